@@ -3,21 +3,54 @@ package main
 import (
 	"flag"
 	"log"
+	"log/slog"
+	"os"
 
 	"github.com/jeroenpf/coda-homework-assignment/internal/api"
+	"github.com/jeroenpf/coda-homework-assignment/internal/limits"
+	"github.com/jeroenpf/coda-homework-assignment/internal/requestid"
+	"github.com/jeroenpf/coda-homework-assignment/internal/tracing"
 )
 
 func main() {
-	var port int
+	slog.SetDefault(slog.New(requestid.NewLogHandler(slog.NewTextHandler(os.Stderr, nil))))
+
+	var port, metricsPort int
+	var otlpEndpoint string
+	var h2cEnabled bool
+	var tlsConfig api.TLSConfig
+	limitsConfig := limits.DefaultConfig()
 	flag.IntVar(&port, "port", 8080, "port to listen on")
+	flag.IntVar(&metricsPort, "metrics-port", 9090, "port to serve Prometheus metrics on (0 disables)")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "host:port of the OTLP/HTTP collector to export traces to (empty disables exporting)")
+	flag.BoolVar(&h2cEnabled, "h2c", false, "accept cleartext HTTP/2 when TLS is disabled")
+	flag.StringVar(&tlsConfig.CertFile, "tls-cert", "", "certificate file, enables HTTPS")
+	flag.StringVar(&tlsConfig.KeyFile, "tls-key", "", "key file of the certificate")
+	flag.StringVar(&tlsConfig.ClientCAFile, "tls-client-ca", "", "CA bundle to verify client certificates, enables mutual TLS")
+	flag.Int64Var(&limitsConfig.MaxBodyBytes, "max-body-bytes", limitsConfig.MaxBodyBytes, "largest request body accepted (0 means no limit)")
+	flag.Int64Var(&limitsConfig.MinReadRate, "min-read-rate", limitsConfig.MinReadRate, "bytes per second clients must send request bodies at (0 disables)")
+	flag.DurationVar(&limitsConfig.ReadRateGrace, "read-rate-grace", limitsConfig.ReadRateGrace, "time before the minimum read rate applies")
+	flag.IntVar(&limitsConfig.MaxHeaderBytes, "max-header-bytes", limitsConfig.MaxHeaderBytes, "largest request line and headers accepted")
+	flag.IntVar(&limitsConfig.MaxHeaderCount, "max-header-count", limitsConfig.MaxHeaderCount, "most request header values accepted (0 means no limit)")
 	flag.Parse()
 
+	tracingConfig := tracing.DefaultConfig("api")
+	if otlpEndpoint != "" {
+		tracingConfig.Exporter = tracing.ExporterOTLP
+		tracingConfig.Endpoint = otlpEndpoint
+	}
+
 	cfg := api.Config{
 		Port:        port,
+		MetricsPort: metricsPort,
 		Environment: "development",
 		ConsulConfig: api.ConsulConfig{
 			Address: "localhost:8500",
 		},
+		H2C:     h2cEnabled,
+		TLS:     tlsConfig,
+		Tracing: tracingConfig,
+		Limits:  limitsConfig,
 	}
 
 	if err := api.Run(cfg); err != nil {
@@ -2,21 +2,159 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"log/slog"
 	"os"
+	"strings"
 
 	"github.com/jeroenpf/coda-homework-assignment/internal/loadbalancer"
+	"github.com/jeroenpf/coda-homework-assignment/internal/requestid"
+	"github.com/jeroenpf/coda-homework-assignment/internal/tracing"
 )
 
 func main() {
-	var port string
+	slog.SetDefault(slog.New(requestid.NewLogHandler(slog.NewTextHandler(os.Stderr, nil))))
+
+	config := loadbalancer.DefaultConfig()
+
+	var port, otlpEndpoint, configFile string
 	flag.StringVar(&port, "port", "8080", "port to listen on")
+	flag.StringVar(&configFile, "config", "", "JSON file with the pools and routes")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "host:port of the OTLP/HTTP collector to export traces to (empty disables exporting)")
+	flag.DurationVar(&config.HealthCheckInterval, "health-check-interval", config.HealthCheckInterval, "default interval of backend health checks")
+	flag.IntVar(&config.MinHealthyBackends, "min-healthy-backends", config.MinHealthyBackends, "number of healthy backends required for /readyz to succeed")
+	flag.DurationVar(&config.ShutdownDelay, "shutdown-delay", config.ShutdownDelay, "how long /readyz fails before the listener closes on shutdown")
+	flag.StringVar(&config.AdminAddr, "admin-addr", config.AdminAddr, "address of the admin API listener (empty disables it)")
+	flag.BoolVar(&config.TrustRequestID, "trust-request-id", config.TrustRequestID, "reuse the X-Request-ID header sent by clients")
+	flag.Func("trusted-proxies", "comma separated addresses or CIDR ranges of proxies whose forwarding headers are kept", func(value string) error {
+		config.Forwarding.TrustedProxies = strings.Split(value, ",")
+		return nil
+	})
+	flag.Func("internal-headers", "comma separated headers removed from client requests and backend responses, X-Internal-* matches a prefix", func(value string) error {
+		config.Forwarding.InternalHeaders = strings.Split(value, ",")
+		return nil
+	})
+	flag.Func("allow-ips", "comma separated addresses or CIDR ranges of the only clients that are accepted", func(value string) error {
+		config.IPAccess.Allow = strings.Split(value, ",")
+		return nil
+	})
+	flag.Func("deny-ips", "comma separated addresses or CIDR ranges of clients that are rejected", func(value string) error {
+		config.IPAccess.Deny = strings.Split(value, ",")
+		return nil
+	})
+	flag.Func("mirror-backends", "comma separated backends of a shadow pool that receives copies of mirrored requests", func(value string) error {
+		config.MirrorBackendUrls = strings.Split(value, ",")
+		return nil
+	})
+	flag.Float64Var(&config.MirrorPercent, "mirror-percent", config.MirrorPercent, "percentage of the requests that is mirrored to the shadow pool")
+	flag.DurationVar(&config.ConfigReloadInterval, "config-reload-interval", config.ConfigReloadInterval, "how often the config file is checked for changed IP access lists (0 disables reloading)")
+	flag.StringVar(&config.Auth.JWT.JWKSFile, "jwks-file", config.Auth.JWT.JWKSFile, "JWKS file with the keys that sign bearer tokens")
+	flag.StringVar(&config.Auth.JWT.JWKSURL, "jwks-url", config.Auth.JWT.JWKSURL, "URL of the JWKS with the keys that sign bearer tokens")
+	flag.StringVar(&config.Auth.JWT.Issuer, "jwt-issuer", config.Auth.JWT.Issuer, "required issuer of bearer tokens")
+	flag.StringVar(&config.Auth.JWT.Audience, "jwt-audience", config.Auth.JWT.Audience, "required audience of bearer tokens")
+	flag.Float64Var(&config.RateLimit.Rate, "rate-limit", config.RateLimit.Rate, "requests per second allowed per client (0 disables rate limiting)")
+	flag.IntVar(&config.RateLimit.Burst, "rate-limit-burst", config.RateLimit.Burst, "requests a client may make at once (defaults to the rate)")
+	flag.StringVar(&config.RateLimit.Key, "rate-limit-key", loadbalancer.RateLimitKeyIP, "identifies clients for rate limiting: ip, api_key or header")
+	flag.StringVar(&config.RateLimit.Header, "rate-limit-header", config.RateLimit.Header, "header that carries the rate limit key for api_key and header")
+	flag.StringVar(&config.RateLimitStore.Type, "rate-limit-store", config.RateLimitStore.Type, "where rate limit counters are kept: local, memory, consul or redis")
+	flag.StringVar(&config.RateLimitStore.Addr, "rate-limit-store-addr", config.RateLimitStore.Addr, "address of the Consul agent or Redis server that shares rate limit counters")
+	flag.DurationVar(&config.RateLimitStore.Window, "rate-limit-window", config.RateLimitStore.Window, "length of the sliding window of shared rate limits")
+	flag.DurationVar(&config.RateLimitStore.SyncInterval, "rate-limit-sync-interval", config.RateLimitStore.SyncInterval, "how often shared rate limit counters are synced")
+	flag.IntVar(&config.RateLimitStore.BatchSize, "rate-limit-batch-size", config.RateLimitStore.BatchSize, "requests of a client that trigger an early sync of shared rate limit counters")
+	flag.IntVar(&config.Concurrency.Limit, "max-concurrent-requests", config.Concurrency.Limit, "requests proxied at once over all pools (0 means no limit)")
+	flag.IntVar(&config.Concurrency.QueueSize, "concurrency-queue-size", config.Concurrency.QueueSize, "requests that wait for a free slot before requests are shed")
+	flag.DurationVar(&config.Concurrency.QueueTimeout, "concurrency-queue-timeout", config.Concurrency.QueueTimeout, "how long requests wait for a free slot (0 waits until the request times out)")
+	flag.BoolVar(&config.Concurrency.Adaptive, "adaptive-concurrency", config.Concurrency.Adaptive, "lower the concurrency limit while backends are slow or failing")
+	flag.IntVar(&config.Concurrency.MinLimit, "adaptive-concurrency-min", config.Concurrency.MinLimit, "lowest concurrency limit of the adaptive limiter")
+	flag.DurationVar(&config.Concurrency.LatencyTarget, "adaptive-concurrency-latency", config.Concurrency.LatencyTarget, "upstream latency above which the adaptive limiter lowers the limit")
+	flag.Int64Var(&config.Limits.MaxBodyBytes, "max-body-bytes", config.Limits.MaxBodyBytes, "largest request body accepted (0 means no limit)")
+	flag.Int64Var(&config.Limits.MinReadRate, "min-read-rate", config.Limits.MinReadRate, "bytes per second clients must send request bodies at (0 disables)")
+	flag.DurationVar(&config.Limits.ReadRateGrace, "read-rate-grace", config.Limits.ReadRateGrace, "time before the minimum read rate applies")
+	flag.IntVar(&config.Limits.MaxHeaderBytes, "max-header-bytes", config.Limits.MaxHeaderBytes, "largest request line and headers accepted")
+	flag.IntVar(&config.Limits.MaxHeaderCount, "max-header-count", config.Limits.MaxHeaderCount, "most request header values accepted (0 means no limit)")
+	flag.BoolVar(&config.H2C, "h2c", config.H2C, "accept cleartext HTTP/2 on the plain HTTP listener")
+	flag.StringVar(&config.Transport.Protocol, "upstream-protocol", config.Transport.Protocol, "protocol spoken to backends: auto, http1 or h2c")
+	flag.DurationVar(&config.Transport.DialTimeout, "upstream-dial-timeout", config.Transport.DialTimeout, "timeout for connecting to a backend")
+	flag.DurationVar(&config.Transport.KeepAlive, "upstream-keepalive", config.Transport.KeepAlive, "interval of TCP keep-alive probes on backend connections")
+	flag.DurationVar(&config.Transport.TLSHandshakeTimeout, "upstream-tls-handshake-timeout", config.Transport.TLSHandshakeTimeout, "timeout for the TLS handshake with a backend")
+	flag.DurationVar(&config.Transport.ResponseHeaderTimeout, "upstream-response-header-timeout", config.Transport.ResponseHeaderTimeout, "time a backend may take to start its response (0 disables)")
+	flag.DurationVar(&config.Transport.IdleConnTimeout, "upstream-idle-timeout", config.Transport.IdleConnTimeout, "how long idle backend connections are kept open")
+	flag.IntVar(&config.Transport.MaxIdleConns, "upstream-max-idle-conns", config.Transport.MaxIdleConns, "maximum number of idle connections to all backends")
+	flag.IntVar(&config.Transport.MaxIdleConnsPerHost, "upstream-max-idle-conns-per-host", config.Transport.MaxIdleConnsPerHost, "maximum number of idle connections to a single backend")
+	flag.IntVar(&config.Transport.MaxConnsPerHost, "upstream-max-conns-per-host", config.Transport.MaxConnsPerHost, "maximum number of connections to a single backend (0 means no limit)")
+	flag.StringVar(&config.TLS.Port, "tls-port", config.TLS.Port, "port of the HTTPS listener (empty disables it)")
+	flag.Func("tls-cert", "certificate and key file as cert.pem:key.pem, may be repeated for SNI", func(value string) error {
+		certFile, keyFile, ok := strings.Cut(value, ":")
+		if !ok {
+			return errors.New("expected cert.pem:key.pem")
+		}
+		config.TLS.Certificates = append(config.TLS.Certificates, loadbalancer.CertificateConfig{CertFile: certFile, KeyFile: keyFile})
+		return nil
+	})
+	flag.StringVar(&config.TLS.MinVersion, "tls-min-version", config.TLS.MinVersion, "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	flag.Func("tls-cipher-suites", "comma separated list of allowed TLS 1.2 cipher suites", func(value string) error {
+		config.TLS.CipherSuites = strings.Split(value, ",")
+		return nil
+	})
+	flag.DurationVar(&config.TLS.ReloadInterval, "tls-reload-interval", config.TLS.ReloadInterval, "how often certificate files are checked for changes")
+	flag.DurationVar(&config.Timeouts.Connect, "timeout-connect", config.Timeouts.Connect, "time to obtain a backend connection (0 disables)")
+	flag.DurationVar(&config.Timeouts.FirstByte, "timeout-first-byte", config.Timeouts.FirstByte, "time until the first byte of the backend response (0 disables)")
+	flag.DurationVar(&config.Timeouts.Total, "timeout-total", config.Timeouts.Total, "time for the whole backend request, propagated to backends (0 disables)")
+	flag.Func("route-timeout", "timeouts by path prefix as /prefix:total=5s,first_byte=2s,connect=500ms, may be repeated", func(value string) error {
+		route, err := loadbalancer.ParseRouteTimeout(value)
+		if err != nil {
+			return err
+		}
+		config.RouteTimeouts = append(config.RouteTimeouts, route)
+		return nil
+	})
+	flag.BoolVar(&config.Cache.Enabled, "cache", config.Cache.Enabled, "cache responses of GET requests that backends mark cacheable")
+	flag.Int64Var(&config.Cache.MaxBytes, "cache-max-bytes", config.Cache.MaxBytes, "memory used by cached responses")
+	flag.Int64Var(&config.Cache.MaxObjectBytes, "cache-max-object-bytes", config.Cache.MaxObjectBytes, "largest response body that is cached")
+	flag.BoolVar(&config.Compression.Enabled, "compress", config.Compression.Enabled, "compress responses for clients that accept gzip or zstd")
+	flag.IntVar(&config.Compression.MinSize, "compress-min-size", config.Compression.MinSize, "smallest response body that is compressed")
+	flag.Func("compress-types", "comma separated content types that are compressed, * matches any part as in text/*", func(value string) error {
+		config.Compression.ContentTypes = strings.Split(value, ",")
+		return nil
+	})
+	flag.Func("compress-encodings", "comma separated encodings offered in order of preference: zstd, gzip", func(value string) error {
+		config.Compression.Encodings = strings.Split(value, ",")
+		return nil
+	})
+	flag.BoolVar(&config.Compression.DecompressRequests, "decompress-requests", config.Compression.DecompressRequests, "decode gzip and zstd request bodies before proxying them")
+	flag.Int64Var(&config.Compression.MaxDecompressedBytes, "max-decompressed-bytes", config.Compression.MaxDecompressedBytes, "largest decoded request body accepted")
+	flag.StringVar(&config.UpstreamTLS.CAFile, "upstream-ca", "", "CA bundle to verify backend certificates")
+	flag.StringVar(&config.UpstreamTLS.CertFile, "upstream-cert", "", "client certificate presented to backends (mutual TLS)")
+	flag.StringVar(&config.UpstreamTLS.KeyFile, "upstream-key", "", "key of the client certificate presented to backends")
+	flag.StringVar(&config.UpstreamTLS.ServerName, "upstream-server-name", "", "server name used for SNI and verification of backend certificates")
+	flag.Func("upstream-pin", "base64 SHA-256 hash of an accepted backend public key, may be repeated", func(value string) error {
+		config.UpstreamTLS.PinnedKeys = append(config.UpstreamTLS.PinnedKeys, value)
+		return nil
+	})
+	flag.BoolVar(&config.AccessLog.Enabled, "access-log", config.AccessLog.Enabled, "write an access log entry for every request")
+	flag.StringVar(&config.AccessLog.Format, "access-log-format", config.AccessLog.Format, "access log format: json, common or combined")
+	flag.StringVar(&config.AccessLog.Output, "access-log-output", config.AccessLog.Output, "access log destination: stdout or the path of a rotated log file")
 	flag.Parse()
 
-	config := loadbalancer.DefaultConfig()
 	config.Port = port
 
+	if backends := os.Getenv("BACKEND_SERVERS"); backends != "" {
+		config.BackendUrls = strings.Split(backends, ",")
+	}
+
+	if configFile != "" {
+		if err := loadbalancer.LoadConfigFile(configFile, &config); err != nil {
+			slog.Error("failed to load config file", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if otlpEndpoint != "" {
+		config.Tracing.Exporter = tracing.ExporterOTLP
+		config.Tracing.Endpoint = otlpEndpoint
+	}
+
 	srv, err := loadbalancer.NewServer(config)
 
 	if err != nil {
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestH2C(t *testing.T) {
+	server, err := createHTTPServer(Config{H2C: true}, NewMetrics())
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+
+	body := []byte(`{"game":"Mobile Legends"}`)
+	resp, err := client.Post("http://"+listener.Addr().String()+"/", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var echoed bytes.Buffer
+	echoed.ReadFrom(resp.Body)
+
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK || echoed.String() != string(body) {
+		t.Errorf("Unexpected response: %d over %s with body %q", resp.StatusCode, resp.Proto, echoed.String())
+	}
+}
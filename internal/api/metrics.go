@@ -0,0 +1,193 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons reported by the validation failure counter
+const (
+	reasonMethod       = "method_not_allowed"
+	reasonContentType  = "invalid_content_type"
+	reasonBody         = "unreadable_body"
+	reasonBodyTooLarge = "body_too_large"
+	reasonSlowBody     = "slow_body"
+	reasonJSON         = "invalid_json"
+)
+
+var sizeBuckets = prometheus.ExponentialBuckets(64, 4, 8)
+
+// Metrics holds the Prometheus collectors of the API server
+type Metrics struct {
+	registry             *prometheus.Registry
+	requestDuration      *prometheus.HistogramVec
+	requestSize          *prometheus.HistogramVec
+	responseSize         *prometheus.HistogramVec
+	validationFailures   *prometheus.CounterVec
+	registrationState    prometheus.Gauge
+	registrationAttempts *prometheus.CounterVec
+}
+
+// NewMetrics creates the API server collectors and registers them on a dedicated registry
+func NewMetrics() *Metrics {
+	labels := []string{"method", "route", "code"}
+
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "api_http_request_duration_seconds",
+			Help:    "Time spent handling HTTP requests.",
+			Buckets: prometheus.DefBuckets,
+		}, labels),
+		requestSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "api_http_request_size_bytes",
+			Help:    "Size of HTTP request bodies.",
+			Buckets: sizeBuckets,
+		}, labels),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "api_http_response_size_bytes",
+			Help:    "Size of HTTP response bodies.",
+			Buckets: sizeBuckets,
+		}, labels),
+		validationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "api_json_validation_failures_total",
+			Help: "Number of rejected echo requests by reason.",
+		}, []string{"reason"}),
+		registrationState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "api_consul_registered",
+			Help: "Whether the service is currently registered with Consul (1) or not (0).",
+		}),
+		registrationAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "api_consul_registration_attempts_total",
+			Help: "Number of Consul registration attempts by result.",
+		}, []string{"result"}),
+	}
+
+	m.registry.MustRegister(
+		m.requestDuration,
+		m.requestSize,
+		m.responseSize,
+		m.validationFailures,
+		m.registrationState,
+		m.registrationAttempts,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Handler returns the handler that exposes the collected metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+func (m *Metrics) validationFailed(reason string) {
+	m.validationFailures.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) registrationAttempt(err error) {
+	if err != nil {
+		m.registrationAttempts.WithLabelValues("failure").Inc()
+		return
+	}
+
+	m.registrationAttempts.WithLabelValues("success").Inc()
+	m.registrationState.Set(1)
+}
+
+func (m *Metrics) deregistered() {
+	m.registrationState.Set(0)
+}
+
+// withMetrics records size and latency histograms for the wrapped handler
+func withMetrics(m *Metrics, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(rec, r)
+
+		labels := prometheus.Labels{
+			"method": r.Method,
+			"route":  r.Pattern,
+			"code":   strconv.Itoa(rec.status),
+		}
+
+		m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+		m.requestSize.With(labels).Observe(float64(body.n))
+		m.responseSize.With(labels).Observe(float64(rec.written))
+	}
+}
+
+func createMetricsServer(cfg Config, m *Metrics) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+
+	return &http.Server{
+		Addr:         fmt.Sprintf("0.0.0.0:%d", cfg.MetricsPort),
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+func runMetricsServer(server *http.Server) error {
+	slog.Info("starting metrics server", "addr", server.Addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("metrics server failed to start: %w", err)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// responseRecorder captures the status code and number of bytes written to a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
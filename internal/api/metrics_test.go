@@ -0,0 +1,113 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/limits"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", withMetrics(metrics, jsonEchoHandler(metrics)))
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		reason      string
+	}{
+		{
+			name:   "Invalid http method",
+			method: http.MethodGet,
+			reason: reasonMethod,
+		},
+		{
+			name:   "Invalid content type",
+			method: http.MethodPost,
+			body:   `{"points":20}`,
+			reason: reasonContentType,
+		},
+		{
+			name:        "Invalid JSON",
+			method:      http.MethodPost,
+			contentType: "application/json",
+			body:        "{invalid}",
+			reason:      reasonJSON,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", bytes.NewBufferString(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			mux.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got := testutil.ToFloat64(metrics.validationFailures.WithLabelValues(tt.reason)); got != 1 {
+				t.Errorf("validation failures for %s: got %v want 1", tt.reason, got)
+			}
+		})
+	}
+
+	t.Run("Body too large", func(t *testing.T) {
+		handler := limits.Middleware(limits.Config{MaxBodyBytes: 8}, mux)
+
+		// The length of the body is unknown up front, so the limit is hit while reading it
+		req := httptest.NewRequest(http.MethodPost, "/", io.MultiReader(strings.NewReader(`{"points":20}`)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("status: got %d want %d", rec.Code, http.StatusRequestEntityTooLarge)
+		}
+		if got := testutil.ToFloat64(metrics.validationFailures.WithLabelValues(reasonBodyTooLarge)); got != 1 {
+			t.Errorf("validation failures for %s: got %v want 1", reasonBodyTooLarge, got)
+		}
+	})
+
+	t.Run("Request and response sizes are observed", func(t *testing.T) {
+		body := `{"game":"Mobile Legends", "gamerID":"GYUTDTE", "points":20}`
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+
+		expected := `
+# HELP api_http_response_size_bytes Size of HTTP response bodies.
+# TYPE api_http_response_size_bytes histogram
+`
+		rec := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		if !strings.Contains(rec.Body.String(), strings.TrimSpace(expected)) {
+			t.Fatalf("response size histogram missing from metrics output")
+		}
+
+		sumLine := `api_http_response_size_bytes_sum{code="200",method="POST",route="/"} 59`
+		if !strings.Contains(rec.Body.String(), sumLine) {
+			t.Errorf("expected %q in metrics output", sumLine)
+		}
+	})
+
+	t.Run("Registration state follows attempts", func(t *testing.T) {
+		metrics.registrationAttempt(nil)
+		if got := testutil.ToFloat64(metrics.registrationState); got != 1 {
+			t.Errorf("registration state: got %v want 1", got)
+		}
+
+		metrics.deregistered()
+		if got := testutil.ToFloat64(metrics.registrationState); got != 0 {
+			t.Errorf("registration state: got %v want 0", got)
+		}
+	})
+}
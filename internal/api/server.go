@@ -16,9 +16,26 @@ import (
 	"github.com/avast/retry-go/v4"
 	"github.com/google/uuid"
 	"github.com/hashicorp/consul/api"
+	"github.com/jeroenpf/coda-homework-assignment/internal/deadline"
+	"github.com/jeroenpf/coda-homework-assignment/internal/limits"
+	"github.com/jeroenpf/coda-homework-assignment/internal/requestid"
+	"github.com/jeroenpf/coda-homework-assignment/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/sync/errgroup"
 )
 
+const tracerName = "github.com/jeroenpf/coda-homework-assignment/internal/api"
+
+// tracer returns the tracer of the package
+func tracer() trace.Tracer {
+	return tracing.Tracer(tracerName)
+}
+
 type ConsulConfig struct {
 	Address string
 	Timeout time.Duration
@@ -26,8 +43,15 @@ type ConsulConfig struct {
 
 type Config struct {
 	Port         int
+	MetricsPort  int
 	ConsulConfig ConsulConfig
 	Environment  string
+	// H2C accepts cleartext HTTP/2 when the API is not served over TLS
+	H2C     bool
+	TLS     TLSConfig
+	Tracing tracing.Config
+	// Limits bounds the size of requests and how slowly clients may send them
+	Limits limits.Config
 }
 
 func Run(cfg Config) error {
@@ -39,25 +63,52 @@ func Run(cfg Config) error {
 		return fmt.Errorf("init consul client: %w", err)
 	}
 
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
+	if err != nil {
+		return fmt.Errorf("init tracing: %w", err)
+	}
+	defer func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			slog.Error("failed to shutdown tracing", "error", err)
+		}
+	}()
+
 	serviceId := fmt.Sprintf("backend-%s", uuid.New())
 	registration := createServiceRegistration(serviceId, cfg)
 
+	metrics := NewMetrics()
+
 	// Set up the HTTP server
-	server := createHTTPServer(cfg)
+	server, err := createHTTPServer(cfg, metrics)
+	if err != nil {
+		return fmt.Errorf("create http server: %w", err)
+	}
+	servers := []*http.Server{server}
 	g, gCtx := errgroup.WithContext(ctx)
 	// Start the API
 	g.Go(func() error {
-		return runHTTPServer(server)
+		return runHTTPServer(server, cfg.TLS.Enabled())
 	})
 
+	// Serve metrics on their own port so they are not exposed through the load balancer
+	if cfg.MetricsPort != 0 {
+		metricsServer := createMetricsServer(cfg, metrics)
+		servers = append(servers, metricsServer)
+		g.Go(func() error {
+			return runMetricsServer(metricsServer)
+		})
+	}
+
 	// Register service with Consul
 	g.Go(func() error {
-		return registerServiceWithRetry(ctx, consulClient, registration)
+		return registerServiceWithRetry(ctx, consulClient, registration, metrics)
 	})
 
 	// Handle context done and termination signals
 	g.Go(func() error {
-		return handleShutdown(gCtx, server, consulClient, serviceId, cancel)
+		return handleShutdown(gCtx, consulClient, serviceId, cancel, metrics, servers...)
 	})
 
 	if err := g.Wait(); err != nil {
@@ -71,7 +122,8 @@ func withLogging(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		handler(w, r)
-		slog.Info(
+		slog.InfoContext(
+			r.Context(),
 			"Request handled",
 			"method", r.Method,
 			"path", r.URL.Path,
@@ -82,21 +134,50 @@ func withLogging(handler http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// withTracing continues the trace propagated by the caller in a server span
+func withTracing(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer().Start(tracing.Extract(r), "api.request",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(tracing.RequestAttributes(r)...),
+		)
+		defer span.End()
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(rec, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPRoute(r.Pattern), semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	}
+}
+
 func healthCheckHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
-func jsonEchoHandler() http.HandlerFunc {
+func jsonEchoHandler(metrics *Metrics) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		_, span := tracer().Start(r.Context(), "api.json_echo")
+		defer span.End()
+
+		rejected := func(reason string) {
+			metrics.validationFailed(reason)
+			span.AddEvent("validation failed", trace.WithAttributes(attribute.String("reason", reason)))
+		}
+
 		if r.Method != http.MethodPost {
+			rejected(reasonMethod)
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
 
 		// Ensure that we are receiving JSON
 		if r.Header.Get("Content-Type") != "application/json" {
+			rejected(reasonContentType)
 			http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
 			return
 		}
@@ -104,17 +185,37 @@ func jsonEchoHandler() http.HandlerFunc {
 		// Get the body
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			http.Error(w, "Invalid body", http.StatusBadRequest)
+			switch status := limits.StatusCode(err); status {
+			case http.StatusRequestEntityTooLarge:
+				rejected(reasonBodyTooLarge)
+				http.Error(w, "Body too large", status)
+			case http.StatusRequestTimeout:
+				rejected(reasonSlowBody)
+				http.Error(w, "Body sent too slowly", status)
+			default:
+				rejected(reasonBody)
+				http.Error(w, "Invalid body", http.StatusBadRequest)
+			}
+			return
+		}
+
+		// The caller already gave up, so there is no point in answering
+		if err := r.Context().Err(); err != nil {
+			span.AddEvent("deadline exceeded")
+			http.Error(w, "Deadline exceeded", http.StatusGatewayTimeout)
 			return
 		}
 
 		// Ensure we received valid JSON body
 		var jsonData interface{}
 		if err := json.Unmarshal(body, &jsonData); err != nil {
+			rejected(reasonJSON)
 			http.Error(w, "Invalid JSON", http.StatusBadRequest)
 			return
 		}
 
+		span.SetAttributes(attribute.Int("body.size", len(body)))
+
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 
@@ -130,6 +231,26 @@ func initConsulClient(cfg ConsulConfig) (*api.Client, error) {
 }
 
 func createServiceRegistration(serviceId string, cfg Config) *api.AgentServiceRegistration {
+	scheme := "http"
+	if cfg.TLS.Enabled() {
+		scheme = "https"
+	}
+
+	check := &api.AgentServiceCheck{
+		HTTP:                           fmt.Sprintf("%s://host.docker.internal:%d/healthz", scheme, cfg.Port),
+		TLSSkipVerify:                  cfg.TLS.Enabled(),
+		Interval:                       "10s",
+		Timeout:                        "5s",
+		DeregisterCriticalServiceAfter: "30s",
+	}
+
+	// The Consul agent has no client certificate, so fall back to a TCP check when one is required
+	if cfg.TLS.RequireClientCert() {
+		check.HTTP = ""
+		check.TLSSkipVerify = false
+		check.TCP = fmt.Sprintf("host.docker.internal:%d", cfg.Port)
+	}
+
 	return &api.AgentServiceRegistration{
 		ID:      serviceId,
 		Name:    "backend",
@@ -139,39 +260,66 @@ func createServiceRegistration(serviceId string, cfg Config) *api.AgentServiceRe
 		Meta: map[string]string{
 			"version": "1.0",
 			"env":     cfg.Environment,
+			"scheme":  scheme,
 		},
-		Check: &api.AgentServiceCheck{
-			HTTP:                           fmt.Sprintf("http://host.docker.internal:%d/healthz", cfg.Port),
-			Interval:                       "10s",
-			Timeout:                        "5s",
-			DeregisterCriticalServiceAfter: "30s",
-		},
+		Check: check,
 	}
 }
 
-func createHTTPServer(cfg Config) *http.Server {
+func createHTTPServer(cfg Config, metrics *Metrics) (*http.Server, error) {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", withLogging(jsonEchoHandler()))
-	mux.HandleFunc("/healthz", withLogging(healthCheckHandler()))
+	mux.HandleFunc("/", withLogging(withMetrics(metrics, withTracing(jsonEchoHandler(metrics)))))
+	mux.HandleFunc("/healthz", withLogging(withMetrics(metrics, withTracing(healthCheckHandler()))))
+
+	server := &http.Server{
+		Addr:           fmt.Sprintf("0.0.0.0:%d", cfg.Port),
+		Handler:        requestid.Middleware(true, deadline.Middleware(limits.Middleware(cfg.Limits, mux))),
+		ReadTimeout:    15 * time.Second,
+		WriteTimeout:   15 * time.Second,
+		IdleTimeout:    60 * time.Second,
+		MaxHeaderBytes: cfg.Limits.MaxHeaderBytes,
+	}
+
+	if cfg.TLS.Enabled() {
+		tlsConfig, err := newServerTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig = tlsConfig
+	}
 
-	return &http.Server{
-		Addr:         fmt.Sprintf("0.0.0.0:%d", cfg.Port),
-		Handler:      mux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	// HTTP/2 is negotiated during the TLS handshake, without TLS it is only spoken by clients with prior knowledge
+	if cfg.TLS.Enabled() || cfg.H2C {
+		h2s := &http2.Server{IdleTimeout: server.IdleTimeout}
+		if err := http2.ConfigureServer(server, h2s); err != nil {
+			return nil, fmt.Errorf("configure http/2: %w", err)
+		}
+		if !cfg.TLS.Enabled() {
+			server.Handler = h2c.NewHandler(server.Handler, h2s)
+		}
 	}
+
+	return server, nil
 }
 
-func runHTTPServer(server *http.Server) error {
-	slog.Info(fmt.Sprintf("Starting API server on port %s", server.Addr))
-	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+func runHTTPServer(server *http.Server, useTLS bool) error {
+	slog.Info(fmt.Sprintf("Starting API server on port %s", server.Addr), "tls", useTLS)
+
+	// Certificates are part of the TLS config, so no files have to be passed
+	var err error
+	if useTLS {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("server failed to start: %v", err)
 	}
 	return nil
 }
 
-func handleShutdown(ctx context.Context, server *http.Server, consulClient *api.Client, serviceId string, cancel context.CancelFunc) error {
+func handleShutdown(ctx context.Context, consulClient *api.Client, serviceId string, cancel context.CancelFunc, metrics *Metrics, servers ...*http.Server) error {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
@@ -185,29 +333,41 @@ func handleShutdown(ctx context.Context, server *http.Server, consulClient *api.
 	defer shutdownCancel()
 
 	if err := consulClient.Agent().ServiceDeregister(serviceId); err != nil {
-		slog.Error("deregistering service failed: %v", err)
+		slog.Error("deregistering service failed", "error", err)
 	}
+	metrics.deregistered()
 
 	cancel()
 
 	slog.Info("initiating graceful shutdown")
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		return fmt.Errorf("server failed to shutdown: %v", err)
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			return fmt.Errorf("server failed to shutdown: %v", err)
+		}
 	}
 
 	return nil
 }
 
-func registerServiceWithRetry(ctx context.Context, consulClient *api.Client, registration *api.AgentServiceRegistration) error {
-	return retry.Do(func() error {
-		return consulClient.Agent().ServiceRegister(registration)
+func registerServiceWithRetry(ctx context.Context, consulClient *api.Client, registration *api.AgentServiceRegistration, metrics *Metrics) error {
+	err := retry.Do(func() error {
+		err := consulClient.Agent().ServiceRegister(registration)
+		metrics.registrationAttempt(err)
+		return err
 	},
 		retry.OnRetry(func(u uint, err error) {
-			slog.Warn("service registration failed, retrying", "attempt", u+1, err)
+			slog.Warn("service registration failed, retrying", "attempt", u+1, "error", err)
 		}),
 		retry.Context(ctx),
 		retry.Attempts(5),
 		retry.Delay(time.Second),
 		retry.DelayType(retry.BackOffDelay),
 	)
+
+	// Giving up on registration because we are shutting down is not an error
+	if err != nil && ctx.Err() != nil {
+		return nil
+	}
+
+	return err
 }
@@ -5,10 +5,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/deadline"
 )
 
 func TestServer(t *testing.T) {
@@ -103,6 +107,9 @@ func TestServer(t *testing.T) {
 		})
 	}
 
+	// Idle keep-alive connections would delay the graceful shutdown
+	client.CloseIdleConnections()
+
 	p, err := os.FindProcess(os.Getpid())
 	if err != nil {
 		t.Fatalf("Failed to find process: %v", err)
@@ -128,3 +135,34 @@ func TestServer(t *testing.T) {
 		t.Error("Server should not be accepting connections")
 	}
 }
+
+func TestDeadline(t *testing.T) {
+	server, err := createHTTPServer(Config{}, NewMetrics())
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		timeout        string
+		expectedStatus int
+	}{
+		{name: "Enough time left", timeout: "1000", expectedStatus: http.StatusOK},
+		{name: "Caller already gave up", timeout: "0", expectedStatus: http.StatusGatewayTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"game":"Mobile Legends"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(deadline.Header, tt.timeout)
+
+			rec := httptest.NewRecorder()
+			server.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("server returned wrong status code: got %v want %v", rec.Code, tt.expectedStatus)
+			}
+		})
+	}
+}
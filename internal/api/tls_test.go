@@ -0,0 +1,79 @@
+package api
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/testca"
+)
+
+func TestMutualTLS(t *testing.T) {
+	ca := testca.New(t)
+	dir := t.TempDir()
+
+	certFile, keyFile := ca.IssueFiles(t, dir, "api", "api.internal")
+	cfg := Config{
+		TLS: TLSConfig{
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			ClientCAFile: ca.WriteFile(t, dir),
+		},
+	}
+
+	server, err := createHTTPServer(cfg, NewMetrics())
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	url := "https://" + listener.Addr().String() + "/healthz"
+
+	clientCertPEM, clientKeyPEM := ca.Issue(t, "loadbalancer")
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatalf("Failed to load client certificate: %v", err)
+	}
+
+	t.Run("Client with certificate", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      ca.Pool,
+			Certificates: []tls.Certificate{clientCert},
+		}}}
+
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected status code: %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Client without certificate is rejected", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs: ca.Pool,
+		}}}
+
+		if resp, err := client.Get(url); err == nil {
+			resp.Body.Close()
+			t.Error("Expected the request to fail without a client certificate")
+		}
+	})
+
+	t.Run("Registration announces HTTPS", func(t *testing.T) {
+		registration := createServiceRegistration("backend-test", cfg)
+		if registration.Meta["scheme"] != "https" || registration.Check.TCP == "" {
+			t.Errorf("Unexpected registration: meta %v, check %+v", registration.Meta, registration.Check)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/tracing/tracingtest"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracingtest.InstallInMemory("api")
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentSpanID = "00f067aa0ba902b7"
+
+	handler := withTracing(jsonEchoHandler(NewMetrics()))
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("{invalid}"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+	handler(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+
+	for _, span := range spans {
+		if span.SpanContext.TraceID().String() != traceID {
+			t.Errorf("Span %s has trace ID %s, expected %s", span.Name, span.SpanContext.TraceID(), traceID)
+		}
+
+		switch span.Name {
+		case "api.request":
+			if span.Parent.SpanID().String() != parentSpanID {
+				t.Errorf("Request span has parent %s, expected %s", span.Parent.SpanID(), parentSpanID)
+			}
+		case "api.json_echo":
+			if len(span.Events) != 1 || span.Events[0].Name != "validation failed" {
+				t.Errorf("Expected a validation failed event, got %v", span.Events)
+			}
+		default:
+			t.Errorf("Unexpected span %s", span.Name)
+		}
+	}
+}
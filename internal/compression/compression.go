@@ -0,0 +1,417 @@
+// Package compression compresses responses in the encoding clients prefer and decompresses request bodies
+package compression
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported content codings
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// ErrInvalidBody is returned when reading a request body that is not valid in its content coding
+var ErrInvalidBody = errors.New("invalid compressed request body")
+
+// Config decides which responses are compressed and whether compressed request bodies are accepted
+type Config struct {
+	Enabled bool
+	// Encodings are offered in order of preference when clients accept several with the same quality
+	Encodings []string
+	// ContentTypes are the media types that are compressed, a * matches any part such as text/* or application/*+json
+	ContentTypes []string
+	// MinSize is the smallest response body that is compressed, smaller bodies do not get any smaller
+	MinSize int
+	// DecompressRequests decodes gzip and zstd request bodies, so handlers only see plain bodies. Other encodings are
+	// answered with 415 Unsupported Media Type.
+	DecompressRequests bool
+	// MaxDecompressedBytes limits the size of a decompressed body, as a small body can expand enormously
+	MaxDecompressedBytes int64
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Encodings: []string{Zstd, Gzip},
+		ContentTypes: []string{
+			"text/*",
+			"application/json",
+			"application/*+json",
+			"application/javascript",
+			"application/xml",
+			"application/*+xml",
+			"image/svg+xml",
+		},
+		MinSize:              1 << 10,
+		MaxDecompressedBytes: 10 << 20,
+	}
+}
+
+// StatusCode returns the status to answer a failed body read with, or 0 when the error is not caused by the coding
+func StatusCode(err error) int {
+	if errors.Is(err, ErrInvalidBody) {
+		return http.StatusBadRequest
+	}
+	return 0
+}
+
+// Validate checks that the encodings are supported
+func (c Config) Validate() error {
+	for _, encoding := range c.Encodings {
+		if _, ok := encoders[encoding]; !ok {
+			return fmt.Errorf("unsupported encoding %q", encoding)
+		}
+	}
+	return nil
+}
+
+// Middleware decompresses request bodies and compresses the responses of next, unsupported encodings in the config
+// are never offered
+func Middleware(cfg Config, next http.Handler) http.Handler {
+	cfg.Encodings = slices.DeleteFunc(slices.Clone(cfg.Encodings), func(encoding string) bool {
+		_, ok := encoders[encoding]
+		return !ok
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.DecompressRequests {
+			if !decompressBody(w, r, cfg.MaxDecompressedBytes) {
+				http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+
+		if !cfg.Enabled || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		encoding := negotiate(r.Header.Values("Accept-Encoding"), cfg.Encodings)
+		cw := &compressWriter{ResponseWriter: w, config: &cfg, encoding: encoding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// decompressBody replaces a compressed request body with its decoded content, it returns false for an encoding it
+// can not decode
+func decompressBody(w http.ResponseWriter, r *http.Request, maxBytes int64) bool {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+
+	var decoded io.ReadCloser
+	switch encoding {
+	case Gzip, "x-gzip":
+		decoded = newDecodedBody(r.Body, openGzip)
+	case Zstd:
+		decoded = newDecodedBody(r.Body, openZstd)
+	default:
+		return false
+	}
+
+	if maxBytes > 0 {
+		decoded = http.MaxBytesReader(w, decoded, maxBytes)
+	}
+	r.Body = decoded
+	r.ContentLength = -1
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	return true
+}
+
+// decodedBody decodes a request body, the decoder is created on the first read so the body is not read before the
+// handler uses it
+type decodedBody struct {
+	body    io.ReadCloser
+	source  source
+	open    func(io.Reader) (io.ReadCloser, error)
+	decoder io.ReadCloser
+}
+
+func newDecodedBody(body io.ReadCloser, open func(io.Reader) (io.ReadCloser, error)) *decodedBody {
+	return &decodedBody{body: body, source: source{r: body}, open: open}
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	if b.decoder == nil {
+		decoder, err := b.open(&b.source)
+		if err != nil {
+			return 0, b.invalid(err)
+		}
+		b.decoder = decoder
+	}
+	n, err := b.decoder.Read(p)
+	return n, b.invalid(err)
+}
+
+func (b *decodedBody) Close() error {
+	if b.decoder != nil {
+		_ = b.decoder.Close()
+	}
+	return b.body.Close()
+}
+
+// invalid marks errors of the decoder as invalid bodies, unless reading the body itself failed, e.g. because it
+// exceeded a limit
+func (b *decodedBody) invalid(err error) error {
+	if err == nil || err == io.EOF || b.source.err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrInvalidBody, err)
+}
+
+// source remembers the last error reading the compressed body
+type source struct {
+	r   io.Reader
+	err error
+}
+
+func (s *source) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+func openGzip(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// openZstd decodes without the background goroutines of a concurrent decoder
+func openZstd(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// negotiate picks the encoding with the highest quality in Accept-Encoding, preferring the order of the offered
+// encodings. It returns an empty string when the response should not be encoded.
+func negotiate(accept []string, offered []string) string {
+	qualities := make(map[string]float64)
+	for _, value := range accept {
+		for _, part := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "" {
+				continue
+			}
+
+			q := 1.0
+			if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+			qualities[coding] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range offered {
+		q, ok := qualities[encoding]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressible reports whether the media type of the content type is in the allowlist
+func compressible(contentType string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(allowed, func(pattern string) bool {
+		prefix, suffix, wildcard := strings.Cut(strings.ToLower(pattern), "*")
+		if !wildcard {
+			return mediaType == prefix
+		}
+		return len(mediaType) >= len(prefix)+len(suffix) &&
+			strings.HasPrefix(mediaType, prefix) && strings.HasSuffix(mediaType, suffix)
+	})
+}
+
+// streamed reports whether the content type is a stream of events that is flushed as it is produced
+func streamed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "text/event-stream" || mediaType == "application/x-ndjson")
+}
+
+// encoder compresses a response, encoders are reused through pools
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var encoders = map[string]*sync.Pool{
+	Gzip: {New: func() any { return gzip.NewWriter(nil) }},
+	Zstd: {New: func() any {
+		// Without options the encoder never fails
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	}},
+}
+
+// compressWriter buffers the start of the response until it knows whether compressing it is worthwhile
+type compressWriter struct {
+	http.ResponseWriter
+	config   *Config
+	encoding string
+
+	status      int
+	wroteHeader bool
+	// decided is set once the headers have been passed on, enc is nil when the response is sent as is
+	decided bool
+	buf     []byte
+	enc     encoder
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if status < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.wroteHeader {
+		return
+	}
+	cw.status = status
+	cw.wroteHeader = true
+
+	h := cw.Header()
+	if !cw.eligible(h) {
+		cw.start(false)
+		return
+	}
+	if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+		cw.start(length >= cw.config.MinSize)
+	}
+}
+
+// eligible reports whether the response may be compressed at all, it adds Vary when the encoding could differ
+func (cw *compressWriter) eligible(h http.Header) bool {
+	switch {
+	case cw.status == http.StatusNoContent, cw.status == http.StatusNotModified,
+		cw.status == http.StatusPartialContent:
+		return false
+	case h.Get("Content-Encoding") != "", h.Get("Content-Range") != "":
+		// The backend already compressed the response, or sent part of it
+		return false
+	case strings.Contains(strings.ToLower(h.Get("Cache-Control")), "no-transform"):
+		return false
+	case !compressible(h.Get("Content-Type"), cw.config.ContentTypes):
+		return false
+	}
+
+	h.Add("Vary", "Accept-Encoding")
+	return cw.encoding != ""
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.config.MinSize {
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// start passes the headers on and writes the buffered start of the response, compressed or not
+func (cw *compressWriter) start(compress bool) error {
+	cw.decided = true
+
+	h := cw.Header()
+	if compress {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+		// The compressed representation is not byte for byte identical to the one the ETag was made for
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+
+		cw.enc = encoders[cw.encoding].Get().(encoder)
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	buf := cw.buf
+	cw.buf = nil
+	if cw.enc != nil {
+		_, err := cw.enc.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// Flush sends what was written so far. A reverse proxy flushes after every write of a response without a length, so
+// other responses below the minimum size stay buffered until they reach it or complete. Only event streams, which
+// must reach the client as they are written, are compressed right away.
+func (cw *compressWriter) Flush() {
+	if cw.wroteHeader && !cw.decided {
+		if !streamed(cw.Header().Get("Content-Type")) {
+			return
+		}
+		_ = cw.start(true)
+	}
+	if cw.enc != nil {
+		_ = cw.enc.Flush()
+	}
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// close completes the response once the handler returned, responses below the minimum size are sent as is
+func (cw *compressWriter) close() {
+	if cw.wroteHeader && !cw.decided {
+		_ = cw.start(false)
+	}
+	if cw.enc != nil {
+		_ = cw.enc.Close()
+		cw.enc.Reset(nil)
+		encoders[cw.encoding].Put(cw.enc)
+		cw.enc = nil
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
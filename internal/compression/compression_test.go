@@ -0,0 +1,280 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(data)); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decode(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+
+	var r io.Reader
+	var err error
+	switch encoding {
+	case Gzip:
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case Zstd:
+		var decoder *zstd.Decoder
+		decoder, err = zstd.NewReader(bytes.NewReader(body))
+		if err == nil {
+			defer decoder.Close()
+		}
+		r = decoder
+	default:
+		return string(body)
+	}
+	if err != nil {
+		t.Fatalf("Failed to decode %s: %v", encoding, err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to decode %s: %v", encoding, err)
+	}
+	return string(data)
+}
+
+func TestNegotiate(t *testing.T) {
+	offered := []string{Zstd, Gzip}
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{"", ""},
+		{"gzip", Gzip},
+		{"gzip, deflate, br, zstd", Zstd},
+		{"zstd;q=0.5, gzip", Gzip},
+		{"gzip;q=0, zstd;q=0", ""},
+		{"*", Zstd},
+		{"zstd;q=0, *;q=0.1", Gzip},
+		{"identity", ""},
+	}
+
+	for _, tt := range tests {
+		if got := negotiate([]string{tt.accept}, offered); got != tt.expected {
+			t.Errorf("Accept-Encoding %q: expected %q, got %q", tt.accept, tt.expected, got)
+		}
+	}
+}
+
+func TestCompressResponses(t *testing.T) {
+	large := strings.Repeat(`{"player":"one","points":20}`, 100)
+	config := DefaultConfig()
+	config.Enabled = true
+	handler := Middleware(config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		w.Header().Set("Content-Type", query.Get("type"))
+		w.Header().Set("ETag", `"v1"`)
+		if encoding := query.Get("encoding"); encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		if query.Get("length") != "" {
+			w.Header().Set("Content-Length", query.Get("length"))
+		}
+
+		body := large
+		if query.Get("small") != "" {
+			body = `{"points":20}`
+		}
+		// Write in pieces, as a proxied response arrives
+		for _, chunk := range strings.Split(body, "},") {
+			_, _ = io.WriteString(w, chunk)
+		}
+	}))
+	expected := strings.ReplaceAll(large, "},", "")
+
+	tests := []struct {
+		name     string
+		target   string
+		accept   string
+		encoding string
+	}{
+		{"zstd preferred", "/?type=application/json", "gzip, zstd", Zstd},
+		{"gzip", "/?type=application/json;charset=utf-8", "gzip", Gzip},
+		{"not accepted", "/?type=application/json", "", ""},
+		{"type not in allowlist", "/?type=image/png", "gzip", ""},
+		{"wildcard type", "/?type=text/html", "gzip", Gzip},
+		{"already compressed", "/?type=application/json&encoding=br", "gzip", "br"},
+		{"below minimum size", "/?type=application/json&small=1", "gzip", ""},
+		{"content length below minimum size", "/?type=application/json&length=10", "gzip", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Header.Set("Accept-Encoding", tt.accept)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if got := rr.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Fatalf("Expected encoding %q, got %q", tt.encoding, got)
+			}
+			if tt.encoding == Gzip || tt.encoding == Zstd {
+				if body := decode(t, tt.encoding, rr.Body.Bytes()); body != expected {
+					t.Errorf("Expected the decoded body to match, got %d bytes", len(body))
+				}
+				if rr.Header().Get("Content-Length") != "" || rr.Header().Get("ETag") != `W/"v1"` {
+					t.Errorf("Expected no content length and a weak etag, got %v", rr.Header())
+				}
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/?type=application/json", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected compressible responses to vary by Accept-Encoding, got %q", rr.Header().Get("Vary"))
+	}
+}
+
+func TestCompressStreamedResponse(t *testing.T) {
+	flushed := make(chan struct{})
+	handler := Middleware(Config{Enabled: true, Encodings: []string{Gzip}, ContentTypes: []string{"text/*"}, MinSize: 1024},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = io.WriteString(w, "data: first\n\n")
+			http.NewResponseController(w).Flush()
+			<-flushed
+			_, _ = io.WriteString(w, "data: second\n\n")
+		}))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Encoding") != Gzip {
+		t.Fatalf("Expected a gzip response, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read the flushed gzip header: %v", err)
+	}
+	first := make([]byte, len("data: first\n\n"))
+	if _, err := io.ReadFull(gz, first); err != nil || string(first) != "data: first\n\n" {
+		t.Fatalf("Expected the first event before the response completed, got %q: %v", first, err)
+	}
+
+	close(flushed)
+	rest, err := io.ReadAll(gz)
+	if err != nil || string(rest) != "data: second\n\n" {
+		t.Errorf("Expected the second event, got %q: %v", rest, err)
+	}
+}
+
+func TestCompressProxiedChunkedResponse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"points":`)
+		http.NewResponseController(w).Flush()
+		_, _ = io.WriteString(w, `20}`)
+	}))
+	defer backend.Close()
+
+	// The proxy flushes after every write of a response without a length, which must not force small responses to be
+	// compressed
+	target, _ := url.Parse(backend.URL)
+	handler := Middleware(Config{Enabled: true, Encodings: []string{Gzip}, ContentTypes: []string{"application/json"}, MinSize: 1024},
+		httputil.NewSingleHostReverseProxy(target))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != `{"points":20}` {
+		t.Errorf("Expected the small response as is, got %q %q", rr.Header().Get("Content-Encoding"), rr.Body.String())
+	}
+}
+
+func TestDecompressRequests(t *testing.T) {
+	var received []byte
+	var readErr error
+	handler := Middleware(Config{DecompressRequests: true, MaxDecompressedBytes: 1024},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received, readErr = io.ReadAll(r.Body)
+			if r.Header.Get("Content-Encoding") != "" {
+				t.Error("Expected the content encoding to be removed")
+			}
+		}))
+
+	zstdBody := func(data string) []byte {
+		encoder, _ := zstd.NewWriter(nil)
+		defer encoder.Close()
+		return encoder.EncodeAll([]byte(data), nil)
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+		expected string
+		err      func(error) bool
+	}{
+		{name: "plain", body: []byte(`{"points":20}`), status: http.StatusOK, expected: `{"points":20}`},
+		{name: "gzip", encoding: "gzip", body: gzipped(t, `{"points":20}`), status: http.StatusOK, expected: `{"points":20}`},
+		{name: "zstd", encoding: "zstd", body: zstdBody(`{"points":20}`), status: http.StatusOK, expected: `{"points":20}`},
+		{name: "unsupported", encoding: "br", body: []byte("?"), status: http.StatusUnsupportedMediaType},
+		{name: "corrupt", encoding: "gzip", body: []byte("not gzip"), status: http.StatusOK,
+			err: func(err error) bool { return StatusCode(err) == http.StatusBadRequest }},
+		{name: "too large once decoded", encoding: "gzip", body: gzipped(t, strings.Repeat("a", 4096)), status: http.StatusOK,
+			err: func(err error) bool {
+				var maxBytesErr *http.MaxBytesError
+				return errors.As(err, &maxBytesErr)
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received, readErr = nil, nil
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Encoding", tt.encoding)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, rr.Code)
+			}
+			if tt.err != nil {
+				if !tt.err(readErr) {
+					t.Errorf("Unexpected read error %v", readErr)
+				}
+				return
+			}
+			if tt.status == http.StatusOK && (readErr != nil || string(received) != tt.expected) {
+				t.Errorf("Expected body %q, got %q: %v", tt.expected, received, readErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+// Package deadline propagates the time a caller is willing to wait for a response across hops
+package deadline
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header carries the remaining time until the deadline in milliseconds. A duration is used instead of an absolute
+// time so the clocks of the hosts do not have to be in sync.
+const Header = "X-Request-Timeout"
+
+// Inject sets the header to the time remaining until the deadline of ctx, it is removed when ctx has no deadline
+func Inject(ctx context.Context, h http.Header) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		h.Del(Header)
+		return
+	}
+
+	remaining := max(time.Until(deadline).Milliseconds(), 0)
+	h.Set(Header, strconv.FormatInt(remaining, 10))
+}
+
+// FromHeader returns the timeout sent by the caller, invalid values are ignored
+func FromHeader(h http.Header) (time.Duration, bool) {
+	value := h.Get(Header)
+	if value == "" {
+		return 0, false
+	}
+
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms < 0 {
+		return 0, false
+	}
+
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// Middleware applies the timeout sent by the caller to the request context, so handlers stop working on requests the
+// caller already gave up on
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout, ok := FromHeader(r.Header)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,73 @@
+package deadline
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInject(t *testing.T) {
+	h := http.Header{}
+	h.Set(Header, "100")
+
+	Inject(context.Background(), h)
+	if h.Get(Header) != "" {
+		t.Errorf("Expected header to be removed without a deadline, got %q", h.Get(Header))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	Inject(ctx, h)
+	timeout, ok := FromHeader(h)
+	if !ok || timeout <= time.Second || timeout > 2*time.Second {
+		t.Errorf("Unexpected timeout %s", timeout)
+	}
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	Inject(expired, h)
+	if h.Get(Header) != "0" {
+		t.Errorf("Expected an expired deadline to be sent as 0, got %q", h.Get(Header))
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name           string
+		header         string
+		expectDeadline bool
+	}{
+		{name: "Without header"},
+		{name: "With timeout", header: "1500", expectDeadline: true},
+		{name: "Invalid timeout", header: "1.5s"},
+		{name: "Negative timeout", header: "-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deadline time.Time
+			var hasDeadline bool
+			handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				deadline, hasDeadline = r.Context().Deadline()
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(Header, tt.header)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if hasDeadline != tt.expectDeadline {
+				t.Fatalf("Expected deadline %v, got %v", tt.expectDeadline, hasDeadline)
+			}
+
+			if hasDeadline && time.Until(deadline) > 1500*time.Millisecond {
+				t.Errorf("Deadline is too far away: %s", time.Until(deadline))
+			}
+		})
+	}
+}
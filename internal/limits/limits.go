@@ -0,0 +1,177 @@
+// Package limits protects servers against oversized requests and clients that send their request body too slowly
+package limits
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrSlowBody is returned when reading a request body that is sent below the minimum read rate
+var ErrSlowBody = errors.New("request body sent too slowly")
+
+// Config limits the requests a server accepts, zero values disable a limit
+type Config struct {
+	// MaxBodyBytes is the largest request body accepted, larger bodies are answered with 413
+	MaxBodyBytes int64
+	// MinReadRate is the number of bytes per second a client must send its body at once ReadRateGrace has passed,
+	// slower uploads are answered with 408
+	MinReadRate   int64
+	ReadRateGrace time.Duration
+	// MaxHeaderBytes limits the size of the request line and headers, MaxHeaderCount the number of header values.
+	// Requests over these limits are answered with 431.
+	MaxHeaderBytes int
+	MaxHeaderCount int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MaxBodyBytes:   10 << 20,
+		MinReadRate:    1 << 10,
+		ReadRateGrace:  5 * time.Second,
+		MaxHeaderBytes: 64 << 10,
+		MaxHeaderCount: 100,
+	}
+}
+
+// StatusCode returns the status to answer a failed body read with, or 0 when the error is not caused by a limit
+func StatusCode(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrSlowBody):
+		return http.StatusRequestTimeout
+	}
+	return 0
+}
+
+// Middleware rejects requests over the header and body limits right away, and enforces the limits on the body while
+// it is read. MaxHeaderBytes has to be set on the http.Server, as headers are parsed before any handler runs.
+func Middleware(cfg Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.MaxHeaderCount > 0 && headerCount(r.Header) > cfg.MaxHeaderCount {
+			http.Error(w, "too many request headers", http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+
+		if cfg.MaxBodyBytes > 0 {
+			if r.ContentLength > cfg.MaxBodyBytes {
+				// The body is not read, so the connection can not be reused
+				w.Header().Set("Connection", "close")
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
+		}
+
+		if cfg.MinReadRate > 0 && r.Body != nil && r.Body != http.NoBody {
+			body := &rateBody{
+				ReadCloser: r.Body,
+				rc:         http.NewResponseController(w),
+				minRate:    cfg.MinReadRate,
+				grace:      cfg.ReadRateGrace,
+				start:      time.Now(),
+				deadlines:  true,
+			}
+			defer body.clearDeadline()
+			r.Body = body
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func headerCount(h http.Header) int {
+	n := 0
+	for _, values := range h {
+		n += len(values)
+	}
+	return n
+}
+
+// rateBody fails reads once the client is behind the minimum read rate. The read deadline of the connection is moved
+// along with the data received, so a client that stops sending does not block the handler either.
+type rateBody struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	minRate int64
+	grace   time.Duration
+	start   time.Time
+	read    int64
+
+	// The body may be closed by another goroutine than the one reading it
+	mu sync.Mutex
+	// deadlines is cleared when the connection does not support read deadlines, the rate is then checked after reads
+	deadlines bool
+	done      bool
+	slow      bool
+}
+
+// deadline returns the time by which the client must have sent the bytes read so far and the next one
+func (b *rateBody) deadline() time.Time {
+	return b.start.Add(b.grace + time.Duration(b.read)*time.Second/time.Duration(b.minRate))
+}
+
+func (b *rateBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	if b.slow {
+		b.mu.Unlock()
+		return 0, ErrSlowBody
+	}
+	if b.done {
+		b.mu.Unlock()
+		return b.ReadCloser.Read(p)
+	}
+	if b.deadlines {
+		if err := b.rc.SetReadDeadline(b.deadline()); err != nil {
+			b.deadlines = false
+		}
+	}
+	b.mu.Unlock()
+
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return n, b.tooSlow()
+	case err != nil:
+		b.clearDeadline()
+	case time.Now().After(b.deadline()):
+		return n, b.tooSlow()
+	}
+	return n, err
+}
+
+// tooSlow closes the body while the read deadline has passed, which makes the server close the connection after the
+// response instead of waiting for the rest of the body to reuse it
+func (b *rateBody) tooSlow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.slow, b.done = true, true
+	_ = b.ReadCloser.Close()
+	return ErrSlowBody
+}
+
+func (b *rateBody) Close() error {
+	b.clearDeadline()
+	return b.ReadCloser.Close()
+}
+
+// clearDeadline lifts the read deadline once the body has been read, the server sets it again for the next request
+func (b *rateBody) clearDeadline() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.done && b.deadlines {
+		_ = b.rc.SetReadDeadline(time.Time{})
+	}
+	b.done = true
+}
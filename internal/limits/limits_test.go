@@ -0,0 +1,135 @@
+package limits
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer serves a handler that reads the whole body and answers with the status of the limit it hit
+func newTestServer(t *testing.T, cfg Config) *httptest.Server {
+	t.Helper()
+
+	handler := Middleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			status := StatusCode(err)
+			if status == 0 {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+		}
+	}))
+
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.MaxHeaderBytes = cfg.MaxHeaderBytes
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBodyLimit(t *testing.T) {
+	server := newTestServer(t, Config{MaxBodyBytes: 10})
+
+	tests := []struct {
+		name   string
+		body   io.Reader
+		status int
+	}{
+		{name: "within limit", body: strings.NewReader("0123456789"), status: http.StatusOK},
+		{name: "content length over limit", body: strings.NewReader("01234567890"), status: http.StatusRequestEntityTooLarge},
+		// Without a Content-Length the limit is enforced while the body is read
+		{name: "chunked over limit", body: io.MultiReader(strings.NewReader("01234567890")), status: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(server.URL, "text/plain", tt.body)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	server := newTestServer(t, Config{MaxHeaderBytes: 4 << 10, MaxHeaderCount: 5})
+
+	tests := []struct {
+		name    string
+		headers int
+		size    int
+		status  int
+	}{
+		{name: "within limits", headers: 2, size: 10, status: http.StatusOK},
+		{name: "too many headers", headers: 10, size: 10, status: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "headers too large", headers: 1, size: 16 << 10, status: http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			for i := range tt.headers {
+				req.Header.Set(fmt.Sprintf("X-Test-%d", i), strings.Repeat("a", tt.size))
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestMinReadRate(t *testing.T) {
+	server := newTestServer(t, Config{MinReadRate: 1000, ReadRateGrace: 100 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// The client announces a body but stops sending after a few bytes
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 1000\r\n\r\n0123456789")
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("Expected the slow upload to be answered with 408, got %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the slow upload to be cut off after about 110ms, took %s", elapsed)
+	}
+
+	// A client that keeps up with the rate is served
+	resp, err = http.Post(server.URL, "text/plain", strings.NewReader(strings.Repeat("a", 1000)))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a fast upload to succeed, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,250 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/requestid"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Supported access log formats
+const (
+	AccessLogJSON     = "json"
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+)
+
+// AccessLogStdout writes the access log to standard output instead of a file
+const AccessLogStdout = "stdout"
+
+type AccessLogConfig struct {
+	Enabled bool
+	// Format is one of AccessLogJSON, AccessLogCommon or AccessLogCombined
+	Format string
+	// Output is either AccessLogStdout or the path of a file that is rotated based on the settings below
+	Output     string
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+	Compress   bool
+}
+
+func DefaultAccessLogConfig() AccessLogConfig {
+	return AccessLogConfig{
+		Enabled:    true,
+		Format:     AccessLogJSON,
+		Output:     AccessLogStdout,
+		MaxSizeMB:  100,
+		MaxBackups: 5,
+		MaxAgeDays: 7,
+	}
+}
+
+type requestInfoKey struct{}
+
+// requestInfo collects the details of a proxied request that are only known once it has been handled
+type requestInfo struct {
+	RequestID string
+	Route     string
+	// User is the authenticated subject of the request
+	User            string
+	Pool            string
+	Backend         string
+	UpstreamStatus  int
+	UpstreamLatency time.Duration
+	// Retries is the number of times the request was sent again, the load balancer does not retry so it is always 0
+	Retries int
+	// CacheStatus is how the response cache answered the request, empty when the cache is disabled
+	CacheStatus   string
+	upstreamStart time.Time
+}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// requestInfoFrom returns the request info of the context. Requests that were not passed through the access log get
+// a detached info so callers never have to check for nil.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// accessLogEntry is a single completed request
+type accessLogEntry struct {
+	Time     time.Time
+	ClientIP string
+	Method   string
+	URI      string
+	Proto    string
+	Status   int
+	Bytes    int64
+	Duration time.Duration
+	Referer  string
+	Agent    string
+	requestInfo
+}
+
+// AccessLogger writes an entry for every completed request
+type AccessLogger struct {
+	format string
+	out    io.Writer
+	closer io.Closer
+	json   *slog.Logger
+	mu     sync.Mutex
+}
+
+// NewAccessLogger creates an access logger writing to the output configured in cfg
+func NewAccessLogger(cfg AccessLogConfig) (*AccessLogger, error) {
+	var out io.Writer
+	var closer io.Closer
+
+	switch cfg.Output {
+	case AccessLogStdout, "":
+		out = os.Stdout
+	default:
+		file := &lumberjack.Logger{
+			Filename:   cfg.Output,
+			MaxSize:    cfg.MaxSizeMB,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAgeDays,
+			Compress:   cfg.Compress,
+		}
+		out, closer = file, file
+	}
+
+	return newAccessLogger(cfg.Format, out, closer)
+}
+
+func newAccessLogger(format string, out io.Writer, closer io.Closer) (*AccessLogger, error) {
+	switch format {
+	case AccessLogJSON, AccessLogCommon, AccessLogCombined:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+
+	return &AccessLogger{
+		format: format,
+		out:    out,
+		closer: closer,
+		json:   slog.New(slog.NewJSONHandler(out, nil)),
+	}, nil
+}
+
+// Middleware logs every request handled by next once the response has been written
+func (l *AccessLogger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{RequestID: requestid.FromContext(r.Context())}
+		rec := newResponseRecorder(w)
+
+		next.ServeHTTP(rec, r.WithContext(withRequestInfo(r.Context(), info)))
+
+		l.Log(accessLogEntry{
+			Time:        start,
+			ClientIP:    forwardedFrom(r).clientIP,
+			Method:      r.Method,
+			URI:         r.RequestURI,
+			Proto:       r.Proto,
+			Status:      rec.status,
+			Bytes:       rec.written,
+			Duration:    time.Since(start),
+			Referer:     r.Referer(),
+			Agent:       r.UserAgent(),
+			requestInfo: *info,
+		})
+	})
+}
+
+// Log writes a single entry in the configured format
+func (l *AccessLogger) Log(e accessLogEntry) {
+	if l.format == AccessLogJSON {
+		l.json.LogAttrs(context.Background(), slog.LevelInfo, "access",
+			slog.String("client_ip", e.ClientIP),
+			slog.String("method", e.Method),
+			slog.String("uri", e.URI),
+			slog.String("proto", e.Proto),
+			slog.Int("status", e.Status),
+			slog.Int64("bytes", e.Bytes),
+			slog.Duration("duration", e.Duration),
+			slog.String("referer", e.Referer),
+			slog.String("user_agent", e.Agent),
+			slog.String("request_id", e.RequestID),
+			slog.String("route", e.Route),
+			slog.String("user", e.User),
+			slog.String("pool", e.Pool),
+			slog.String("backend", e.Backend),
+			slog.Int("upstream_status", e.UpstreamStatus),
+			slog.Duration("upstream_latency", e.UpstreamLatency),
+			slog.Int("retries", e.Retries),
+			slog.String("cache", e.CacheStatus),
+		)
+		return
+	}
+
+	line := formatCLF(e, l.format == AccessLogCombined)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := io.WriteString(l.out, line); err != nil {
+		slog.Error("failed to write access log", "error", err)
+	}
+}
+
+// Close closes the underlying log file, if any
+func (l *AccessLogger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// formatCLF formats the entry in Common or Combined Log Format, followed by the proxy specific fields
+func formatCLF(e accessLogEntry, combined bool) string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+		e.ClientIP,
+		clfValue(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.URI, e.Proto,
+		e.Status,
+		bytes,
+	)
+
+	if combined {
+		line += fmt.Sprintf(" %q %q", clfValue(e.Referer), clfValue(e.Agent))
+	}
+
+	return line + fmt.Sprintf(" request_id=%s route=%s pool=%s backend=%s upstream_status=%d upstream_latency=%.3f retries=%d duration=%.3f\n",
+		clfValue(e.RequestID),
+		clfValue(e.Route),
+		clfValue(e.Pool),
+		clfValue(e.Backend),
+		e.UpstreamStatus,
+		e.UpstreamLatency.Seconds(),
+		e.Retries,
+		e.Duration.Seconds(),
+	)
+}
+
+// clfValue replaces empty values with a dash as is customary in Common Log Format
+func clfValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
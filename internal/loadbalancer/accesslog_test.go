@@ -0,0 +1,104 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/requestid"
+)
+
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"points":20}`))
+	}))
+	defer backend.Close()
+
+	lb := newTestLoadBalancer(t, backend.URL)
+
+	t.Run("JSON entry is written after the response", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := newAccessLogger(AccessLogJSON, &buf, nil)
+		if err != nil {
+			t.Fatalf("Failed to create access logger: %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/echo?x=1", nil)
+		req.RemoteAddr = "192.0.2.10:53211"
+		req.Header.Set(requestid.Header, "abc-123")
+		requestid.Middleware(true, logger.Middleware(lb)).ServeHTTP(httptest.NewRecorder(), req)
+
+		var entry map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("Access log is not valid JSON: %v (%s)", err, buf.String())
+		}
+
+		expected := map[string]any{
+			"client_ip":       "192.0.2.10",
+			"method":          http.MethodPost,
+			"uri":             "/echo?x=1",
+			"status":          float64(http.StatusCreated),
+			"bytes":           float64(13),
+			"request_id":      "abc-123",
+			"backend":         backend.URL,
+			"upstream_status": float64(http.StatusCreated),
+			"retries":         float64(0),
+		}
+		for key, want := range expected {
+			if entry[key] != want {
+				t.Errorf("%s: got %v want %v", key, entry[key], want)
+			}
+		}
+
+		if entry["upstream_latency"].(float64) <= 0 {
+			t.Errorf("Expected upstream latency to be recorded, got %v", entry["upstream_latency"])
+		}
+	})
+
+	t.Run("Combined log format", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := newAccessLogger(AccessLogCombined, &buf, nil)
+		if err != nil {
+			t.Fatalf("Failed to create access logger: %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.RemoteAddr = "192.0.2.10:53211"
+		req.Header.Set("User-Agent", "curl/8.0")
+		logger.Middleware(lb).ServeHTTP(httptest.NewRecorder(), req)
+
+		pattern := `^192\.0\.2\.10 - - \[[^\]]+\] "POST / HTTP/1\.1" 201 13 "-" "curl/8\.0" request_id=- route=- pool=backend backend=` +
+			regexp.QuoteMeta(backend.URL) + ` upstream_status=201 upstream_latency=[0-9.]+ retries=0 duration=[0-9.]+\n$`
+		if !regexp.MustCompile(pattern).MatchString(buf.String()) {
+			t.Errorf("Unexpected access log line: %q", buf.String())
+		}
+	})
+
+	t.Run("Failed upstream has no upstream status", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := newAccessLogger(AccessLogCommon, &buf, nil)
+		if err != nil {
+			t.Fatalf("Failed to create access logger: %v", err)
+		}
+
+		unreachable := httptest.NewServer(http.NotFoundHandler())
+		unreachable.Close()
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		logger.Middleware(newTestLoadBalancer(t, unreachable.URL)).ServeHTTP(httptest.NewRecorder(), req)
+
+		if !regexp.MustCompile(`" 502 - request_id=- route=- pool=backend backend=\S+ upstream_status=0 `).MatchString(buf.String()) {
+			t.Errorf("Unexpected access log line: %q", buf.String())
+		}
+	})
+
+	t.Run("Unknown format is rejected", func(t *testing.T) {
+		if _, err := newAccessLogger("xml", &bytes.Buffer{}, nil); err == nil {
+			t.Error("Expected an error for an unknown format")
+		}
+	})
+}
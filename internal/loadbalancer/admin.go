@@ -0,0 +1,246 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+)
+
+// adminHandler serves the JSON API used to inspect and control the load balancer at runtime
+type adminHandler struct {
+	pools  []*Pool
+	config Config
+}
+
+// NewAdminHandler returns the handler of the admin listener
+func NewAdminHandler(pools []*Pool, config Config) http.Handler {
+	h := &adminHandler{pools: pools, config: config}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /pools", h.listPools)
+	mux.HandleFunc("GET /backends", h.listBackends)
+	mux.HandleFunc("POST /backends/{id}/drain", h.setState(BackendDraining))
+	mux.HandleFunc("POST /backends/{id}/enable", h.setState(BackendActive))
+	mux.HandleFunc("POST /backends/{id}/disable", h.setState(BackendDisabled))
+	mux.HandleFunc("PUT /backends/{id}/weight", h.setWeight)
+	mux.HandleFunc("PUT /backends/{id}/timeouts", h.setTimeouts)
+	mux.HandleFunc("POST /healthcheck", h.healthCheck)
+	mux.HandleFunc("GET /config", h.showConfig)
+
+	return mux
+}
+
+func (h *adminHandler) listPools(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]PoolStatus, 0, len(h.pools))
+	for _, pool := range h.pools {
+		statuses = append(statuses, pool.status())
+	}
+
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (h *adminHandler) listBackends(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.backendStatuses())
+}
+
+func (h *adminHandler) backendStatuses() []BackendStatus {
+	statuses := make([]BackendStatus, 0)
+	for _, pool := range h.pools {
+		statuses = append(statuses, pool.lb.BackendStatuses()...)
+	}
+	return statuses
+}
+
+// updateBackend applies the update to the backend in every pool it belongs to, the pool query parameter restricts the
+// update to a single pool. The status of the first updated backend is returned.
+func (h *adminHandler) updateBackend(r *http.Request, update func(lb *LoadBalancer, id string) (BackendStatus, error)) (BackendStatus, error) {
+	poolName := r.URL.Query().Get("pool")
+
+	var result BackendStatus
+	found := false
+	for _, pool := range h.pools {
+		if poolName != "" && pool.Name != poolName {
+			continue
+		}
+
+		status, err := update(pool.lb, r.PathValue("id"))
+		if errors.Is(err, ErrBackendNotFound) {
+			continue
+		}
+		if err != nil {
+			return BackendStatus{}, err
+		}
+
+		if !found {
+			result, found = status, true
+		}
+	}
+
+	if !found {
+		return BackendStatus{}, ErrBackendNotFound
+	}
+	return result, nil
+}
+
+func (h *adminHandler) setState(state BackendState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := h.updateBackend(r, func(lb *LoadBalancer, id string) (BackendStatus, error) {
+			return lb.SetBackendState(id, state)
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+func (h *adminHandler) setWeight(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Weight int `json:"weight"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid body: " + err.Error()})
+		return
+	}
+
+	status, err := h.updateBackend(r, func(lb *LoadBalancer, id string) (BackendStatus, error) {
+		return lb.SetBackendWeight(id, body.Weight)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (h *adminHandler) setTimeouts(w http.ResponseWriter, r *http.Request) {
+	var timeouts TimeoutConfig
+	if err := json.NewDecoder(r.Body).Decode(&timeouts); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid body: " + err.Error()})
+		return
+	}
+
+	status, err := h.updateBackend(r, func(lb *LoadBalancer, id string) (BackendStatus, error) {
+		return lb.SetBackendTimeouts(id, timeouts)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// healthCheck runs a health check of all backends right away and returns the result
+func (h *adminHandler) healthCheck(w http.ResponseWriter, r *http.Request) {
+	for _, pool := range h.pools {
+		pool.hc.Check()
+	}
+	writeJSON(w, http.StatusOK, h.backendStatuses())
+}
+
+// configView is the effective routing of the load balancer. Credentials, header values and the settings of other
+// subsystems are left out, they are not needed to inspect routing and should not leave the process.
+type configView struct {
+	Pools  []poolView  `json:"pools"`
+	Routes []routeView `json:"routes"`
+}
+
+type poolView struct {
+	Name        string            `json:"name"`
+	Service     string            `json:"service"`
+	Strategy    string            `json:"strategy"`
+	HealthCheck HealthCheckConfig `json:"health_check"`
+	Concurrency ConcurrencyConfig `json:"concurrency"`
+	Mirror      *MirrorConfig     `json:"mirror,omitempty"`
+	// Backends are the addresses currently known to the pool, with any user info in the URL redacted
+	Backends []string `json:"backends"`
+}
+
+type routeView struct {
+	Name       string   `json:"name"`
+	Host       string   `json:"host,omitempty"`
+	PathPrefix string   `json:"path_prefix,omitempty"`
+	PathRegex  string   `json:"path_regex,omitempty"`
+	Methods    []string `json:"methods,omitempty"`
+	// Headers are the names of the headers the route matches on
+	Headers  []string      `json:"headers,omitempty"`
+	Pool     string        `json:"pool"`
+	Timeouts TimeoutConfig `json:"timeouts"`
+	Rewrite  RewriteConfig `json:"rewrite"`
+}
+
+func (h *adminHandler) showConfig(w http.ResponseWriter, r *http.Request) {
+	view := configView{Pools: make([]poolView, 0, len(h.pools)), Routes: make([]routeView, 0)}
+	for _, pool := range h.pools {
+		backends := make([]string, 0)
+		for _, status := range pool.lb.BackendStatuses() {
+			backends = append(backends, redactURL(status.Addr))
+		}
+		view.Pools = append(view.Pools, poolView{
+			Name:        pool.Name,
+			Service:     pool.config.Service,
+			Strategy:    pool.config.Strategy,
+			HealthCheck: pool.config.HealthCheck,
+			Concurrency: pool.config.Concurrency,
+			Mirror:      pool.config.Mirror,
+			Backends:    backends,
+		})
+	}
+
+	_, routes := h.config.routing()
+	for _, route := range routes {
+		view.Routes = append(view.Routes, routeView{
+			Name:       route.Name,
+			Host:       route.Host,
+			PathPrefix: route.PathPrefix,
+			PathRegex:  route.PathRegex,
+			Methods:    route.Methods,
+			Headers:    slices.Sorted(maps.Keys(route.Headers)),
+			Pool:       route.Pool,
+			Timeouts:   route.Timeouts,
+			Rewrite:    route.Rewrite,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, view)
+}
+
+// redactURL hides the password of a backend URL
+func redactURL(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return addr
+	}
+	return u.Redacted()
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	if errors.Is(err, ErrBackendNotFound) {
+		status = http.StatusNotFound
+	}
+
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		slog.Error("failed to encode admin response", "error", err)
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,169 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAPI(t *testing.T) {
+	backend1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Server-Id", "backend 1")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend1.Close()
+
+	backend2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("X-Server-Id", "backend 2")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend2.Close()
+
+	lb := newTestLoadBalancer(t, backend1.URL, backend2.URL)
+	hc := NewHealthChecker(lb, time.Second)
+	admin := httptest.NewServer(NewAdminHandler([]*Pool{{Name: "backend", lb: lb, hc: hc}}, DefaultConfig()))
+	defer admin.Close()
+
+	id1 := mustParseURL(t, backend1.URL).Host
+	id2 := mustParseURL(t, backend2.URL).Host
+
+	t.Run("List backends with statistics", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+
+		var statuses []BackendStatus
+		doAdminRequest(t, http.MethodGet, admin.URL+"/backends", "", http.StatusOK, &statuses)
+
+		if len(statuses) != 2 {
+			t.Fatalf("Expected 2 backends, got %d", len(statuses))
+		}
+
+		for _, status := range statuses {
+			if status.Requests != 1 || status.InFlight != 0 || status.State != BackendActive || status.Weight != 1 {
+				t.Errorf("Unexpected status %+v", status)
+			}
+		}
+
+		if statuses[1].ID != id2 || statuses[1].Errors != 1 {
+			t.Errorf("Expected one error for %s, got %+v", id2, statuses[1])
+		}
+	})
+
+	t.Run("Drained backend receives no new requests", func(t *testing.T) {
+		var status BackendStatus
+		doAdminRequest(t, http.MethodPost, admin.URL+"/backends/"+id1+"/drain", "", http.StatusOK, &status)
+
+		if status.State != BackendDraining {
+			t.Fatalf("Expected draining state, got %s", status.State)
+		}
+
+		for i := 0; i < 3; i++ {
+			rec := httptest.NewRecorder()
+			lb.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Header().Get("X-Server-Id") != "backend 2" {
+				t.Errorf("Expected request to go to backend 2, got %q", rec.Header().Get("X-Server-Id"))
+			}
+		}
+
+		doAdminRequest(t, http.MethodPost, admin.URL+"/backends/"+id1+"/enable", "", http.StatusOK, &status)
+		if status.State != BackendActive {
+			t.Errorf("Expected active state, got %s", status.State)
+		}
+	})
+
+	t.Run("Disabling an unknown backend fails", func(t *testing.T) {
+		doAdminRequest(t, http.MethodPost, admin.URL+"/backends/unknown:80/disable", "", http.StatusNotFound, nil)
+	})
+
+	t.Run("Change weight", func(t *testing.T) {
+		var status BackendStatus
+		doAdminRequest(t, http.MethodPut, admin.URL+"/backends/"+id1+"/weight", `{"weight":3}`, http.StatusOK, &status)
+		if status.Weight != 3 {
+			t.Errorf("Expected weight 3, got %d", status.Weight)
+		}
+
+		doAdminRequest(t, http.MethodPut, admin.URL+"/backends/"+id1+"/weight", `{"weight":0}`, http.StatusBadRequest, nil)
+	})
+
+	t.Run("Change timeouts", func(t *testing.T) {
+		var status BackendStatus
+		doAdminRequest(t, http.MethodPut, admin.URL+"/backends/"+id1+"/timeouts", `{"total":"2s","first_byte":"500ms"}`, http.StatusOK, &status)
+		if status.Timeouts != (TimeoutConfig{FirstByte: 500 * time.Millisecond, Total: 2 * time.Second}) {
+			t.Errorf("Unexpected timeouts %+v", status.Timeouts)
+		}
+
+		doAdminRequest(t, http.MethodPut, admin.URL+"/backends/"+id1+"/timeouts", `{"total":"soon"}`, http.StatusBadRequest, nil)
+	})
+
+	t.Run("Trigger health check", func(t *testing.T) {
+		var statuses []BackendStatus
+		doAdminRequest(t, http.MethodPost, admin.URL+"/healthcheck", "", http.StatusOK, &statuses)
+
+		for _, status := range statuses {
+			if status.Healthy != (status.ID == id1) {
+				t.Errorf("Unexpected health for %s: %v", status.ID, status.Healthy)
+			}
+		}
+	})
+
+	t.Run("Show effective config", func(t *testing.T) {
+		var body map[string]any
+		doAdminRequest(t, http.MethodGet, admin.URL+"/config", "", http.StatusOK, &body)
+		if _, ok := body["auth"]; ok || len(body) != 2 {
+			t.Errorf("Expected only pools and routes, got %v", body)
+		}
+
+		var config configView
+		doAdminRequest(t, http.MethodGet, admin.URL+"/config", "", http.StatusOK, &config)
+		if len(config.Pools) != 1 || len(config.Pools[0].Backends) != 2 {
+			t.Errorf("Expected the pool with its backends, got %+v", config.Pools)
+		}
+		if len(config.Routes) != 1 || config.Routes[0].Pool != "backend" {
+			t.Errorf("Expected the default route, got %+v", config.Routes)
+		}
+	})
+}
+
+func doAdminRequest(t *testing.T, method, url, body string, expectedStatus int, v any) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest() error = %v", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("client.Do() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Fatalf("%s %s returned %d, expected %d", method, url, resp.StatusCode, expectedStatus)
+	}
+
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+	}
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("Failed to parse URL %q: %v", raw, err)
+	}
+	return u
+}
@@ -0,0 +1,257 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Methods that authenticate requests
+const (
+	AuthMethodAPIKey = "api_key"
+	AuthMethodJWT    = "jwt"
+)
+
+// Headers that carry the verified identity to the backends, they are always removed from client requests
+const (
+	AuthSubjectHeader = "X-Auth-Subject"
+	AuthMethodHeader  = "X-Auth-Method"
+)
+
+var errNoCredentials = errors.New("no credentials")
+
+// AuthConfig authenticates requests at the edge, so backends can rely on the identity headers
+type AuthConfig struct {
+	// APIKeys are matched against the APIKeyHeader of requests, which defaults to X-API-Key
+	APIKeys      []APIKeyConfig `json:"api_keys,omitempty"`
+	APIKeyHeader string         `json:"api_key_header,omitempty"`
+	JWT          JWTConfig      `json:"jwt"`
+	// Require applies to the routes without an auth policy of their own
+	Require RouteAuthConfig `json:"require"`
+	// ClaimHeaders forwards claims of the identity to the backends, by claim name
+	ClaimHeaders map[string]string `json:"claim_headers,omitempty"`
+}
+
+// APIKeyConfig is a static API key. Only the SHA-256 hash of the key is configured, so the config does not reveal it.
+type APIKeyConfig struct {
+	// Name is forwarded as the subject of requests made with the key
+	Name string `json:"name"`
+	// Hash is the hex encoded SHA-256 hash of the key
+	Hash string `json:"hash"`
+	// Claims are checked by the routes like the claims of a token
+	Claims map[string]any `json:"claims,omitempty"`
+}
+
+// RouteAuthConfig is the policy of a route. A route without methods is public.
+type RouteAuthConfig struct {
+	// Methods that are accepted on the route: api_key and jwt
+	Methods []string `json:"methods,omitempty"`
+	// Claims lists the accepted values of claims the identity must have. A claim with a list of values, or a
+	// space separated scope, matches when one of its values is accepted.
+	Claims map[string][]string `json:"claims,omitempty"`
+}
+
+// identity is the verified caller of a request
+type identity struct {
+	method  string
+	subject string
+	claims  map[string]any
+}
+
+// Authenticator verifies the credentials of requests against the policy of their route
+type Authenticator struct {
+	config  AuthConfig
+	keys    map[string]APIKeyConfig
+	jwt     *jwtVerifier
+	headers []string
+}
+
+// NewAuthenticator creates an authenticator, without API keys or a JWKS it only strips the identity headers
+func NewAuthenticator(cfg AuthConfig) (*Authenticator, error) {
+	if cfg.APIKeyHeader == "" {
+		cfg.APIKeyHeader = DefaultAPIKeyHeader
+	}
+
+	a := &Authenticator{
+		config:  cfg,
+		keys:    make(map[string]APIKeyConfig, len(cfg.APIKeys)),
+		headers: []string{AuthSubjectHeader, AuthMethodHeader},
+	}
+
+	for _, key := range cfg.APIKeys {
+		hash := strings.ToLower(key.Hash)
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("api key %s: hash must be a hex encoded SHA-256 hash", key.Name)
+		}
+		if key.Name == "" {
+			return nil, errors.New("api keys need a name")
+		}
+		a.keys[hash] = key
+	}
+
+	if cfg.JWT.enabled() {
+		var err error
+		if a.jwt, err = newJWTVerifier(cfg.JWT); err != nil {
+			return nil, fmt.Errorf("jwt: %w", err)
+		}
+	}
+
+	for _, header := range cfg.ClaimHeaders {
+		a.headers = append(a.headers, header)
+	}
+
+	if err := a.validate(cfg.Require); err != nil {
+		return nil, fmt.Errorf("require: %w", err)
+	}
+	return a, nil
+}
+
+// validate checks that the methods of a policy are configured
+func (a *Authenticator) validate(policy RouteAuthConfig) error {
+	for _, method := range policy.Methods {
+		switch method {
+		case AuthMethodAPIKey:
+			if len(a.keys) == 0 {
+				return errors.New("api_key authentication requires api keys")
+			}
+		case AuthMethodJWT:
+			if a.jwt == nil {
+				return errors.New("jwt authentication requires a jwks file or url")
+			}
+		default:
+			return fmt.Errorf("unknown auth method %q", method)
+		}
+	}
+	return nil
+}
+
+// policy returns the policy of the route
+func (a *Authenticator) policy(rt *route) RouteAuthConfig {
+	if rt.config.Auth != nil {
+		return *rt.config.Auth
+	}
+	return a.config.Require
+}
+
+// authorize checks the request against the policy of its route and forwards the identity, it answers the request
+// and returns false when it may not proceed
+func (a *Authenticator) authorize(w http.ResponseWriter, r *http.Request, rt *route) bool {
+	// Identity headers are only set by the load balancer
+	for _, header := range a.headers {
+		r.Header.Del(header)
+	}
+
+	policy := a.policy(rt)
+	if len(policy.Methods) == 0 {
+		return true
+	}
+
+	id, err := a.authenticate(r, policy.Methods)
+	if err != nil {
+		slog.InfoContext(r.Context(), "request not authenticated", "route", rt.config.Name, "error", err)
+		if slices.Contains(policy.Methods, AuthMethodJWT) {
+			challenge := `Bearer realm="loadbalancer"`
+			if !errors.Is(err, errNoCredentials) {
+				challenge += `, error="invalid_token"`
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	if claim, ok := policy.authorized(id.claims); !ok {
+		slog.InfoContext(r.Context(), "request not authorized", "route", rt.config.Name,
+			"subject", id.subject, "claim", claim)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+
+	requestInfoFrom(r.Context()).User = id.subject
+	r.Header.Set(AuthMethodHeader, id.method)
+	r.Header.Set(AuthSubjectHeader, id.subject)
+	for claim, header := range a.config.ClaimHeaders {
+		if values := claimValues(id.claims[claim]); len(values) > 0 {
+			r.Header.Set(header, strings.Join(values, ","))
+		}
+	}
+	return true
+}
+
+// authenticate verifies the first credentials the request carries of the accepted methods
+func (a *Authenticator) authenticate(r *http.Request, methods []string) (*identity, error) {
+	if slices.Contains(methods, AuthMethodAPIKey) {
+		if key := r.Header.Get(a.config.APIKeyHeader); key != "" {
+			sum := sha256.Sum256([]byte(key))
+			config, ok := a.keys[hex.EncodeToString(sum[:])]
+			if !ok {
+				return nil, errors.New("unknown api key")
+			}
+			return &identity{method: AuthMethodAPIKey, subject: config.Name, claims: config.Claims}, nil
+		}
+	}
+
+	if slices.Contains(methods, AuthMethodJWT) {
+		if token, ok := bearerToken(r); ok {
+			claims, err := a.jwt.verify(r.Context(), token)
+			if err != nil {
+				return nil, err
+			}
+			subject, _ := claims["sub"].(string)
+			return &identity{method: AuthMethodJWT, subject: subject, claims: claims}, nil
+		}
+	}
+
+	return nil, errNoCredentials
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// authorized checks the claims required by the policy, it returns the first claim that does not match
+func (p RouteAuthConfig) authorized(claims map[string]any) (string, bool) {
+	for name, accepted := range p.Claims {
+		values := claimValues(claims[name])
+		if name == "scope" && len(values) == 1 {
+			values = strings.Fields(values[0])
+		}
+		if !slices.ContainsFunc(values, func(v string) bool { return slices.Contains(accepted, v) }) {
+			return name, false
+		}
+	}
+	return "", true
+}
+
+// claimValues returns a claim as a list of strings
+func claimValues(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case bool:
+		return []string{strconv.FormatBool(v)}
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+	case int:
+		return []string{strconv.Itoa(v)}
+	case []string:
+		return v
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, claimValues(item)...)
+		}
+		return values
+	}
+	return nil
+}
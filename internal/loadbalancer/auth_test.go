@@ -0,0 +1,406 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSigner issues tokens signed with its key
+type testSigner struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func newTestSigner(t *testing.T, kid, alg string) testSigner {
+	t.Helper()
+
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case "RS256", "PS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return testSigner{kid: kid, alg: alg, key: key}
+}
+
+func (s testSigner) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		if s.alg == "PS256" {
+			signature, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		}
+	case *ecdsa.PrivateKey:
+		var r, sig *big.Int
+		r, sig, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// jwk returns the public key of the signer as a JSON Web Key
+func (s testSigner) jwk() map[string]string {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch pub := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": s.kid, "n": encode(pub.N.Bytes()), "e": encode(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": s.kid, "crv": "P-256", "x": encode(pub.X.FillBytes(make([]byte, 32))), "y": encode(pub.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": s.kid, "crv": "Ed25519", "x": encode(pub)}
+	}
+	return nil
+}
+
+func jwksOf(signers ...testSigner) []byte {
+	keys := make([]map[string]string, 0, len(signers))
+	for _, s := range signers {
+		keys = append(keys, s.jwk())
+	}
+	data, _ := json.Marshal(map[string]any{"keys": keys})
+	return data
+}
+
+func writeJWKS(t *testing.T, signers ...testSigner) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwksOf(signers...), 0o600); err != nil {
+		t.Fatalf("Failed to write jwks: %v", err)
+	}
+	return path
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"sub": "player-1",
+		"iss": "https://auth.example.com",
+		"aud": []string{"games", "echo"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	rs := newTestSigner(t, "rsa", "RS256")
+	ps := testSigner{kid: "rsa", alg: "PS256", key: rs.key}
+	es := newTestSigner(t, "ec", "ES256")
+	ed := newTestSigner(t, "ed", "EdDSA")
+	unknown := newTestSigner(t, "other", "ES256")
+
+	verifier, err := newJWTVerifier(JWTConfig{
+		JWKSFile: writeJWKS(t, rs, es, ed),
+		Issuer:   "https://auth.example.com",
+		Audience: "echo",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %v", err)
+	}
+
+	with := func(key string, value any) map[string]any {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{name: "RS256", token: rs.sign(t, validClaims()), valid: true},
+		{name: "PS256", token: ps.sign(t, validClaims()), valid: true},
+		{name: "ES256", token: es.sign(t, validClaims()), valid: true},
+		{name: "EdDSA", token: ed.sign(t, validClaims()), valid: true},
+		{name: "expired", token: rs.sign(t, with("exp", time.Now().Add(-time.Minute).Unix()))},
+		{name: "no expiry", token: rs.sign(t, with("exp", nil))},
+		{name: "not valid yet", token: rs.sign(t, with("nbf", time.Now().Add(time.Hour).Unix()))},
+		{name: "wrong issuer", token: rs.sign(t, with("iss", "https://evil.example.com"))},
+		{name: "wrong audience", token: rs.sign(t, with("aud", "games"))},
+		{name: "unknown key", token: unknown.sign(t, validClaims())},
+		{name: "algorithm of another key type", token: testSigner{kid: "ec", alg: "RS256", key: rs.key}.sign(t, validClaims())},
+		{name: "alg none", token: strings.Join(strings.Split(rs.sign(t, validClaims()), ".")[:2], ".") + "."},
+		{name: "malformed", token: "not-a-token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifier.verify(context.Background(), tt.token)
+			if tt.valid && (err != nil || claims["sub"] != "player-1") {
+				t.Errorf("Expected a valid token, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("Expected the token to be rejected")
+			}
+		})
+	}
+
+	t.Run("tampered claims", func(t *testing.T) {
+		parts := strings.Split(rs.sign(t, validClaims()), ".")
+		claims := validClaims()
+		claims["sub"] = "admin"
+		payload, _ := json.Marshal(claims)
+		parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+
+		if _, err := verifier.verify(context.Background(), strings.Join(parts, ".")); err == nil {
+			t.Error("Expected a tampered token to be rejected")
+		}
+	})
+}
+
+func TestJWKSRotation(t *testing.T) {
+	old := newTestSigner(t, "2024", "ES256")
+	current := newTestSigner(t, "2025", "ES256")
+
+	var mu sync.Mutex
+	published := jwksOf(old)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = w.Write(published)
+	}))
+	defer server.Close()
+
+	verifier, err := newJWTVerifier(JWTConfig{JWKSURL: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %v", err)
+	}
+	clock := time.Now()
+	verifier.keys.now = func() time.Time { return clock }
+
+	if _, err := verifier.verify(context.Background(), old.sign(t, validClaims())); err != nil {
+		t.Fatalf("Expected the keys to be fetched on first use, got %v", err)
+	}
+
+	mu.Lock()
+	published = jwksOf(old, current)
+	mu.Unlock()
+
+	// Unknown keys only trigger a reload once in a while
+	if _, err := verifier.verify(context.Background(), current.sign(t, validClaims())); err == nil {
+		t.Fatal("Expected the new key to be unknown right after a reload")
+	}
+
+	clock = clock.Add(jwksMinRefresh + time.Second)
+	if _, err := verifier.verify(context.Background(), current.sign(t, validClaims())); err != nil {
+		t.Errorf("Expected the rotated key to be picked up, got %v", err)
+	}
+
+	// The keys stay in use while the key server is down
+	server.Close()
+	clock = clock.Add(DefaultJWKSRefreshInterval + time.Second)
+	if _, err := verifier.verify(context.Background(), current.sign(t, validClaims())); err != nil {
+		t.Errorf("Expected the last keys to be used when the reload fails, got %v", err)
+	}
+}
+
+func TestJWKSSlowReload(t *testing.T) {
+	signer := newTestSigner(t, "2025", "ES256")
+
+	var requests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every fetch after the first hangs until the test is done
+		if requests.Add(1) > 1 {
+			<-release
+		}
+		_, _ = w.Write(jwksOf(signer))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	verifier, err := newJWTVerifier(JWTConfig{JWKSURL: server.URL})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %v", err)
+	}
+	clock := time.Now()
+	verifier.keys.now = func() time.Time { return clock }
+
+	if _, err := verifier.verify(context.Background(), signer.sign(t, validClaims())); err != nil {
+		t.Fatalf("Expected the keys to be fetched on first use, got %v", err)
+	}
+
+	// Stale keys are reloaded in the background, requests signed with a known key do not wait for the key server
+	clock = clock.Add(DefaultJWKSRefreshInterval + time.Second)
+	token := signer.sign(t, validClaims())
+	done := make(chan error, 5)
+	for range 5 {
+		go func() {
+			_, err := verifier.verify(context.Background(), token)
+			done <- err
+		}()
+	}
+	for range 5 {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Expected the known key to verify the token, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected verification not to wait for the reload")
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for requests.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("Expected a single reload in flight, got %d fetches", n)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	backend := headerEchoBackend(t)
+	pool := newTestPool(t, PoolConfig{Name: "backend", BackendUrls: []string{backend.URL}})
+	router, err := NewRouter([]RouteConfig{
+		{Name: "public", PathPrefix: "/public", Pool: "backend", Auth: &RouteAuthConfig{}},
+		{Name: "admin", PathPrefix: "/admin", Pool: "backend", Auth: &RouteAuthConfig{
+			Methods: []string{AuthMethodJWT},
+			Claims:  map[string][]string{"role": {"admin"}, "scope": {"games:write"}},
+		}},
+		{Name: "default", Pool: "backend"},
+	}, []*Pool{pool})
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	signer := newTestSigner(t, "key", "ES256")
+	keyHash := sha256.Sum256([]byte("secret-key"))
+	auth, err := NewAuthenticator(AuthConfig{
+		APIKeys: []APIKeyConfig{{Name: "partner", Hash: hex.EncodeToString(keyHash[:]), Claims: map[string]any{"tier": "gold"}}},
+		JWT:     JWTConfig{JWKSFile: writeJWKS(t, signer)},
+		Require: RouteAuthConfig{Methods: []string{AuthMethodAPIKey, AuthMethodJWT}},
+		ClaimHeaders: map[string]string{
+			"tier": "X-Auth-Tier",
+			"role": "X-Auth-Role",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	if err := router.useAuthenticator(auth); err != nil {
+		t.Fatalf("Failed to use authenticator: %v", err)
+	}
+
+	request := func(path string, headers map[string]string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(AuthSubjectHeader, "spoofed")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return req
+	}
+	bearer := func(claims map[string]any) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + signer.sign(t, claims)}
+	}
+
+	t.Run("public routes forward no identity", func(t *testing.T) {
+		_, received := serveHeaders(t, router, request("/public", nil))
+		if received.Get(AuthSubjectHeader) != "" {
+			t.Errorf("Expected the spoofed identity to be removed, got %q", received.Get(AuthSubjectHeader))
+		}
+	})
+
+	t.Run("api key", func(t *testing.T) {
+		_, received := serveHeaders(t, router, request("/", map[string]string{"X-API-Key": "secret-key"}))
+		if received.Get(AuthSubjectHeader) != "partner" || received.Get(AuthMethodHeader) != AuthMethodAPIKey ||
+			received.Get("X-Auth-Tier") != "gold" {
+			t.Errorf("Expected the identity of the api key to be forwarded, got %v", received)
+		}
+	})
+
+	t.Run("bearer token", func(t *testing.T) {
+		claims := validClaims()
+		claims["role"] = []string{"player", "admin"}
+		claims["scope"] = "games:read games:write"
+
+		_, received := serveHeaders(t, router, request("/admin", bearer(claims)))
+		if received.Get(AuthSubjectHeader) != "player-1" || received.Get(AuthMethodHeader) != AuthMethodJWT ||
+			received.Get("X-Auth-Role") != "player,admin" {
+			t.Errorf("Expected the identity of the token to be forwarded, got %v", received)
+		}
+	})
+
+	rejected := []struct {
+		name      string
+		req       *http.Request
+		status    int
+		challenge string
+	}{
+		{name: "no credentials", req: request("/", nil), status: http.StatusUnauthorized, challenge: `Bearer realm="loadbalancer"`},
+		{name: "unknown api key", req: request("/", map[string]string{"X-API-Key": "guess"}), status: http.StatusUnauthorized},
+		{name: "api key on a jwt route", req: request("/admin", map[string]string{"X-API-Key": "secret-key"}), status: http.StatusUnauthorized},
+		{name: "invalid token", req: request("/", map[string]string{"Authorization": "Bearer a.b.c"}), status: http.StatusUnauthorized,
+			challenge: `Bearer realm="loadbalancer", error="invalid_token"`},
+		{name: "missing claim", req: request("/admin", bearer(validClaims())), status: http.StatusForbidden},
+	}
+
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, tt.req)
+
+			if rr.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, rr.Code)
+			}
+			if tt.challenge != "" && rr.Header().Get("WWW-Authenticate") != tt.challenge {
+				t.Errorf("Expected challenge %q, got %q", tt.challenge, rr.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	for _, cfg := range []AuthConfig{
+		{APIKeys: []APIKeyConfig{{Name: "plain", Hash: "secret-key"}}},
+		{Require: RouteAuthConfig{Methods: []string{AuthMethodJWT}}},
+		{Require: RouteAuthConfig{Methods: []string{"basic"}}},
+	} {
+		if _, err := NewAuthenticator(cfg); err == nil {
+			t.Errorf("Expected config %+v to be rejected", cfg)
+		}
+	}
+}
@@ -1,43 +1,195 @@
 package loadbalancer
 
 import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
+	"sync/atomic"
 	"time"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/compression"
+	"github.com/jeroenpf/coda-homework-assignment/internal/deadline"
+	"github.com/jeroenpf/coda-homework-assignment/internal/limits"
+	"github.com/jeroenpf/coda-homework-assignment/internal/requestid"
+	"github.com/jeroenpf/coda-homework-assignment/internal/tracing"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BackendState is the administrative state of a backend, independent of its health
+type BackendState string
+
+const (
+	// BackendActive backends receive traffic while they are healthy
+	BackendActive BackendState = "active"
+	// BackendDraining backends finish their in-flight requests but receive no new ones
+	BackendDraining BackendState = "draining"
+	// BackendDisabled backends receive no traffic
+	BackendDisabled BackendState = "disabled"
 )
 
 type Backend struct {
+	// ID identifies the backend by its host and port
+	ID           string
 	Addr         string
 	ReverseProxy *httputil.ReverseProxy
-	Healthy      bool
-	LastCheck    time.Time
+	// Pool is the name of the pool the backend belongs to
+	Pool      string
+	Healthy   bool
+	LastCheck time.Time
+	State     BackendState
+	Weight    int
+	// Timeouts override the timeouts of the route for requests to this backend
+	Timeouts TimeoutConfig
+
+	inFlight    atomic.Int64
+	requests    atomic.Uint64
+	errors      atomic.Uint64
+	newConns    atomic.Uint64
+	reusedConns atomic.Uint64
+	// conns are the connection statistics of the shared transport, nil when another transport is used
+	conns *connStats
+}
+
+// BackendStatus is a point in time view of a backend
+type BackendStatus struct {
+	ID          string        `json:"id"`
+	Pool        string        `json:"pool"`
+	Addr        string        `json:"addr"`
+	State       BackendState  `json:"state"`
+	Healthy     bool          `json:"healthy"`
+	Weight      int           `json:"weight"`
+	Timeouts    TimeoutConfig `json:"timeouts"`
+	LastCheck   time.Time     `json:"last_check"`
+	InFlight    int64         `json:"in_flight"`
+	Requests    uint64        `json:"requests"`
+	Errors      uint64        `json:"errors"`
+	Connections ConnStats     `json:"connections"`
 }
 
-// NewBackend Creates a new backend for the provided URL
-func NewBackend(addr string) (*Backend, error) {
+// NewBackend Creates a new backend for the provided URL, requests are sent using the given transport
+func NewBackend(addr string, transport http.RoundTripper) (*Backend, error) {
 	backendUrl, err := url.Parse(addr)
 
 	if err != nil {
 		return nil, err
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(backendUrl)
+	proxy := &httputil.ReverseProxy{Transport: transport}
+
+	// The reverse proxy already removes hop-by-hop headers and the forwarding headers of the client before rewriting
+	proxy.Rewrite = func(pr *httputil.ProxyRequest) {
+		rt := routeFrom(pr.In.Context())
+		if rt != nil && rt.rewriter != nil {
+			rt.rewriter.rewrite(pr.Out.URL)
+		}
+
+		pr.SetURL(backendUrl)
+		pr.Out.Host = pr.In.Host
+		setForwardedHeaders(pr)
+
+		if rt != nil {
+			rt.config.RequestHeaders.apply(pr.Out.Header)
+		}
+
+		// Propagate the trace context of the upstream span and the remaining time to the backend
+		tracing.Inject(pr.Out.Context(), pr.Out)
+		deadline.Inject(pr.Out.Context(), pr.Out.Header)
+	}
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		ctx := resp.Request.Context()
+
+		// Record the upstream outcome for the access log
+		info := requestInfoFrom(ctx)
+		info.UpstreamStatus = resp.StatusCode
+		info.UpstreamLatency = time.Since(info.upstreamStart)
+
+		removeHeaders(resp.Header, forwardedFrom(resp.Request).internal)
+		// The client already gets the request ID of the load balancer, a backend echoing it would add it twice
+		resp.Header.Del(requestid.Header)
+		if rt := routeFrom(ctx); rt != nil {
+			if rt.cors != nil {
+				removeCORSHeaders(resp.Header)
+			}
+			rt.config.ResponseHeaders.apply(resp.Header)
+		}
+		return nil
+	}
+
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		info := requestInfoFrom(r.Context())
+		info.UpstreamLatency = time.Since(info.upstreamStart)
+
+		// Report why the request timed out rather than the generic context cancellation
+		var timeoutErr *upstreamTimeoutError
+		if errors.As(context.Cause(r.Context()), &timeoutErr) {
+			err = timeoutErr
+		}
+
+		span := trace.SpanFromContext(r.Context())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 
-	return &Backend{
+		// The client sent a body over the limits or one that could not be decoded, the backend is not to blame
+		status := limits.StatusCode(err)
+		if status == 0 {
+			status = compression.StatusCode(err)
+		}
+		if status != 0 {
+			slog.WarnContext(r.Context(), "request body rejected", "backend", addr, "error", err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		var netErr net.Error
+		if timeoutErr != nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+			slog.WarnContext(r.Context(), "upstream request timed out", "backend", addr, "error", err)
+			http.Error(w, "upstream request timed out: "+err.Error(), http.StatusGatewayTimeout)
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "proxying request failed", "backend", addr, "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	backend := &Backend{
+		ID:           backendUrl.Host,
 		Addr:         addr,
 		ReverseProxy: proxy,
 		Healthy:      true,
 		LastCheck:    time.Now(),
-	}, nil
+		State:        BackendActive,
+		Weight:       1,
+	}
+
+	if upstream, ok := transport.(*UpstreamTransport); ok {
+		backend.conns = upstream.conns.host(dialAddr(backendUrl))
+	}
+
+	return backend, nil
+}
+
+// gotConn counts whether a request to the backend was sent over a new or a reused connection
+func (b *Backend) gotConn(info httptrace.GotConnInfo) {
+	if info.Reused {
+		b.reusedConns.Add(1)
+		return
+	}
+	b.newConns.Add(1)
 }
 
 // NewBackends returns a slice of backends based on a given slice of backend URL's
-func NewBackends(urls []string) ([]*Backend, error) {
+func NewBackends(urls []string, transport http.RoundTripper) ([]*Backend, error) {
 	backends := make([]*Backend, 0, len(urls))
 
 	for _, backendUrl := range urls {
-		backend, err := NewBackend(backendUrl)
+		backend, err := NewBackend(backendUrl, transport)
 
 		if err != nil {
 			return nil, err
@@ -51,7 +203,12 @@ func NewBackends(urls []string) ([]*Backend, error) {
 
 // IsHealthy checks if the backend's /healthz endpoint can be reached and returns a valid status code
 func (b *Backend) IsHealthy(client *http.Client) bool {
-	resp, err := client.Get(b.Addr + "/healthz")
+	return b.checkHealth(client, DefaultHealthCheckPath)
+}
+
+// checkHealth checks if the health check path of the backend can be reached and returns a valid status code
+func (b *Backend) checkHealth(client *http.Client, path string) bool {
+	resp, err := client.Get(b.Addr + path)
 
 	if err != nil {
 		return false
@@ -61,3 +218,31 @@ func (b *Backend) IsHealthy(client *http.Client) bool {
 
 	return resp.StatusCode == http.StatusOK
 }
+
+// status returns a snapshot of the backend, the caller must hold the load balancer lock
+func (b *Backend) status() BackendStatus {
+	conns := ConnStats{
+		NewConns:    b.newConns.Load(),
+		ReusedConns: b.reusedConns.Load(),
+	}
+	if b.conns != nil {
+		conns.OpenConns = b.conns.open.Load()
+		conns.Dials = b.conns.dials.Load()
+		conns.DialErrors = b.conns.dialErrors.Load()
+	}
+
+	return BackendStatus{
+		ID:          b.ID,
+		Pool:        b.Pool,
+		Addr:        b.Addr,
+		State:       b.State,
+		Healthy:     b.Healthy,
+		Weight:      b.Weight,
+		Timeouts:    b.Timeouts,
+		LastCheck:   b.LastCheck,
+		InFlight:    b.inFlight.Load(),
+		Requests:    b.requests.Load(),
+		Errors:      b.errors.Load(),
+		Connections: conns,
+	}
+}
@@ -0,0 +1,640 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/requestid"
+)
+
+// CacheStatusHeader tells clients how the cache answered a request
+const CacheStatusHeader = "X-Cache"
+
+// Values of the cache status header
+const (
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheRevalidated = "REVALIDATED"
+	cacheBypass      = "BYPASS"
+)
+
+// CacheConfig configures the shared response cache in front of the pools
+type CacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// MaxBytes bounds the memory used by cached responses, the least recently used responses are evicted first
+	MaxBytes int64 `json:"max_bytes"`
+	// MaxObjectBytes is the largest response body that is cached
+	MaxObjectBytes int64 `json:"max_object_bytes"`
+}
+
+func DefaultCacheConfig() CacheConfig {
+	return CacheConfig{
+		MaxBytes:       64 << 20,
+		MaxObjectBytes: 1 << 20,
+	}
+}
+
+// cacheableStatus are the status codes whose responses may be stored
+var cacheableStatus = []int{
+	http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMultipleChoices,
+	http.StatusMovedPermanently, http.StatusPermanentRedirect, http.StatusNotFound, http.StatusMethodNotAllowed,
+	http.StatusGone, http.StatusRequestURITooLong, http.StatusNotImplemented,
+}
+
+// perRequestHeaders describe the exchange that filled the cache rather than the response, they are not stored
+var perRequestHeaders = []string{
+	requestid.Header, "Traceparent", "Tracestate", "Date",
+	"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After",
+	CacheStatusHeader,
+}
+
+// Cache is a shared HTTP cache for GET and HEAD requests. It honours the Cache-Control of requests and responses,
+// revalidates stale responses with their ETag or Last-Modified and stores a response per value of the headers it
+// varies by. Concurrent misses for the same response are sent to the backend once.
+type Cache struct {
+	config  CacheConfig
+	store   *cacheStore
+	metrics *Metrics
+	now     func() time.Time
+	// credentialHeaders carry the credentials of clients, responses to requests with credentials are only shared
+	// when the backend allows it explicitly
+	credentialHeaders []string
+
+	mu    sync.Mutex
+	calls map[string]*cacheCall
+}
+
+// cacheCall is a backend request that concurrent misses for the same key wait for
+type cacheCall struct {
+	done  chan struct{}
+	entry *cacheEntry
+}
+
+// NewCache creates an empty cache, metrics may be nil
+func NewCache(config CacheConfig, metrics *Metrics) *Cache {
+	return &Cache{
+		config:            config,
+		store:             newCacheStore(config.MaxBytes),
+		metrics:           metrics,
+		now:               time.Now,
+		credentialHeaders: []string{"Authorization", DefaultAPIKeyHeader},
+		calls:             make(map[string]*cacheCall),
+	}
+}
+
+// ServeHTTP answers the request from the cache or sends it to next, which proxies it to the backends of the route
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request, rt *route, next http.Handler) {
+	primary := cacheKey(r, rt)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// Successful unsafe requests invalidate the stored responses of their URL
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r)
+		if rec.status < http.StatusBadRequest {
+			c.store.invalidate(primary)
+		}
+		return
+	}
+
+	directives := parseCacheControl(r.Header.Values("Cache-Control"))
+	if directives.has("no-store") || r.Header.Get("Range") != "" {
+		c.pass(w, r, next, cacheBypass)
+		return
+	}
+
+	key := c.store.variantKey(primary, r.Header)
+	if entry := c.store.get(key); entry != nil && c.fresh(entry, r, directives) {
+		c.serve(w, r, entry, cacheHit)
+		return
+	}
+
+	// Responses to HEAD requests have no body to store
+	if r.Method == http.MethodHead {
+		c.pass(w, r, next, cacheMiss)
+		return
+	}
+
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			return
+		}
+		// The response may vary by headers in which this request differs from the one that was sent
+		if e := call.entry; e != nil && e.key == c.store.keyFor(primary, e.vary, r.Header) {
+			c.serve(w, r, e, cacheHit)
+		} else {
+			c.pass(w, r, next, cacheMiss)
+		}
+		return
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	call.entry = c.fetch(w, r, primary, key, next)
+}
+
+// pass sends the request to next without storing the response
+func (c *Cache) pass(w http.ResponseWriter, r *http.Request, next http.Handler, status string) {
+	c.record(r, status)
+	w.Header().Set(CacheStatusHeader, status)
+	next.ServeHTTP(w, r)
+}
+
+// fresh reports whether the stored response may be served without revalidation
+func (c *Cache) fresh(e *cacheEntry, r *http.Request, directives cacheControl) bool {
+	if directives.has("no-cache") || r.Header.Get("Pragma") == "no-cache" {
+		return false
+	}
+	age := e.age(c.now())
+	if maxAge, ok := directives.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	return age < e.lifetime
+}
+
+// fetch sends the request to the backend, revalidating the stale entry under the key if it has validators, and
+// stores the response when it may be cached. It returns the stored entry.
+func (c *Cache) fetch(w http.ResponseWriter, r *http.Request, primary, key string, next http.Handler) *cacheEntry {
+	// The cache asks its own conditional questions, the conditions of the client are evaluated on the stored response
+	out := r.Clone(r.Context())
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+
+	stale := c.store.get(key)
+	if stale != nil && stale.validators() {
+		if etag := stale.header.Get("ETag"); etag != "" {
+			out.Header.Set("If-None-Match", etag)
+		}
+		if modified := stale.header.Get("Last-Modified"); modified != "" {
+			out.Header.Set("If-Modified-Since", modified)
+		}
+	} else {
+		stale = nil
+	}
+
+	cw := &cacheWriter{w: w, header: make(http.Header), limit: c.config.MaxObjectBytes, revalidating: stale != nil}
+	next.ServeHTTP(cw, out)
+
+	if cw.notModified {
+		entry := stale.revalidated(cw.header, c.now())
+		c.store.put(entry)
+		c.metrics.cacheSize(c.store.bytes())
+		c.serve(w, r, entry, cacheRevalidated)
+		return entry
+	}
+	c.record(r, cacheMiss)
+
+	entry, ok := newCacheEntry(c.credentials(r), cw.status, cw.header, cw.body.Bytes(), c.now())
+	if !ok || cw.tooLarge {
+		// A stale response that can no longer be stored must not be revalidated again
+		c.store.delete(key)
+		return nil
+	}
+	entry.primary = primary
+	entry.key = c.store.keyFor(primary, entry.vary, r.Header)
+	c.store.put(entry)
+	c.metrics.cacheSize(c.store.bytes())
+	return entry
+}
+
+// serve writes a stored response, conditional requests of the client are answered with 304 Not Modified
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, e *cacheEntry, status string) {
+	c.record(r, status)
+
+	h := w.Header()
+	for name, values := range e.header {
+		h[name] = append(h[name], values...)
+	}
+	h.Set("Age", strconv.Itoa(int(e.age(c.now()).Seconds())))
+	h.Set(CacheStatusHeader, status)
+
+	if e.status == http.StatusOK && e.notModified(r) {
+		h.Del("Content-Length")
+		h.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(e.body)
+	}
+}
+
+// credentials reports whether the request carries credentials or was authenticated
+func (c *Cache) credentials(r *http.Request) bool {
+	if r.Header.Get(AuthSubjectHeader) != "" || requestInfoFrom(r.Context()).User != "" {
+		return true
+	}
+	for _, name := range c.credentialHeaders {
+		if r.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cache) record(r *http.Request, status string) {
+	requestInfoFrom(r.Context()).CacheStatus = status
+	c.metrics.cacheRequest(status)
+}
+
+// cacheKey identifies the responses of a URL on a route, HEAD requests are answered with the response to GET
+func cacheKey(r *http.Request, rt *route) string {
+	return rt.config.Name + "\x00" + strings.ToLower(r.Host) + "\x00" + r.URL.RequestURI()
+}
+
+// cacheWriter passes the response of the backend to the client while keeping a copy to store. A 304 in answer to
+// a revalidation is not passed on, the client receives the revalidated response instead.
+type cacheWriter struct {
+	w            http.ResponseWriter
+	header       http.Header
+	status       int
+	wroteHeader  bool
+	revalidating bool
+	notModified  bool
+	body         bytes.Buffer
+	limit        int64
+	tooLarge     bool
+}
+
+func (cw *cacheWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	if cw.wroteHeader || status < http.StatusOK {
+		return
+	}
+	cw.status = status
+	cw.wroteHeader = true
+
+	if cw.revalidating && status == http.StatusNotModified {
+		cw.notModified = true
+		return
+	}
+	if length, err := strconv.ParseInt(cw.header.Get("Content-Length"), 10, 64); err == nil && length > cw.limit {
+		cw.tooLarge = true
+	}
+
+	h := cw.w.Header()
+	for name, values := range cw.header {
+		h[name] = append(h[name], values...)
+	}
+	h.Set(CacheStatusHeader, cacheMiss)
+	cw.w.WriteHeader(status)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.notModified {
+		return len(b), nil
+	}
+
+	if !cw.tooLarge {
+		if int64(cw.body.Len()+len(b)) > cw.limit {
+			cw.tooLarge = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(b)
+		}
+	}
+	return cw.w.Write(b)
+}
+
+// Flush lets streamed responses reach the client, the reverse proxy flushes through http.ResponseController
+func (cw *cacheWriter) Flush() {
+	if !cw.notModified {
+		_ = http.NewResponseController(cw.w).Flush()
+	}
+}
+
+// cacheEntry is a stored response
+type cacheEntry struct {
+	// primary is the key of the URL, key adds the values of the headers the response varies by
+	primary string
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	// vary are the request headers the response depends on
+	vary []string
+	// stored is when the response was received or last revalidated, initialAge is its Age at that time
+	stored     time.Time
+	initialAge time.Duration
+	lifetime   time.Duration
+}
+
+// newCacheEntry returns the response as an entry when a shared cache may store it, credentials tells whether the
+// request carried credentials
+func newCacheEntry(credentials bool, status int, header http.Header, body []byte, now time.Time) (*cacheEntry, bool) {
+	if !slices.Contains(cacheableStatus, status) || header.Get("Set-Cookie") != "" {
+		return nil, false
+	}
+
+	directives := parseCacheControl(header.Values("Cache-Control"))
+	if directives.has("no-store") || directives.has("private") {
+		return nil, false
+	}
+	// Responses to authorized requests are only shared when the backend allows it explicitly
+	if credentials &&
+		!directives.has("public") && !directives.has("s-maxage") && !directives.has("must-revalidate") {
+		return nil, false
+	}
+
+	var vary []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name == "*" {
+				return nil, false
+			} else if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(vary)
+
+	e := &cacheEntry{
+		status: status,
+		header: header.Clone(),
+		body:   bytes.Clone(body),
+		vary:   slices.Compact(vary),
+		stored: now,
+	}
+	e.update(now)
+	removeHeaders(e.header, perRequestHeaders)
+
+	// Without a freshness lifetime a response is only useful when it can be revalidated
+	if e.lifetime <= 0 && !e.validators() {
+		return nil, false
+	}
+	return e, true
+}
+
+// update derives the age and freshness lifetime from the headers of the entry
+func (e *cacheEntry) update(now time.Time) {
+	e.initialAge = 0
+	if age, err := strconv.Atoi(e.header.Get("Age")); err == nil && age > 0 {
+		e.initialAge = time.Duration(age) * time.Second
+	}
+
+	// s-maxage is meant for shared caches and takes precedence over max-age and Expires
+	directives := parseCacheControl(e.header.Values("Cache-Control"))
+	e.lifetime = 0
+	if directives.has("no-cache") {
+		return
+	}
+	if lifetime, ok := directives.seconds("s-maxage"); ok {
+		e.lifetime = lifetime
+		return
+	}
+	if lifetime, ok := directives.seconds("max-age"); ok {
+		e.lifetime = lifetime
+		return
+	}
+	if expires, err := http.ParseTime(e.header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(e.header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		e.lifetime = expires.Sub(date)
+	}
+}
+
+// revalidated returns a copy of the entry with the headers of a 304 response applied
+func (e *cacheEntry) revalidated(header http.Header, now time.Time) *cacheEntry {
+	updated := *e
+	updated.header = e.header.Clone()
+	for name, values := range header {
+		if name == "Content-Length" || name == CacheStatusHeader {
+			continue
+		}
+		updated.header[name] = values
+	}
+	updated.stored = now
+	updated.update(now)
+	removeHeaders(updated.header, perRequestHeaders)
+	return &updated
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.stored)
+}
+
+func (e *cacheEntry) validators() bool {
+	return e.header.Get("ETag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+// notModified evaluates the conditional headers of the request against the entry
+func (e *cacheEntry) notModified(r *http.Request) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		etag := strings.TrimPrefix(e.header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		modified, err := http.ParseTime(e.header.Get("Last-Modified"))
+		return err == nil && !modified.After(since)
+	}
+	return false
+}
+
+func (e *cacheEntry) size() int64 {
+	size := len(e.key) + len(e.body)
+	for name, values := range e.header {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	return int64(size)
+}
+
+// cacheStore keeps the entries in memory up to a number of bytes, evicting the least recently used entries first
+type cacheStore struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List
+	entries  map[string]*list.Element
+	// variants are the entries of a URL by their primary key, with the headers the responses vary by
+	variants map[string]*cacheVariants
+}
+
+type cacheVariants struct {
+	vary []string
+	keys map[string]struct{}
+}
+
+func newCacheStore(maxBytes int64) *cacheStore {
+	return &cacheStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		variants: make(map[string]*cacheVariants),
+	}
+}
+
+// variantKey returns the key of the entry that would answer the request
+func (s *cacheStore) variantKey(primary string, header http.Header) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.variants[primary]; ok {
+		return s.keyFor(primary, v.vary, header)
+	}
+	return primary
+}
+
+// keyFor adds the values of the request headers a response varies by to the primary key
+func (s *cacheStore) keyFor(primary string, vary []string, header http.Header) string {
+	key := primary
+	for _, name := range vary {
+		key += "\x00" + name + ":" + strings.Join(header.Values(name), ",")
+	}
+	return key
+}
+
+func (s *cacheStore) get(key string) *cacheEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry)
+}
+
+func (s *cacheStore) put(e *cacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e.size() > s.maxBytes {
+		return
+	}
+
+	if elem, ok := s.entries[e.key]; ok {
+		s.remove(elem)
+	}
+
+	// A response that varies by other headers replaces all variants of the URL
+	v, ok := s.variants[e.primary]
+	if ok && !slices.Equal(v.vary, e.vary) {
+		s.removeVariants(e.primary)
+		ok = false
+	}
+	if !ok {
+		v = &cacheVariants{vary: e.vary, keys: make(map[string]struct{})}
+		s.variants[e.primary] = v
+	}
+
+	s.entries[e.key] = s.lru.PushFront(e)
+	s.size += e.size()
+	v.keys[e.key] = struct{}{}
+
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *cacheStore) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+}
+
+// invalidate removes all variants of a URL
+func (s *cacheStore) invalidate(primary string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeVariants(primary)
+}
+
+func (s *cacheStore) removeVariants(primary string) {
+	if v, ok := s.variants[primary]; ok {
+		for key := range v.keys {
+			s.remove(s.entries[key])
+		}
+		delete(s.variants, primary)
+	}
+}
+
+func (s *cacheStore) remove(elem *list.Element) {
+	e := s.lru.Remove(elem).(*cacheEntry)
+	delete(s.entries, e.key)
+	s.size -= e.size()
+
+	if v, ok := s.variants[e.primary]; ok {
+		delete(v.keys, e.key)
+		if len(v.keys) == 0 {
+			delete(s.variants, e.primary)
+		}
+	}
+}
+
+func (s *cacheStore) bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// cacheControl are the directives of Cache-Control headers by name
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	directives := make(cacheControl)
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the value of a directive with a delta-seconds argument such as max-age
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	seconds, err := strconv.ParseInt(cc[directive], 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
@@ -0,0 +1,300 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/requestid"
+)
+
+// cacheTestBackend answers with the Cache-Control and Vary of the query, an ETag and the number of requests it got,
+// conditional requests with a matching ETag get a 304
+func cacheTestBackend(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		w.Header().Set("Cache-Control", r.URL.Query().Get("cc"))
+		if r.URL.Query().Get("etag") != "none" {
+			w.Header().Set("ETag", `"v1"`)
+		}
+		if vary := r.URL.Query().Get("vary"); vary != "" {
+			w.Header().Set("Vary", vary)
+		}
+		if r.URL.Query().Get("cookie") != "" {
+			w.Header().Set("Set-Cookie", "session=1")
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = fmt.Fprintf(w, "response %d %s", n, r.Header.Get("Accept-Language"))
+	}))
+	t.Cleanup(backend.Close)
+	return backend, &requests
+}
+
+func newCacheTestRouter(t *testing.T, backendURL string, config CacheConfig) *Router {
+	t.Helper()
+
+	pool := newTestPool(t, PoolConfig{Name: "backend", BackendUrls: []string{backendURL}})
+	router, err := NewRouter([]RouteConfig{{Name: "default", Pool: "backend"}}, []*Pool{pool})
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	router.cache = NewCache(config, nil)
+	return router
+}
+
+func cacheRequest(router *Router, method, target string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCache(t *testing.T) {
+	backend, requests := cacheTestBackend(t)
+	router := newCacheTestRouter(t, backend.URL, DefaultCacheConfig())
+	now := time.Now()
+	router.cache.now = func() time.Time { return now }
+
+	expect := func(t *testing.T, rr *httptest.ResponseRecorder, status int, cacheStatus, body string) {
+		t.Helper()
+		if rr.Code != status || rr.Header().Get(CacheStatusHeader) != cacheStatus || rr.Body.String() != body {
+			t.Errorf("Expected %d %s %q, got %d %s %q", status, cacheStatus, body,
+				rr.Code, rr.Header().Get(CacheStatusHeader), rr.Body.String())
+		}
+	}
+
+	t.Run("fresh responses are served from the cache", func(t *testing.T) {
+		requests.Store(0)
+		rr := cacheRequest(router, http.MethodGet, "/fresh?cc=max-age=60", nil)
+		expect(t, rr, http.StatusOK, cacheMiss, "response 1 ")
+
+		now = now.Add(30 * time.Second)
+		rr = cacheRequest(router, http.MethodGet, "/fresh?cc=max-age=60", nil)
+		expect(t, rr, http.StatusOK, cacheHit, "response 1 ")
+		if rr.Header().Get("Age") != "30" {
+			t.Errorf("Expected age 30, got %q", rr.Header().Get("Age"))
+		}
+		expect(t, cacheRequest(router, http.MethodHead, "/fresh?cc=max-age=60", nil), http.StatusOK, cacheHit, "")
+
+		// The client may ask for a fresher response or revalidation
+		rr = cacheRequest(router, http.MethodGet, "/fresh?cc=max-age=60", map[string]string{"Cache-Control": "max-age=10"})
+		expect(t, rr, http.StatusOK, cacheRevalidated, "response 1 ")
+		if requests.Load() != 2 {
+			t.Errorf("Expected 2 backend requests, got %d", requests.Load())
+		}
+	})
+
+	t.Run("stale responses are revalidated", func(t *testing.T) {
+		requests.Store(0)
+		cacheRequest(router, http.MethodGet, "/stale?cc=max-age=10", nil)
+		now = now.Add(time.Minute)
+
+		rr := cacheRequest(router, http.MethodGet, "/stale?cc=max-age=10", nil)
+		expect(t, rr, http.StatusOK, cacheRevalidated, "response 1 ")
+		rr = cacheRequest(router, http.MethodGet, "/stale?cc=max-age=10", nil)
+		expect(t, rr, http.StatusOK, cacheHit, "response 1 ")
+		if requests.Load() != 2 {
+			t.Errorf("Expected 2 backend requests, got %d", requests.Load())
+		}
+	})
+
+	t.Run("conditional requests of clients", func(t *testing.T) {
+		cacheRequest(router, http.MethodGet, "/conditional?cc=max-age=60", nil)
+		rr := cacheRequest(router, http.MethodGet, "/conditional?cc=max-age=60", map[string]string{"If-None-Match": `W/"v1"`})
+		expect(t, rr, http.StatusNotModified, cacheHit, "")
+	})
+
+	t.Run("vary", func(t *testing.T) {
+		requests.Store(0)
+		target := "/vary?cc=max-age=60&vary=Accept-Language"
+		language := func(value string) map[string]string { return map[string]string{"Accept-Language": value} }
+		expect(t, cacheRequest(router, http.MethodGet, target, language("nl")), http.StatusOK, cacheMiss, "response 1 nl")
+		expect(t, cacheRequest(router, http.MethodGet, target, language("en")), http.StatusOK, cacheMiss, "response 2 en")
+		expect(t, cacheRequest(router, http.MethodGet, target, language("nl")), http.StatusOK, cacheHit, "response 1 nl")
+		expect(t, cacheRequest(router, http.MethodGet, target, language("en")), http.StatusOK, cacheHit, "response 2 en")
+	})
+
+	t.Run("unsafe requests invalidate", func(t *testing.T) {
+		requests.Store(0)
+		cacheRequest(router, http.MethodGet, "/invalidate?cc=max-age=60", nil)
+		cacheRequest(router, http.MethodPost, "/invalidate?cc=max-age=60", nil)
+		rr := cacheRequest(router, http.MethodGet, "/invalidate?cc=max-age=60", nil)
+		expect(t, rr, http.StatusOK, cacheMiss, "response 3 ")
+	})
+
+	uncacheable := []struct {
+		name    string
+		target  string
+		headers map[string]string
+		status  string
+	}{
+		{"no-store", "/no-store?cc=no-store", nil, cacheMiss},
+		{"private", "/private?cc=private,max-age=60", nil, cacheMiss},
+		{"no freshness or validators", "/plain?cc=&etag=none", nil, cacheMiss},
+		{"set-cookie", "/cookie?cc=max-age=60&cookie=1", nil, cacheMiss},
+		{"vary on anything", "/star?cc=max-age=60&vary=*", nil, cacheMiss},
+		{"authorization", "/auth?cc=max-age=60", map[string]string{"Authorization": "Bearer token"}, cacheMiss},
+		{"api key", "/api-key?cc=max-age=60", map[string]string{DefaultAPIKeyHeader: "secret"}, cacheMiss},
+		{"request no-store", "/request-no-store?cc=max-age=60", map[string]string{"Cache-Control": "no-store"}, cacheBypass},
+	}
+	for _, tt := range uncacheable {
+		t.Run(tt.name, func(t *testing.T) {
+			requests.Store(0)
+			for range 2 {
+				rr := cacheRequest(router, http.MethodGet, tt.target, tt.headers)
+				if rr.Header().Get(CacheStatusHeader) != tt.status {
+					t.Errorf("Expected %s, got %s", tt.status, rr.Header().Get(CacheStatusHeader))
+				}
+			}
+			if requests.Load() != 2 {
+				t.Errorf("Expected every request to reach the backend, got %d backend requests", requests.Load())
+			}
+		})
+	}
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("slow response"))
+	}))
+	t.Cleanup(backend.Close)
+	router := newCacheTestRouter(t, backend.URL, DefaultCacheConfig())
+
+	const clients = 10
+	var wg sync.WaitGroup
+	results := make([]*httptest.ResponseRecorder, clients)
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = cacheRequest(router, http.MethodGet, "/slow", nil)
+		}()
+	}
+
+	// Give the clients time to queue up behind the first request
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if requests.Load() != 1 {
+		t.Errorf("Expected the misses to be coalesced into 1 backend request, got %d", requests.Load())
+	}
+	for _, rr := range results {
+		if rr.Code != http.StatusOK || rr.Body.String() != "slow response" {
+			t.Errorf("Expected every client to get the response, got %d %q", rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestCachePerRequestHeaders(t *testing.T) {
+	backend := httptest.NewServer(requestid.Middleware(true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("cached"))
+	})))
+	t.Cleanup(backend.Close)
+	router := newCacheTestRouter(t, backend.URL, DefaultCacheConfig())
+	handler := requestid.Middleware(true, router)
+
+	send := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/ids", nil)
+		req.Header.Set(requestid.Header, id)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	send("first")
+
+	rr := send("second")
+	if rr.Header().Get(CacheStatusHeader) != cacheHit {
+		t.Fatalf("Expected a hit, got %s", rr.Header().Get(CacheStatusHeader))
+	}
+	if ids := rr.Header().Values(requestid.Header); len(ids) != 1 || ids[0] != "second" {
+		t.Errorf("Expected only the ID of the second request, got %v", ids)
+	}
+	if values := rr.Header().Values(CacheStatusHeader); len(values) != 1 {
+		t.Errorf("Expected a single cache status, got %v", values)
+	}
+}
+
+func TestCacheCoalescingVary(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			<-release
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		_, _ = w.Write([]byte(r.Header.Get("Accept-Language")))
+	}))
+	t.Cleanup(backend.Close)
+	router := newCacheTestRouter(t, backend.URL, DefaultCacheConfig())
+
+	// Before the first response arrives the cache cannot know it varies, so both requests wait for the same call
+	first := make(chan *httptest.ResponseRecorder)
+	go func() {
+		first <- cacheRequest(router, http.MethodGet, "/vary", map[string]string{"Accept-Language": "nl"})
+	}()
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan *httptest.ResponseRecorder)
+	go func() {
+		second <- cacheRequest(router, http.MethodGet, "/vary", map[string]string{"Accept-Language": "en"})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	if rr := <-first; rr.Body.String() != "nl" {
+		t.Errorf("Expected the first client to get its variant, got %q", rr.Body.String())
+	}
+	if rr := <-second; rr.Body.String() != "en" || rr.Header().Get(CacheStatusHeader) != cacheMiss {
+		t.Errorf("Expected the second client to get its own variant from the backend, got %s %q",
+			rr.Header().Get(CacheStatusHeader), rr.Body.String())
+	}
+}
+
+func TestCacheStoreEviction(t *testing.T) {
+	store := newCacheStore(300)
+	entry := func(key string) *cacheEntry {
+		return &cacheEntry{primary: key, key: key, header: http.Header{}, body: make([]byte, 100)}
+	}
+
+	store.put(entry("a"))
+	store.put(entry("b"))
+	store.get("a")
+	store.put(entry("c"))
+
+	if store.get("b") != nil {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	if store.get("a") == nil || store.get("c") == nil {
+		t.Error("Expected the recently used entries to be kept")
+	}
+	if store.bytes() > 300 {
+		t.Errorf("Expected the store to stay within 300 bytes, got %d", store.bytes())
+	}
+
+	store.put(&cacheEntry{primary: "large", key: "large", header: http.Header{}, body: make([]byte, 400)})
+	if store.get("large") != nil || store.get("a") == nil {
+		t.Error("Expected entries larger than the store to be skipped")
+	}
+}
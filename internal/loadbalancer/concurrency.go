@@ -0,0 +1,276 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull    = errors.New("too many requests waiting")
+	ErrQueueTimeout = errors.New("timed out waiting for a free slot")
+)
+
+// ConcurrencyConfig limits the number of requests proxied at once. A limit of 0 disables the limiter.
+type ConcurrencyConfig struct {
+	// Limit is the maximum number of requests in flight
+	Limit int
+	// QueueSize requests wait for a free slot for at most QueueTimeout, other requests are rejected right away
+	QueueSize    int
+	QueueTimeout time.Duration
+	// Adaptive lowers the limit down to MinLimit while the upstream latency exceeds LatencyTarget or backends fail,
+	// and raises it back to Limit when they recover (additive increase, multiplicative decrease)
+	Adaptive      bool
+	MinLimit      int
+	LatencyTarget time.Duration
+}
+
+func (c ConcurrencyConfig) validate() error {
+	switch {
+	case c.Limit < 0 || c.QueueSize < 0 || c.QueueTimeout < 0 || c.MinLimit < 0 || c.LatencyTarget < 0:
+		return errors.New("concurrency values must not be negative")
+	case c.Adaptive && c.LatencyTarget == 0:
+		return errors.New("adaptive concurrency requires a latency target")
+	case c.MinLimit > c.Limit:
+		return fmt.Errorf("minimum limit %d exceeds the limit %d", c.MinLimit, c.Limit)
+	}
+	return nil
+}
+
+func (c ConcurrencyConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(concurrencyJSON{
+		Limit:         c.Limit,
+		QueueSize:     c.QueueSize,
+		QueueTimeout:  formatDuration(c.QueueTimeout),
+		Adaptive:      c.Adaptive,
+		MinLimit:      c.MinLimit,
+		LatencyTarget: formatDuration(c.LatencyTarget),
+	})
+}
+
+func (c *ConcurrencyConfig) UnmarshalJSON(data []byte) error {
+	var raw concurrencyJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	var err error
+	c.Limit, c.QueueSize, c.Adaptive, c.MinLimit = raw.Limit, raw.QueueSize, raw.Adaptive, raw.MinLimit
+	if c.QueueTimeout, err = parseDuration("queue_timeout", raw.QueueTimeout); err != nil {
+		return err
+	}
+	if c.LatencyTarget, err = parseDuration("latency_target", raw.LatencyTarget); err != nil {
+		return err
+	}
+	return nil
+}
+
+type concurrencyJSON struct {
+	Limit         int    `json:"limit,omitempty"`
+	QueueSize     int    `json:"queue_size,omitempty"`
+	QueueTimeout  string `json:"queue_timeout,omitempty"`
+	Adaptive      bool   `json:"adaptive,omitempty"`
+	MinLimit      int    `json:"min_limit,omitempty"`
+	LatencyTarget string `json:"latency_target,omitempty"`
+}
+
+// aimdBackoff is the factor the adaptive limit is multiplied with when the backends are overloaded
+const aimdBackoff = 0.9
+
+// ConcurrencyStatus is a point in time view of a concurrency limiter
+type ConcurrencyStatus struct {
+	Limit    int `json:"limit"`
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+	// QueuedByClass breaks the queued requests down by priority class
+	QueuedByClass map[string]int `json:"queued_by_class,omitempty"`
+	Rejected      uint64         `json:"rejected"`
+}
+
+// ConcurrencyLimiter admits a limited number of requests at once. Excess requests wait in a bounded weighted fair
+// queue, when it is full a request preempts a waiting request of a lower priority class.
+type ConcurrencyLimiter struct {
+	config ConcurrencyConfig
+	// name identifies the limiter in metrics
+	name    string
+	metrics *Metrics
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	queue    fairQueue
+	rejected uint64
+}
+
+// NewConcurrencyLimiter creates a limiter, it returns nil when the config does not limit anything
+func NewConcurrencyLimiter(cfg ConcurrencyConfig) (*ConcurrencyLimiter, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Limit == 0 {
+		return nil, nil
+	}
+	if cfg.MinLimit == 0 {
+		cfg.MinLimit = 1
+	}
+
+	return &ConcurrencyLimiter{config: cfg, limit: float64(cfg.Limit)}, nil
+}
+
+// instrument reports the queue of the limiter under the given name
+func (l *ConcurrencyLimiter) instrument(name string, metrics *Metrics) {
+	if l != nil {
+		l.name, l.metrics = name, metrics
+	}
+}
+
+// Acquire waits for a free slot, every successful call must be followed by Release. The priority class of the request
+// is taken from the context.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) error {
+	p := priorityFrom(ctx)
+	start := time.Now()
+
+	l.mu.Lock()
+	if l.inFlight < int(l.limit) && l.queue.len == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		l.metrics.admitted(l.name, p.class, 0)
+		return nil
+	}
+
+	if l.queue.len >= l.config.QueueSize && !l.preempt(p.rank) {
+		l.rejected++
+		l.mu.Unlock()
+		l.metrics.rejected(l.name, p.class, ErrQueueFull)
+		return ErrQueueFull
+	}
+
+	w := &waiter{class: l.queue.class(p), enqueued: start, ready: make(chan struct{})}
+	l.queue.push(w)
+	l.observe(w.class)
+	l.mu.Unlock()
+
+	// Without a queue timeout requests wait as long as their context allows
+	var timeout <-chan time.Time
+	if l.config.QueueTimeout > 0 {
+		timer := time.NewTimer(l.config.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		if w.err != nil {
+			l.metrics.rejected(l.name, p.class, w.err)
+			return w.err
+		}
+		l.metrics.admitted(l.name, p.class, time.Since(start))
+		return nil
+	case <-timeout:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+	}
+
+	l.mu.Lock()
+	select {
+	case <-w.ready:
+		if w.err == nil {
+			// The slot was granted while giving up, it is handed to the next request
+			l.inFlight--
+			l.grant()
+			l.rejected++
+		} else {
+			// The request was preempted and counted as rejected already
+			err = w.err
+		}
+	default:
+		l.queue.remove(w)
+		l.observe(w.class)
+		l.rejected++
+	}
+	l.mu.Unlock()
+
+	l.metrics.rejected(l.name, p.class, err)
+	return err
+}
+
+// preempt makes room in the queue by rejecting the most recent request of the lowest class below the given rank
+func (l *ConcurrencyLimiter) preempt(rank int) bool {
+	victim := l.queue.victim(rank)
+	if victim == nil {
+		return false
+	}
+
+	l.queue.remove(victim)
+	l.observe(victim.class)
+	l.rejected++
+	victim.err = ErrPreempted
+	close(victim.ready)
+	return true
+}
+
+// Release frees the slot of a completed request and adapts the limit to its outcome, overloaded reports a failed
+// response from the backend
+func (l *ConcurrencyLimiter) Release(latency time.Duration, overloaded bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.config.Adaptive {
+		if overloaded || latency > l.config.LatencyTarget {
+			l.limit = max(float64(l.config.MinLimit), l.limit*aimdBackoff)
+		} else {
+			l.limit = min(float64(l.config.Limit), l.limit+1/l.limit)
+		}
+	}
+
+	l.inFlight--
+	l.grant()
+}
+
+// abandon frees the slot of a request that was never proxied, without adapting the limit
+func (l *ConcurrencyLimiter) abandon() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	l.grant()
+}
+
+// grant admits queued requests while there are free slots
+func (l *ConcurrencyLimiter) grant() {
+	for l.inFlight < int(l.limit) {
+		w := l.queue.pop()
+		if w == nil {
+			return
+		}
+		l.observe(w.class)
+		l.inFlight++
+		close(w.ready)
+	}
+}
+
+// observe reports the queue length of a class
+func (l *ConcurrencyLimiter) observe(class *classQueue) {
+	l.metrics.queued(l.name, class.class, class.waiters.Len())
+}
+
+func (l *ConcurrencyLimiter) Status() ConcurrencyStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := ConcurrencyStatus{Limit: int(l.limit), InFlight: l.inFlight, Queued: l.queue.len, Rejected: l.rejected}
+	for _, class := range l.queue.classes {
+		if n := class.waiters.Len(); n > 0 {
+			if status.QueuedByClass == nil {
+				status.QueuedByClass = make(map[string]int)
+			}
+			status.QueuedByClass[class.class] = n
+		}
+	}
+	return status
+}
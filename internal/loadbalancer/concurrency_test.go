@@ -0,0 +1,213 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestConcurrencyLimiter(t *testing.T, cfg ConcurrencyConfig) *ConcurrencyLimiter {
+	t.Helper()
+
+	limiter, err := NewConcurrencyLimiter(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create concurrency limiter: %v", err)
+	}
+	return limiter
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	limiter := newTestConcurrencyLimiter(t, ConcurrencyConfig{Limit: 2, QueueSize: 1, QueueTimeout: time.Second})
+	ctx := context.Background()
+
+	for range 2 {
+		if err := limiter.Acquire(ctx); err != nil {
+			t.Fatalf("Expected a free slot, got %v", err)
+		}
+	}
+
+	// The third request waits in the queue, the fourth does not fit
+	acquired := make(chan error, 1)
+	go func() { acquired <- limiter.Acquire(ctx) }()
+	for limiter.Status().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := limiter.Acquire(ctx); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Expected the queue to be full, got %v", err)
+	}
+
+	limiter.Release(time.Millisecond, false)
+	if err := <-acquired; err != nil {
+		t.Fatalf("Expected the queued request to get the released slot, got %v", err)
+	}
+
+	status := limiter.Status()
+	if status.InFlight != 2 || status.Queued != 0 || status.Rejected != 1 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	// Queued requests give up when their context ends
+	cancelCtx, cancel := context.WithCancel(ctx)
+	go func() { acquired <- limiter.Acquire(cancelCtx) }()
+	for limiter.Status().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-acquired; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the request to be cancelled, got %v", err)
+	}
+	if status := limiter.Status(); status.Queued != 0 || status.InFlight != 2 {
+		t.Errorf("Expected the cancelled request to leave the queue, got %+v", status)
+	}
+}
+
+func TestConcurrencyLimiterTimeout(t *testing.T) {
+	limiter := newTestConcurrencyLimiter(t, ConcurrencyConfig{Limit: 1, QueueSize: 5, QueueTimeout: 20 * time.Millisecond})
+
+	if err := limiter.Acquire(context.Background()); err != nil {
+		t.Fatalf("Expected a free slot, got %v", err)
+	}
+	if err := limiter.Acquire(context.Background()); !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("Expected the queued request to time out, got %v", err)
+	}
+
+	// A slot freed without an outcome is handed to the next request
+	limiter.abandon()
+	if err := limiter.Acquire(context.Background()); err != nil {
+		t.Errorf("Expected the abandoned slot to be free, got %v", err)
+	}
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	limiter := newTestConcurrencyLimiter(t, ConcurrencyConfig{
+		Limit:         10,
+		MinLimit:      2,
+		Adaptive:      true,
+		LatencyTarget: 100 * time.Millisecond,
+	})
+
+	release := func(latency time.Duration, overloaded bool, n int) {
+		for range n {
+			if err := limiter.Acquire(context.Background()); err != nil {
+				t.Fatalf("Failed to acquire: %v", err)
+			}
+			limiter.Release(latency, overloaded)
+		}
+	}
+
+	release(time.Second, false, 1)
+	if limit := limiter.Status().Limit; limit != 9 {
+		t.Errorf("Expected a slow response to lower the limit to 9, got %d", limit)
+	}
+
+	release(10*time.Millisecond, true, 50)
+	if limit := limiter.Status().Limit; limit != 2 {
+		t.Errorf("Expected failures to lower the limit to the minimum of 2, got %d", limit)
+	}
+
+	// Fast responses raise the limit by about one per limit requests
+	release(10*time.Millisecond, false, 6)
+	if limit := limiter.Status().Limit; limit != 4 {
+		t.Errorf("Expected the limit to recover to 4, got %d", limit)
+	}
+
+	release(10*time.Millisecond, false, 500)
+	if limit := limiter.Status().Limit; limit != 10 {
+		t.Errorf("Expected the limit to recover to its maximum of 10, got %d", limit)
+	}
+
+	for _, cfg := range []ConcurrencyConfig{
+		{Limit: -1},
+		{Limit: 10, Adaptive: true},
+		{Limit: 10, MinLimit: 20},
+	} {
+		if _, err := NewConcurrencyLimiter(cfg); err == nil {
+			t.Errorf("Expected config %+v to be rejected", cfg)
+		}
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer backend.Close()
+
+	pool := newTestPool(t, PoolConfig{
+		Name:        "backend",
+		BackendUrls: []string{backend.URL},
+		Concurrency: ConcurrencyConfig{Limit: 1},
+	})
+
+	done := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		pool.lb.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		done <- rr.Code
+	}()
+	for pool.limiter.Status().InFlight == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rr := httptest.NewRecorder()
+	pool.lb.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the second request to be shed with 503, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+
+	close(unblock)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected the first request to succeed, got %d", code)
+	}
+
+	status := pool.status().Concurrency
+	if status == nil || status.InFlight != 0 || status.Rejected != 1 {
+		t.Errorf("Unexpected pool concurrency status %+v", status)
+	}
+}
+
+func TestAdaptiveConcurrencyOutcomes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/throttled" {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer backend.Close()
+
+	pool := newTestPool(t, PoolConfig{
+		Name:        "backend",
+		BackendUrls: []string{backend.URL},
+		Concurrency: ConcurrencyConfig{Limit: 10, MinLimit: 2, Adaptive: true, LatencyTarget: time.Second},
+	})
+	serve := func(path string) int {
+		rr := httptest.NewRecorder()
+		pool.lb.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr.Code
+	}
+
+	serve("/throttled")
+	if limit := pool.limiter.Status().Limit; limit != 9 {
+		t.Errorf("Expected a throttled response to lower the limit to 9, got %d", limit)
+	}
+
+	// Without a backend the request never reached one, so the limit is left alone
+	pool.lb.mu.Lock()
+	pool.lb.Backends[0].Healthy = false
+	pool.lb.mu.Unlock()
+	for range 5 {
+		if code := serve("/"); code != http.StatusServiceUnavailable {
+			t.Fatalf("Expected 503 without backends, got %d", code)
+		}
+	}
+	if status := pool.limiter.Status(); status.Limit != 9 || status.InFlight != 0 {
+		t.Errorf("Expected the limit to stay at 9 with no request in flight, got %+v", status)
+	}
+}
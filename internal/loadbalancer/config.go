@@ -0,0 +1,72 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// fileConfig is the part of the configuration that is read from the config file
+type fileConfig struct {
+	Pools           []PoolConfig    `json:"pools"`
+	Routes          []RouteConfig   `json:"routes"`
+	PriorityClasses []PriorityClass `json:"priority_classes"`
+	Auth            *AuthConfig     `json:"auth"`
+	IPAccess        *IPAccessConfig `json:"ip_access"`
+}
+
+// LoadConfigFile reads the pools, routes, priority classes, auth settings and IP access lists from a JSON file into config
+func LoadConfigFile(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+
+	var file fileConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	config.Pools = file.Pools
+	config.Routes = file.Routes
+	config.PriorityClasses = file.PriorityClasses
+	if file.Auth != nil {
+		// The JWKS flags apply unless the file configures the keys itself
+		jwt := config.Auth.JWT
+		config.Auth = *file.Auth
+		if !config.Auth.JWT.enabled() {
+			config.Auth.JWT = jwt
+		}
+	}
+	config.flagIPAccess = config.IPAccess
+	if file.IPAccess != nil {
+		config.IPAccess = *file.IPAccess
+	}
+	config.ConfigFile = path
+	return nil
+}
+
+// formatDuration formats durations as strings such as "1.5s" for JSON, zero durations are left out
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// parseDuration parses a duration formatted by formatDuration
+func parseDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,280 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCORSMethods are allowed when a CORS policy does not list any methods
+var DefaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// CORSConfig lets browsers on other origins call a route. Preflight requests are answered by the load balancer, the
+// backends only receive the actual requests.
+type CORSConfig struct {
+	// AllowedOrigins are exact origins such as https://games.example.com, origins with a wildcard subdomain such as
+	// https://*.example.com, or * for any origin
+	AllowedOrigins []string
+	// AllowedMethods defaults to GET, HEAD and POST
+	AllowedMethods []string
+	// AllowedHeaders are the request headers browsers may send, * allows any header
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers scripts may read besides the CORS-safelisted ones
+	ExposedHeaders []string
+	// AllowCredentials lets browsers send cookies and authorization headers, it can not be combined with any origin
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache the result of a preflight, zero leaves it to the browser
+	MaxAge time.Duration
+}
+
+// corsJSON shows the max age as a duration string such as "10m"
+type corsJSON struct {
+	AllowedOrigins   []string `json:"allowed_origins,omitempty"`
+	AllowedMethods   []string `json:"allowed_methods,omitempty"`
+	AllowedHeaders   []string `json:"allowed_headers,omitempty"`
+	ExposedHeaders   []string `json:"exposed_headers,omitempty"`
+	AllowCredentials bool     `json:"allow_credentials,omitempty"`
+	MaxAge           string   `json:"max_age,omitempty"`
+}
+
+func (c CORSConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(corsJSON{
+		AllowedOrigins:   c.AllowedOrigins,
+		AllowedMethods:   c.AllowedMethods,
+		AllowedHeaders:   c.AllowedHeaders,
+		ExposedHeaders:   c.ExposedHeaders,
+		AllowCredentials: c.AllowCredentials,
+		MaxAge:           formatDuration(c.MaxAge),
+	})
+}
+
+func (c *CORSConfig) UnmarshalJSON(data []byte) error {
+	var raw corsJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	maxAge, err := parseDuration("cors max_age", raw.MaxAge)
+	if err != nil {
+		return err
+	}
+
+	*c = CORSConfig{
+		AllowedOrigins:   raw.AllowedOrigins,
+		AllowedMethods:   raw.AllowedMethods,
+		AllowedHeaders:   raw.AllowedHeaders,
+		ExposedHeaders:   raw.ExposedHeaders,
+		AllowCredentials: raw.AllowCredentials,
+		MaxAge:           maxAge,
+	}
+	return nil
+}
+
+// corsPolicy is a compiled CORSConfig
+type corsPolicy struct {
+	config    CORSConfig
+	anyOrigin bool
+	origins   []string
+	wildcards []originWildcard
+	methods   []string
+	anyHeader bool
+	headers   []string
+	// The values of the response headers that do not depend on the request
+	allowHeaders  string
+	exposeHeaders string
+	maxAge        string
+}
+
+// originWildcard matches origins with the scheme whose host ends with the domain, e.g. https:// and .example.com
+type originWildcard struct {
+	scheme string
+	domain string
+}
+
+// newCORSPolicy compiles the config, it returns nil when the route has no CORS policy
+func newCORSPolicy(config *CORSConfig) (*corsPolicy, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if len(config.AllowedOrigins) == 0 {
+		return nil, errors.New("cors policy needs allowed origins")
+	}
+	if config.MaxAge < 0 {
+		return nil, errors.New("cors max_age must not be negative")
+	}
+
+	p := &corsPolicy{config: *config}
+	for _, origin := range config.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+		switch {
+		case origin == "*":
+			p.anyOrigin = true
+		case strings.Count(origin, "*") > 1:
+			return nil, fmt.Errorf("invalid cors origin %q", origin)
+		case strings.Contains(origin, "://*."):
+			// The wildcard matches at least one label, so https://*.example.com does not match https://example.com
+			scheme, domain, _ := strings.Cut(origin, "*")
+			p.wildcards = append(p.wildcards, originWildcard{scheme: scheme, domain: domain})
+		case strings.Contains(origin, "*"):
+			return nil, fmt.Errorf("invalid cors origin %q, wildcards must replace the first label of the host", origin)
+		default:
+			p.origins = append(p.origins, origin)
+		}
+	}
+	if p.anyOrigin && config.AllowCredentials {
+		return nil, errors.New("cors credentials can not be allowed for any origin")
+	}
+
+	methods := config.AllowedMethods
+	if len(methods) == 0 {
+		methods = DefaultCORSMethods
+	}
+	for _, method := range methods {
+		p.methods = append(p.methods, strings.ToUpper(method))
+	}
+
+	for _, header := range config.AllowedHeaders {
+		if header == "*" {
+			p.anyHeader = true
+			continue
+		}
+		p.headers = append(p.headers, http.CanonicalHeaderKey(header))
+	}
+	p.allowHeaders = strings.Join(p.headers, ", ")
+	p.exposeHeaders = strings.Join(config.ExposedHeaders, ", ")
+	if config.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(config.MaxAge.Seconds()))
+	}
+	return p, nil
+}
+
+// isPreflight reports whether the request is a CORS preflight, which asks whether the actual request may be sent
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// allowsOrigin reports whether the origin may call the route
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if slices.Contains(p.origins, origin) {
+		return true
+	}
+	for _, wildcard := range p.wildcards {
+		host, ok := strings.CutPrefix(origin, wildcard.scheme)
+		if ok && len(host) > len(wildcard.domain) && strings.HasSuffix(host, wildcard.domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin sets the allowed origin of the response, a policy with specific origins echoes the origin and makes
+// caches store a response per origin
+func (p *corsPolicy) allowOrigin(h http.Header, origin string) {
+	if p.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if p.config.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// handle applies the policy to the request. Preflights are answered and it returns false, actual requests from an
+// allowed origin get the CORS response headers and proceed.
+func (p *corsPolicy) handle(w http.ResponseWriter, r *http.Request, rt *route) bool {
+	origin := r.Header.Get("Origin")
+	h := w.Header()
+	if !p.anyOrigin {
+		h.Add("Vary", "Origin")
+	}
+
+	if !isPreflight(r) {
+		if origin != "" && p.allowsOrigin(origin) {
+			p.allowOrigin(h, origin)
+			if p.exposeHeaders != "" {
+				h.Set("Access-Control-Expose-Headers", p.exposeHeaders)
+			}
+		}
+		return true
+	}
+
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	headers := requestedHeaders(r)
+	if reason := p.rejectPreflight(origin, method, headers); reason != "" {
+		slog.InfoContext(r.Context(), "cors preflight rejected", "route", rt.config.Name, "origin", origin,
+			"method", method, "reason", reason)
+		http.Error(w, "cors preflight rejected", http.StatusForbidden)
+		return false
+	}
+
+	p.allowOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(p.methods, ", "))
+	switch {
+	case p.anyHeader && len(headers) > 0:
+		// A literal * is not honoured for requests with credentials, so the requested headers are echoed
+		h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	case p.allowHeaders != "":
+		h.Set("Access-Control-Allow-Headers", p.allowHeaders)
+	}
+	if p.maxAge != "" {
+		h.Set("Access-Control-Max-Age", p.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return false
+}
+
+// rejectPreflight returns why the preflight is rejected, or an empty string when the actual request may be sent
+func (p *corsPolicy) rejectPreflight(origin, method string, headers []string) string {
+	if !p.allowsOrigin(origin) {
+		return "origin not allowed"
+	}
+	if !slices.Contains(p.methods, method) {
+		return "method not allowed"
+	}
+	if p.anyHeader {
+		return ""
+	}
+	for _, header := range headers {
+		if !slices.Contains(p.headers, http.CanonicalHeaderKey(header)) {
+			return "header " + header + " not allowed"
+		}
+	}
+	return ""
+}
+
+// requestedHeaders returns the headers a preflight announces
+func requestedHeaders(r *http.Request) []string {
+	var headers []string
+	for _, value := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, header := range strings.Split(value, ",") {
+			if header = strings.TrimSpace(header); header != "" {
+				headers = append(headers, header)
+			}
+		}
+	}
+	return headers
+}
+
+// removeCORSHeaders deletes the CORS headers of a backend response, the policy of the route decides them instead
+func removeCORSHeaders(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(name, "Access-Control-") {
+			h.Del(name)
+		}
+	}
+}
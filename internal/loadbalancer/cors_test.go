@@ -0,0 +1,151 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	var proxied atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("X-Game-Version", "7")
+	}))
+	t.Cleanup(backend.Close)
+
+	pool := newTestPool(t, PoolConfig{Name: "backend", BackendUrls: []string{backend.URL}})
+	router, err := NewRouter([]RouteConfig{
+		{Name: "echo", PathPrefix: "/echo", Methods: []string{http.MethodPost, http.MethodDelete}, Pool: "backend",
+			CORS: &CORSConfig{
+				AllowedOrigins:   []string{"https://dashboard.example.com", "https://*.games.example.com"},
+				AllowedMethods:   []string{"post", "put"},
+				AllowedHeaders:   []string{"content-type", "X-Request-ID"},
+				ExposedHeaders:   []string{"X-Game-Version"},
+				AllowCredentials: true,
+				MaxAge:           10 * time.Minute,
+			}},
+		{Name: "public", PathPrefix: "/public", Pool: "backend", CORS: &CORSConfig{AllowedOrigins: []string{"*"}}},
+		{Name: "default", Pool: "backend"},
+	}, []*Pool{pool})
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	preflight := func(path, origin, method, headers string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, path, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("preflight is answered by the load balancer", func(t *testing.T) {
+		rr := preflight("/echo", "https://dashboard.example.com", http.MethodPost, "Content-Type, x-request-id")
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected status 204, got %d", rr.Code)
+		}
+		expected := map[string]string{
+			"Access-Control-Allow-Origin":      "https://dashboard.example.com",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Allow-Methods":     "POST, PUT",
+			"Access-Control-Allow-Headers":     "Content-Type, X-Request-Id",
+			"Access-Control-Max-Age":           "600",
+		}
+		for name, value := range expected {
+			if got := rr.Header().Get(name); got != value {
+				t.Errorf("Expected %s %q, got %q", name, value, got)
+			}
+		}
+		if proxied.Load() != 0 {
+			t.Error("Expected the preflight not to reach the backend")
+		}
+	})
+
+	rejected := []struct {
+		name, origin, method, headers string
+	}{
+		{"unknown origin", "https://evil.example.com", http.MethodPost, ""},
+		{"wildcard needs a subdomain", "https://games.example.com", http.MethodPost, ""},
+		{"method not allowed", "https://dashboard.example.com", http.MethodDelete, ""},
+		{"header not allowed", "https://dashboard.example.com", http.MethodPost, "Authorization"},
+	}
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := preflight("/echo", tt.origin, tt.method, tt.headers)
+			if rr.Code != http.StatusForbidden || rr.Header().Get("Access-Control-Allow-Origin") != "" {
+				t.Errorf("Expected the preflight to be rejected, got %d with origin %q", rr.Code,
+					rr.Header().Get("Access-Control-Allow-Origin"))
+			}
+		})
+	}
+
+	t.Run("actual request", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/echo", nil)
+		req.Header.Set("Origin", "https://eu.games.example.com")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rr.Code)
+		}
+		if got := rr.Header().Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "https://eu.games.example.com" {
+			t.Errorf("Expected only the origin of the policy to be allowed, got %v", got)
+		}
+		if got := rr.Header().Get("Access-Control-Expose-Headers"); got != "X-Game-Version" {
+			t.Errorf("Expected the exposed headers to be set, got %q", got)
+		}
+		if got := rr.Header().Get("Vary"); got != "Origin" {
+			t.Errorf("Expected responses to vary by origin, got %q", got)
+		}
+	})
+
+	t.Run("any origin", func(t *testing.T) {
+		rr := preflight("/public", "https://anywhere.example.org", http.MethodGet, "")
+		if rr.Code != http.StatusNoContent || rr.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("Expected any origin to be allowed, got %d with origin %q", rr.Code,
+				rr.Header().Get("Access-Control-Allow-Origin"))
+		}
+	})
+
+	t.Run("routes without a policy proxy preflights", func(t *testing.T) {
+		proxied.Store(0)
+		preflight("/other", "https://dashboard.example.com", http.MethodGet, "")
+		if proxied.Load() != 1 {
+			t.Error("Expected the preflight to reach the backend")
+		}
+	})
+
+	invalid := []CORSConfig{
+		{},
+		{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+		{AllowedOrigins: []string{"https://games.*.com"}},
+	}
+	for _, config := range invalid {
+		if _, err := newCORSPolicy(&config); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
+
+func TestCORSConfigJSON(t *testing.T) {
+	var config CORSConfig
+	if err := json.Unmarshal([]byte(`{"allowed_origins": ["*"], "max_age": "1h"}`), &config); err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if config.MaxAge != time.Hour || len(config.AllowedOrigins) != 1 {
+		t.Errorf("Unexpected config %+v", config)
+	}
+
+	if err := json.Unmarshal([]byte(`{"max_age": "soon"}`), &config); err == nil {
+		t.Error("Expected an invalid max age to be rejected")
+	}
+}
@@ -0,0 +1,235 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"strings"
+)
+
+// ForwardingConfig controls which forwarding headers of clients are trusted and which headers never cross the load
+// balancer
+type ForwardingConfig struct {
+	// TrustedProxies are the addresses or CIDR ranges of proxies in front of the load balancer. The X-Forwarded-* and
+	// Forwarded headers of requests from these peers are extended, those of other peers are replaced.
+	TrustedProxies []string
+	// InternalHeaders are removed from client requests and backend responses, a name ending in * matches a prefix
+	InternalHeaders []string
+}
+
+// HeaderRules change the headers of a request or response. Headers are removed first, then set and finally added.
+type HeaderRules struct {
+	Add map[string]string `json:"add,omitempty"`
+	Set map[string]string `json:"set,omitempty"`
+	// Remove deletes headers by name, a name ending in * removes every header with that prefix
+	Remove []string `json:"remove,omitempty"`
+}
+
+// apply changes the header according to the rules
+func (rules HeaderRules) apply(h http.Header) {
+	removeHeaders(h, rules.Remove)
+	for name, value := range rules.Set {
+		h.Set(name, value)
+	}
+	for name, value := range rules.Add {
+		h.Add(name, value)
+	}
+}
+
+// removeHeaders deletes the named headers, names ending in * delete every header with the prefix
+func removeHeaders(h http.Header, names []string) {
+	for _, name := range names {
+		prefix, wildcard := strings.CutSuffix(name, "*")
+		if !wildcard {
+			h.Del(name)
+			continue
+		}
+
+		prefix = http.CanonicalHeaderKey(prefix)
+		for key := range h {
+			if strings.HasPrefix(key, prefix) {
+				delete(h, key)
+			}
+		}
+	}
+}
+
+// Forwarding determines the client of a request and strips internal headers before requests are routed
+type Forwarding struct {
+	trusted  []netip.Prefix
+	internal []string
+}
+
+// NewForwarding parses the trusted proxies of the config
+func NewForwarding(cfg ForwardingConfig) (*Forwarding, error) {
+	f := &Forwarding{internal: cfg.InternalHeaders}
+
+	for _, proxy := range cfg.TrustedProxies {
+		prefix, err := parsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		f.trusted = append(f.trusted, prefix)
+	}
+
+	return f, nil
+}
+
+// parsePrefix parses a CIDR range or a single address
+func parsePrefix(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(s)
+		if addrErr != nil {
+			return netip.Prefix{}, err
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return prefix.Masked(), nil
+}
+
+// isTrusted reports whether the address belongs to a trusted proxy
+func (f *Forwarding) isTrusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range f.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the first address from the right of the X-Forwarded-For chain that is not a trusted proxy. The
+// chain is only consulted when the direct peer is trusted.
+func (f *Forwarding) clientIP(r *http.Request) (ip string, trusted bool) {
+	ip = peerIP(r)
+	if !f.isTrusted(ip) {
+		return ip, false
+	}
+
+	chain := forwardedFor(r.Header)
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip = chain[i]
+		if !f.isTrusted(ip) {
+			break
+		}
+	}
+	return ip, true
+}
+
+// Middleware records the client of the request and removes the internal headers sent by the client
+func (f *Forwarding) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, trusted := f.clientIP(r)
+		info := forwardedInfo{clientIP: ip, trusted: trusted, internal: f.internal}
+		r = r.WithContext(context.WithValue(r.Context(), forwardedKey{}, info))
+
+		if len(f.internal) > 0 {
+			r.Header = r.Header.Clone()
+			removeHeaders(r.Header, f.internal)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type forwardedKey struct{}
+
+// forwardedInfo is the client of a request as determined by the Forwarding middleware
+type forwardedInfo struct {
+	clientIP string
+	// trusted is set when the direct peer is a trusted proxy whose forwarding headers are kept
+	trusted bool
+	// internal are the headers that are removed from backend responses
+	internal []string
+}
+
+// forwardedFrom returns the client of the request, requests that did not pass the middleware are never trusted
+func forwardedFrom(r *http.Request) forwardedInfo {
+	if info, ok := r.Context().Value(forwardedKey{}).(forwardedInfo); ok {
+		return info
+	}
+	return forwardedInfo{clientIP: peerIP(r)}
+}
+
+// setForwardedHeaders sets X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto and Forwarded on the outbound
+// request. The headers of a trusted peer are extended, otherwise they only describe the direct peer.
+func setForwardedHeaders(pr *httputil.ProxyRequest) {
+	in, out := pr.In, pr.Out
+	peer := peerIP(in)
+
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+
+	if forwardedFrom(in).trusted {
+		if prior := in.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			out.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+peer)
+		} else {
+			out.Header.Set("X-Forwarded-For", peer)
+		}
+		out.Header.Set("X-Forwarded-Host", firstNonEmpty(in.Header.Get("X-Forwarded-Host"), in.Host))
+		out.Header.Set("X-Forwarded-Proto", firstNonEmpty(in.Header.Get("X-Forwarded-Proto"), proto))
+
+		element := forwardedElement(peer, in.Host, proto)
+		if prior := in.Header.Values("Forwarded"); len(prior) > 0 {
+			element = strings.Join(prior, ", ") + ", " + element
+		}
+		out.Header.Set("Forwarded", element)
+		return
+	}
+
+	out.Header.Set("X-Forwarded-For", peer)
+	out.Header.Set("X-Forwarded-Host", in.Host)
+	out.Header.Set("X-Forwarded-Proto", proto)
+	out.Header.Set("Forwarded", forwardedElement(peer, in.Host, proto))
+}
+
+// forwardedElement formats a single element of the Forwarded header as described in RFC 7239
+func forwardedElement(peer, host, proto string) string {
+	node := peer
+	if addr, err := netip.ParseAddr(peer); err == nil && addr.Is6() && !addr.Is4In6() {
+		node = `"[` + peer + `]"`
+	}
+	return fmt.Sprintf("for=%s;host=%q;proto=%s", node, host, proto)
+}
+
+// forwardedFor returns the addresses in the X-Forwarded-For headers of the request
+func forwardedFor(h http.Header) []string {
+	var chain []string
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(value, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				chain = append(chain, ip)
+			}
+		}
+	}
+	return chain
+}
+
+// peerIP returns the IP address of the direct peer of the request
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,260 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// headerEchoBackend responds with the request headers it received as JSON
+func headerEchoBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := r.Header.Clone()
+		headers.Set("Host", r.Host)
+
+		w.Header().Set("X-Internal-Debug", "backend-1")
+		w.Header().Set("X-Powered-By", "go")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(headers)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// serveHeaders sends the request through the handler and returns the response and the headers the backend received
+func serveHeaders(t *testing.T, handler http.Handler, req *http.Request) (*httptest.ResponseRecorder, http.Header) {
+	t.Helper()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var received http.Header
+	if err := json.Unmarshal(rr.Body.Bytes(), &received); err != nil {
+		t.Fatalf("Failed to decode backend headers: %v", err)
+	}
+	return rr, received
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	backend := headerEchoBackend(t)
+	pool := newTestPool(t, PoolConfig{Name: "backend", BackendUrls: []string{backend.URL}})
+	router, err := NewRouter([]RouteConfig{{Name: "default", Pool: "backend"}}, []*Pool{pool})
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	forwarding, err := NewForwarding(ForwardingConfig{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.10"}})
+	if err != nil {
+		t.Fatalf("Failed to create forwarding: %v", err)
+	}
+	handler := forwarding.Middleware(router)
+
+	tests := []struct {
+		name              string
+		remoteAddr        string
+		headers           map[string]string
+		expectedFor       string
+		expectedProto     string
+		expectedForwarded string
+	}{
+		{
+			name:              "Direct client",
+			remoteAddr:        "203.0.113.7:4000",
+			expectedFor:       "203.0.113.7",
+			expectedProto:     "http",
+			expectedForwarded: `for=203.0.113.7;host="lb.example.com";proto=http`,
+		},
+		{
+			name:       "Spoofed headers of an untrusted client are replaced",
+			remoteAddr: "203.0.113.7:4000",
+			headers: map[string]string{
+				"X-Forwarded-For":   "1.2.3.4",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=1.2.3.4",
+			},
+			expectedFor:       "203.0.113.7",
+			expectedProto:     "http",
+			expectedForwarded: `for=203.0.113.7;host="lb.example.com";proto=http`,
+		},
+		{
+			name:       "Headers of a trusted proxy are extended",
+			remoteAddr: "10.1.2.3:4000",
+			headers: map[string]string{
+				"X-Forwarded-For":   "198.51.100.1",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=198.51.100.1;proto=https",
+			},
+			expectedFor:       "198.51.100.1, 10.1.2.3",
+			expectedProto:     "https",
+			expectedForwarded: `for=198.51.100.1;proto=https, for=10.1.2.3;host="lb.example.com";proto=http`,
+		},
+		{
+			name:              "IPv6 peers are quoted in Forwarded",
+			remoteAddr:        "[2001:db8::1]:4000",
+			expectedFor:       "2001:db8::1",
+			expectedProto:     "http",
+			expectedForwarded: `for="[2001:db8::1]";host="lb.example.com";proto=http`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://lb.example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			_, received := serveHeaders(t, handler, req)
+
+			if got := received.Get("X-Forwarded-For"); got != tt.expectedFor {
+				t.Errorf("Expected X-Forwarded-For %q, got %q", tt.expectedFor, got)
+			}
+			if got := received.Get("X-Forwarded-Proto"); got != tt.expectedProto {
+				t.Errorf("Expected X-Forwarded-Proto %q, got %q", tt.expectedProto, got)
+			}
+			if got := received.Get("X-Forwarded-Host"); got != "lb.example.com" {
+				t.Errorf("Expected X-Forwarded-Host lb.example.com, got %q", got)
+			}
+			if got := received.Get("Forwarded"); got != tt.expectedForwarded {
+				t.Errorf("Expected Forwarded %q, got %q", tt.expectedForwarded, got)
+			}
+			if got := received.Get("Host"); got != "lb.example.com" {
+				t.Errorf("Expected the Host of the client to be kept, got %q", got)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	forwarding, err := NewForwarding(ForwardingConfig{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.10"}})
+	if err != nil {
+		t.Fatalf("Failed to create forwarding: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		forwardedFor  string
+		expectedIP    string
+		expectTrusted bool
+	}{
+		{"Untrusted peer", "203.0.113.7:4000", "1.2.3.4", "203.0.113.7", false},
+		{"Trusted peer", "192.0.2.10:4000", "198.51.100.1", "198.51.100.1", true},
+		{"Chain of trusted proxies", "10.0.0.1:4000", "198.51.100.1, 203.0.113.9, 10.0.0.2", "203.0.113.9", true},
+		{"Only trusted proxies", "10.0.0.1:4000", "10.0.0.2", "10.0.0.2", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+
+			ip, trusted := forwarding.clientIP(req)
+			if ip != tt.expectedIP || trusted != tt.expectTrusted {
+				t.Errorf("Expected %s (trusted %v), got %s (trusted %v)", tt.expectedIP, tt.expectTrusted, ip, trusted)
+			}
+		})
+	}
+
+	if _, err := NewForwarding(ForwardingConfig{TrustedProxies: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("Expected an invalid trusted proxy to be rejected")
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	backend := headerEchoBackend(t)
+	pool := newTestPool(t, PoolConfig{Name: "backend", BackendUrls: []string{backend.URL}})
+	router, err := NewRouter([]RouteConfig{
+		{
+			Name:       "api",
+			PathPrefix: "/api/",
+			Pool:       "backend",
+			RequestHeaders: HeaderRules{
+				Add:    map[string]string{"X-Tenant": "acme"},
+				Set:    map[string]string{"X-Api-Version": "2"},
+				Remove: []string{"Cookie", "X-Debug-*"},
+			},
+			ResponseHeaders: HeaderRules{
+				Set:    map[string]string{"Cache-Control": "public, max-age=60"},
+				Add:    map[string]string{"X-Route": "api"},
+				Remove: []string{"X-Powered-By"},
+			},
+		},
+		{Name: "default", Pool: "backend"},
+	}, []*Pool{pool})
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	forwarding, err := NewForwarding(ForwardingConfig{InternalHeaders: []string{"X-Internal-*"}})
+	if err != nil {
+		t.Fatalf("Failed to create forwarding: %v", err)
+	}
+	handler := forwarding.Middleware(router)
+
+	newRequest := func(path string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Cookie", "session=1")
+		req.Header.Set("X-Tenant", "client")
+		req.Header.Set("X-Api-Version", "1")
+		req.Header.Set("X-Debug-Level", "trace")
+		req.Header.Set("X-Internal-User", "admin")
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "1")
+		return req
+	}
+
+	t.Run("Route rules", func(t *testing.T) {
+		rr, received := serveHeaders(t, handler, newRequest("/api/users"))
+
+		if got := received.Values("X-Tenant"); len(got) != 2 || got[0] != "client" || got[1] != "acme" {
+			t.Errorf("Expected X-Tenant to be added, got %v", got)
+		}
+		if got := received.Get("X-Api-Version"); got != "2" {
+			t.Errorf("Expected X-Api-Version to be set to 2, got %q", got)
+		}
+		for _, name := range []string{"Cookie", "X-Debug-Level", "X-Internal-User", "X-Hop"} {
+			if got := received.Get(name); got != "" {
+				t.Errorf("Expected %s to be removed, got %q", name, got)
+			}
+		}
+
+		if got := rr.Header().Get("Cache-Control"); got != "public, max-age=60" {
+			t.Errorf("Expected Cache-Control to be replaced, got %q", got)
+		}
+		if got := rr.Header().Get("X-Route"); got != "api" {
+			t.Errorf("Expected X-Route to be added, got %q", got)
+		}
+		for _, name := range []string{"X-Powered-By", "X-Internal-Debug"} {
+			if got := rr.Header().Get(name); got != "" {
+				t.Errorf("Expected response header %s to be removed, got %q", name, got)
+			}
+		}
+	})
+
+	t.Run("Other routes are unchanged", func(t *testing.T) {
+		rr, received := serveHeaders(t, handler, newRequest("/other"))
+
+		if got := received.Get("Cookie"); got != "session=1" {
+			t.Errorf("Expected Cookie to be forwarded, got %q", got)
+		}
+		if got := received.Get("X-Internal-User"); got != "" {
+			t.Errorf("Expected internal headers to be removed on every route, got %q", got)
+		}
+		if got := rr.Header().Get("X-Powered-By"); got != "go" {
+			t.Errorf("Expected X-Powered-By to be kept, got %q", got)
+		}
+		if got := rr.Header().Get("X-Internal-Debug"); got != "" {
+			t.Errorf("Expected internal response headers to be removed on every route, got %q", got)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package loadbalancer
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthChecker periodically checks the backends of a load balancer and marks them healthy or unhealthy
+type HealthChecker struct {
+	lb       *LoadBalancer
+	interval time.Duration
+	path     string
+	client   *http.Client
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewHealthChecker creates a health checker for the backends of the given load balancer
+func NewHealthChecker(lb *LoadBalancer, interval time.Duration) *HealthChecker {
+	return newHealthChecker(lb, HealthCheckConfig{Path: DefaultHealthCheckPath, Interval: interval, Timeout: interval})
+}
+
+func newHealthChecker(lb *LoadBalancer, cfg HealthCheckConfig) *HealthChecker {
+	return &HealthChecker{
+		lb:       lb,
+		interval: cfg.Interval,
+		path:     cfg.Path,
+		client:   &http.Client{Timeout: cfg.Timeout, Transport: lb.transport},
+	}
+}
+
+// Start runs the health checks in the background until Stop is called
+func (hc *HealthChecker) Start() {
+	hc.done = make(chan struct{})
+	hc.wg.Add(1)
+
+	go func() {
+		defer hc.wg.Done()
+		ticker := time.NewTicker(hc.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-hc.done:
+				return
+			case <-ticker.C:
+				hc.Check()
+			}
+		}
+	}()
+}
+
+// Stop stops the health checks and waits for a running check to complete
+func (hc *HealthChecker) Stop() {
+	close(hc.done)
+	hc.wg.Wait()
+}
+
+// Check checks all current backends once
+func (hc *HealthChecker) Check() {
+	hc.lb.mu.RLock()
+	backends := hc.lb.Backends
+	hc.lb.mu.RUnlock()
+
+	results := make([]bool, len(backends))
+	for i, backend := range backends {
+		results[i] = backend.checkHealth(hc.client, hc.path)
+	}
+
+	hc.lb.mu.Lock()
+	defer hc.lb.mu.Unlock()
+	for i, backend := range backends {
+		if backend.Healthy != results[i] {
+			slog.Info("backend health changed", "backend", backend.Addr, "healthy", results[i])
+		}
+		backend.Healthy = results[i]
+		backend.LastCheck = time.Now()
+	}
+}
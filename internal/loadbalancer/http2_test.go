@@ -0,0 +1,187 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/servicediscovery"
+	"github.com/jeroenpf/coda-homework-assignment/internal/testca"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// protoHandler reports the protocol the request was received with
+var protoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Backend-Proto", r.Proto)
+	w.WriteHeader(http.StatusOK)
+})
+
+// h2cClient speaks cleartext HTTP/2 with prior knowledge
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func TestUpstreamProtocols(t *testing.T) {
+	ca := testca.New(t)
+	dir := t.TempDir()
+
+	h2cBackend := httptest.NewServer(h2c.NewHandler(protoHandler, &http2.Server{}))
+	defer h2cBackend.Close()
+
+	certPEM, keyPEM := ca.Issue(t, "backend.internal")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+
+	tlsBackend := httptest.NewUnstartedServer(protoHandler)
+	tlsBackend.EnableHTTP2 = true
+	tlsBackend.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	tlsBackend.StartTLS()
+	defer tlsBackend.Close()
+
+	upstreamTLS := UpstreamTLSConfig{CAFile: ca.WriteFile(t, dir), ServerName: "backend.internal"}
+
+	tests := []struct {
+		name          string
+		backend       string
+		protocol      string
+		tls           UpstreamTLSConfig
+		expectedProto string
+	}{
+		{name: "HTTP/1.1 to a cleartext backend", backend: h2cBackend.URL, protocol: UpstreamAuto, expectedProto: "HTTP/1.1"},
+		{name: "h2c to a cleartext backend", backend: h2cBackend.URL, protocol: UpstreamH2C, expectedProto: "HTTP/2.0"},
+		{name: "HTTP/2 negotiated over TLS", backend: tlsBackend.URL, protocol: UpstreamAuto, tls: upstreamTLS, expectedProto: "HTTP/2.0"},
+		{name: "HTTP/1.1 forced over TLS", backend: tlsBackend.URL, protocol: UpstreamHTTP1, tls: upstreamTLS, expectedProto: "HTTP/1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultTransportConfig()
+			cfg.Protocol = tt.protocol
+			transport, err := newUpstreamTransport(cfg, tt.tls)
+			if err != nil {
+				t.Fatalf("Failed to create transport: %v", err)
+			}
+
+			lb := NewLoadBalancer(servicediscovery.NewStaticServiceWatcher([]string{tt.backend}), "backend", transport)
+			if err := lb.StartServiceWatcher(); err != nil {
+				t.Fatalf("Failed to start service watcher: %v", err)
+			}
+
+			// The health checker uses the same transport as the proxy
+			if !lb.Backends[0].IsHealthy(&http.Client{Transport: transport, Timeout: time.Second}) {
+				t.Errorf("Backend is not healthy over %s", tt.protocol)
+			}
+
+			rec := httptest.NewRecorder()
+			lb.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rec.Code != http.StatusOK || rec.Header().Get("X-Backend-Proto") != tt.expectedProto {
+				t.Errorf("Unexpected response: %d over %q, expected %s", rec.Code, rec.Header().Get("X-Backend-Proto"), tt.expectedProto)
+			}
+		})
+	}
+
+	t.Run("h2c can not be combined with TLS", func(t *testing.T) {
+		cfg := DefaultTransportConfig()
+		cfg.Protocol = UpstreamH2C
+		if _, err := newUpstreamTransport(cfg, upstreamTLS); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+
+	t.Run("Unknown protocol", func(t *testing.T) {
+		cfg := DefaultTransportConfig()
+		cfg.Protocol = "spdy"
+		if _, err := newUpstreamTransport(cfg, UpstreamTLSConfig{}); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
+
+func TestHTTP2Listeners(t *testing.T) {
+	ca := testca.New(t)
+	dir := t.TempDir()
+
+	backend := httptest.NewServer(h2c.NewHandler(protoHandler, &http2.Server{}))
+	defer backend.Close()
+
+	config := DefaultConfig()
+	config.Port = "8097"
+	config.ShutdownDelay = 0
+	config.AdminAddr = ""
+	config.AccessLog.Enabled = false
+	config.BackendUrls = []string{backend.URL}
+	config.H2C = true
+	config.Transport.Protocol = UpstreamH2C
+	config.TLS.Port = "8098"
+	config.TLS.Certificates = []CertificateConfig{issueCertificate(t, ca, dir, "lb", "lb.example.com")}
+
+	srv, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Start(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	tlsClient := &http.Client{Transport: &http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{RootCAs: ca.Pool, ServerName: "lb.example.com"},
+	}}
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		url    string
+	}{
+		{name: "h2c on the plain listener", client: h2cClient(), url: "http://localhost:8097/"},
+		{name: "HTTP/2 on the TLS listener", client: tlsClient, url: "https://localhost:8098/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Several requests are multiplexed over a single connection
+			for range 3 {
+				resp, err := tt.client.Get(tt.url)
+				if err != nil {
+					t.Fatalf("Request failed: %v", err)
+				}
+				resp.Body.Close()
+
+				if resp.ProtoMajor != 2 || resp.Header.Get("X-Backend-Proto") != "HTTP/2.0" {
+					t.Errorf("Expected HTTP/2 end to end, got %s to the load balancer and %q to the backend",
+						resp.Proto, resp.Header.Get("X-Backend-Proto"))
+				}
+			}
+		})
+	}
+
+	tlsClient.CloseIdleConnections()
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Failed to stop server: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Failed to stop server within timeout")
+	}
+}
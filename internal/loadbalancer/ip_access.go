@@ -0,0 +1,188 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// IPAccessConfig restricts which clients may use the load balancer or a route. Entries are CIDR ranges or single
+// addresses. Denied clients are always rejected, when Allow is set only the clients it lists are accepted.
+type IPAccessConfig struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// ipRule is a parsed entry of an access list, rule is how it is reported in logs
+type ipRule struct {
+	prefix netip.Prefix
+	rule   string
+}
+
+type ipAccessList struct {
+	allow []ipRule
+	deny  []ipRule
+}
+
+// newIPAccessList parses the config, it returns nil when the config does not restrict anything
+func newIPAccessList(cfg IPAccessConfig) (*ipAccessList, error) {
+	if len(cfg.Allow) == 0 && len(cfg.Deny) == 0 {
+		return nil, nil
+	}
+
+	parse := func(action string, entries []string) ([]ipRule, error) {
+		rules := make([]ipRule, 0, len(entries))
+		for _, entry := range entries {
+			prefix, err := parsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s entry: %w", action, err)
+			}
+			rules = append(rules, ipRule{prefix: prefix, rule: action + " " + prefix.String()})
+		}
+		return rules, nil
+	}
+
+	var l ipAccessList
+	var err error
+	if l.allow, err = parse("allow", cfg.Allow); err != nil {
+		return nil, err
+	}
+	if l.deny, err = parse("deny", cfg.Deny); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// check reports whether the address is allowed and the rule that decided it
+func (l *ipAccessList) check(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	for _, rule := range l.deny {
+		if rule.prefix.Contains(addr) {
+			return rule.rule, false
+		}
+	}
+
+	if len(l.allow) == 0 {
+		return "", true
+	}
+	for _, rule := range l.allow {
+		if rule.prefix.Contains(addr) {
+			return rule.rule, true
+		}
+	}
+	return "not in allow list", false
+}
+
+// ipAccessRules are the global access list and the access lists of the routes by name
+type ipAccessRules struct {
+	global *ipAccessList
+	routes map[string]*ipAccessList
+}
+
+// IPAccessControl checks the client IP of requests against the access lists, which can be replaced while requests
+// are being served
+type IPAccessControl struct {
+	rules atomic.Pointer[ipAccessRules]
+}
+
+// NewIPAccessControl parses the global access list and those of the routes
+func NewIPAccessControl(global IPAccessConfig, routes []RouteConfig) (*IPAccessControl, error) {
+	c := &IPAccessControl{}
+	if err := c.update(global, routes); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// update replaces all access lists, the current lists stay in place when any of the new ones is invalid
+func (c *IPAccessControl) update(global IPAccessConfig, routes []RouteConfig) error {
+	rules := &ipAccessRules{routes: make(map[string]*ipAccessList)}
+
+	var err error
+	if rules.global, err = newIPAccessList(global); err != nil {
+		return fmt.Errorf("ip access: %w", err)
+	}
+	for _, route := range routes {
+		list, err := newIPAccessList(route.IPAccess)
+		if err != nil {
+			return fmt.Errorf("route %s: ip access: %w", route.Name, err)
+		}
+		if list != nil {
+			rules.routes[route.Name] = list
+		}
+	}
+
+	c.rules.Store(rules)
+	return nil
+}
+
+// allow checks the client of the request against the global access list, or the list of the route when one is
+// given. Denied requests are answered with 403 and logged with the rule that matched.
+func (c *IPAccessControl) allow(w http.ResponseWriter, r *http.Request, rt *route) bool {
+	rules := c.rules.Load()
+	list, scope := rules.global, "global"
+	if rt != nil {
+		list, scope = rules.routes[rt.config.Name], "route "+rt.config.Name
+	}
+	if list == nil {
+		return true
+	}
+
+	// The client IP takes trusted proxies into account, an address that can not be parsed matches no rule
+	ip := forwardedFrom(r).clientIP
+	addr, _ := netip.ParseAddr(ip)
+	rule, ok := list.check(addr)
+	if ok {
+		return true
+	}
+
+	slog.WarnContext(r.Context(), "client ip denied", "client_ip", ip, "scope", scope, "rule", rule)
+	http.Error(w, "forbidden", http.StatusForbidden)
+	return false
+}
+
+// Watch reloads the access lists from the config file whenever it changes, until the context is cancelled. Other
+// settings in the file only take effect after a restart.
+func (c *IPAccessControl) Watch(ctx context.Context, config Config, interval time.Duration) {
+	path := config.ConfigFile
+	var loaded time.Time
+	if info, err := os.Stat(path); err == nil {
+		loaded = info.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil || info.ModTime().Equal(loaded) {
+				continue
+			}
+			loaded = info.ModTime()
+
+			// Keep the current lists when the file is invalid, e.g. while it is being edited. Lists removed from the
+			// file fall back to the flags rather than to what the file set before.
+			reloaded := config
+			reloaded.IPAccess = config.flagIPAccess
+			if err := LoadConfigFile(path, &reloaded); err != nil {
+				slog.Error("failed to reload ip access lists", "error", err)
+				continue
+			}
+			_, routes := reloaded.routing()
+			if err := c.update(reloaded.IPAccess, routes); err != nil {
+				slog.Error("failed to reload ip access lists", "error", err)
+				continue
+			}
+			slog.Info("reloaded ip access lists", "path", path)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIPAccess(t *testing.T) {
+	backend := headerEchoBackend(t)
+	pool := newTestPool(t, PoolConfig{Name: "backend", BackendUrls: []string{backend.URL}})
+	routes := []RouteConfig{
+		{Name: "admin", PathPrefix: "/admin", Pool: "backend", IPAccess: IPAccessConfig{Allow: []string{"10.1.0.0/16"}}},
+		{Name: "default", Pool: "backend"},
+	}
+	router, err := NewRouter(routes, []*Pool{pool})
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	if router.access, err = NewIPAccessControl(IPAccessConfig{Deny: []string{"198.51.100.0/24", "203.0.113.7"}}, routes); err != nil {
+		t.Fatalf("Failed to create ip access control: %v", err)
+	}
+
+	forwarding, err := NewForwarding(ForwardingConfig{TrustedProxies: []string{"192.0.2.10"}})
+	if err != nil {
+		t.Fatalf("Failed to create forwarding: %v", err)
+	}
+	handler := forwarding.Middleware(router)
+
+	tests := []struct {
+		name         string
+		path         string
+		remoteAddr   string
+		forwardedFor string
+		status       int
+	}{
+		{"Allowed client", "/", "192.0.2.1:4000", "", http.StatusOK},
+		{"Denied range", "/", "198.51.100.20:4000", "", http.StatusForbidden},
+		{"Denied address", "/", "203.0.113.7:4000", "", http.StatusForbidden},
+		{"Denied client behind a trusted proxy", "/", "192.0.2.10:4000", "198.51.100.20", http.StatusForbidden},
+		{"Forwarded address of an untrusted peer", "/", "192.0.2.1:4000", "198.51.100.20", http.StatusOK},
+		{"Route allow list", "/admin", "192.0.2.10:4000", "10.1.2.3", http.StatusOK},
+		{"Not in route allow list", "/admin", "192.0.2.1:4000", "", http.StatusForbidden},
+		{"Global deny list applies to the route", "/admin", "198.51.100.20:4000", "", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, rr.Code)
+			}
+		})
+	}
+
+	if _, err := NewIPAccessControl(IPAccessConfig{Allow: []string{"10.0.0.0/33"}}, nil); err == nil {
+		t.Error("Expected an invalid allow entry to be rejected")
+	}
+}
+
+func TestIPAccessReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(content string, modified time.Time) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatalf("Failed to set modification time: %v", err)
+		}
+	}
+
+	write(`{"pools": [{"name": "backend", "backend_urls": ["http://127.0.0.1:1"]}], "routes": [{"name": "default", "pool": "backend"}],
+		"ip_access": {"deny": ["192.0.2.0/24"]}}`, time.Now().Add(-time.Minute))
+
+	config := DefaultConfig()
+	config.IPAccess.Deny = []string{"198.51.100.0/24"}
+	if err := LoadConfigFile(path, &config); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	access, err := NewIPAccessControl(config.IPAccess, config.Routes)
+	if err != nil {
+		t.Fatalf("Failed to create ip access control: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go access.Watch(ctx, config, 10*time.Millisecond)
+
+	deniedIP := func(addr string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = addr
+		return !access.allow(httptest.NewRecorder(), req, nil)
+	}
+	denied := func() bool { return deniedIP("203.0.113.7:4000") }
+	if denied() {
+		t.Fatal("Expected the client to be allowed before the reload")
+	}
+
+	// An invalid file keeps the current lists
+	write(`{"ip_access": {"deny": ["not an address"]}}`, time.Now().Add(-30*time.Second))
+	time.Sleep(50 * time.Millisecond)
+	if denied() {
+		t.Fatal("Expected an invalid config to be ignored")
+	}
+
+	write(`{"pools": [{"name": "backend", "backend_urls": ["http://127.0.0.1:1"]}], "routes": [{"name": "default", "pool": "backend"}],
+		"ip_access": {"deny": ["203.0.113.0/24"]}}`, time.Now())
+	deadline := time.Now().Add(2 * time.Second)
+	for !denied() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the client to be denied after the reload")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if deniedIP("198.51.100.7:4000") {
+		t.Error("Expected the lists of the file to replace the flags")
+	}
+
+	// Removing the lists from the file brings back the lists of the flags
+	write(`{"pools": [{"name": "backend", "backend_urls": ["http://127.0.0.1:1"]}], "routes": [{"name": "default", "pool": "backend"}]}`,
+		time.Now().Add(time.Minute))
+	deadline = time.Now().Add(2 * time.Second)
+	for denied() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the client to be allowed once the lists are removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !deniedIP("198.51.100.7:4000") || deniedIP("192.0.2.7:4000") {
+		t.Error("Expected the lists of the flags to apply again, not the lists the file started with")
+	}
+}
@@ -0,0 +1,458 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultJWKSRefreshInterval is how often the signing keys are reloaded
+	DefaultJWKSRefreshInterval = 5 * time.Minute
+	// jwksMinRefresh limits the reloads triggered by tokens signed with an unknown key
+	jwksMinRefresh   = 30 * time.Second
+	jwksFetchTimeout = 5 * time.Second
+)
+
+// JWTConfig verifies bearer tokens against the keys of a JWKS, read from a local file or fetched from a URL
+type JWTConfig struct {
+	JWKSFile string
+	JWKSURL  string
+	// Issuer and Audience are checked against the iss and aud claims when set
+	Issuer   string
+	Audience string
+	// RefreshInterval is how often the keys are reloaded, tokens signed with an unknown key trigger a reload as well
+	RefreshInterval time.Duration
+	// Leeway allows for clock skew when checking exp and nbf
+	Leeway time.Duration
+}
+
+func (c JWTConfig) enabled() bool {
+	return c.JWKSFile != "" || c.JWKSURL != ""
+}
+
+func (c JWTConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jwtJSON{
+		JWKSFile:        c.JWKSFile,
+		JWKSURL:         c.JWKSURL,
+		Issuer:          c.Issuer,
+		Audience:        c.Audience,
+		RefreshInterval: formatDuration(c.RefreshInterval),
+		Leeway:          formatDuration(c.Leeway),
+	})
+}
+
+func (c *JWTConfig) UnmarshalJSON(data []byte) error {
+	var raw jwtJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	var err error
+	c.JWKSFile, c.JWKSURL, c.Issuer, c.Audience = raw.JWKSFile, raw.JWKSURL, raw.Issuer, raw.Audience
+	if c.RefreshInterval, err = parseDuration("refresh_interval", raw.RefreshInterval); err != nil {
+		return err
+	}
+	if c.Leeway, err = parseDuration("leeway", raw.Leeway); err != nil {
+		return err
+	}
+	return nil
+}
+
+type jwtJSON struct {
+	JWKSFile        string `json:"jwks_file,omitempty"`
+	JWKSURL         string `json:"jwks_url,omitempty"`
+	Issuer          string `json:"issuer,omitempty"`
+	Audience        string `json:"audience,omitempty"`
+	RefreshInterval string `json:"refresh_interval,omitempty"`
+	Leeway          string `json:"leeway,omitempty"`
+}
+
+// jwtVerifier validates the signature and the registered claims of tokens
+type jwtVerifier struct {
+	config JWTConfig
+	keys   *keySet
+	now    func() time.Time
+}
+
+func newJWTVerifier(cfg JWTConfig) (*jwtVerifier, error) {
+	if cfg.JWKSFile != "" && cfg.JWKSURL != "" {
+		return nil, errors.New("configure either a JWKS file or a JWKS URL")
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = DefaultJWKSRefreshInterval
+	}
+
+	keys := &keySet{refresh: cfg.RefreshInterval, now: time.Now}
+	if cfg.JWKSFile != "" {
+		keys.source = cfg.JWKSFile
+		keys.load = func(context.Context) ([]byte, error) { return os.ReadFile(cfg.JWKSFile) }
+
+		// A broken key file is a configuration error, a key server may just be unavailable for now
+		data, err := keys.load(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("read jwks: %w", err)
+		}
+		if keys.keys, err = parseJWKS(data); err != nil {
+			return nil, fmt.Errorf("parse jwks %s: %w", cfg.JWKSFile, err)
+		}
+		keys.loaded = time.Now()
+	} else {
+		keys.source = cfg.JWKSURL
+		keys.load = fetchJWKS(cfg.JWKSURL)
+	}
+
+	return &jwtVerifier{config: cfg, keys: keys, now: time.Now}, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify returns the claims of a valid token
+func (v *jwtVerifier) verify(ctx context.Context, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid signature encoding")
+	}
+
+	key, err := v.keys.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// validate checks the expiry, issuer and audience of the token
+func (v *jwtVerifier) validate(claims map[string]any) error {
+	now := v.now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.config.Leeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.config.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not valid yet")
+	}
+
+	if v.config.Issuer != "" && claims["iss"] != v.config.Issuer {
+		return fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if v.config.Audience != "" && !slices.Contains(claimValues(claims["aud"]), v.config.Audience) {
+		return fmt.Errorf("token is not meant for audience %s", v.config.Audience)
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature checks the signature with the key, which must be of the type the algorithm calls for
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch {
+	case strings.HasSuffix(alg, "256"):
+		hash = crypto.SHA256
+	case strings.HasSuffix(alg, "384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(alg, "512"):
+		hash = crypto.SHA512
+	}
+
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest = h.Sum(nil)
+	}
+
+	invalid := errors.New("invalid signature")
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case "RS256", "RS384", "RS512":
+			if rsa.VerifyPKCS1v15(pub, hash, digest, signature) != nil {
+				return invalid
+			}
+			return nil
+		case "PS256", "PS384", "PS512":
+			if rsa.VerifyPSS(pub, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) != nil {
+				return invalid
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		// The curve is part of the algorithm, ES512 uses P-521
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if alg == fmt.Sprintf("ES%d", min(pub.Curve.Params().BitSize, 512)) {
+			if len(signature) != 2*size {
+				return invalid
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(pub, digest, r, s) {
+				return invalid
+			}
+			return nil
+		}
+	case ed25519.PublicKey:
+		if alg == "EdDSA" {
+			if !ed25519.Verify(pub, []byte(signed), signature) {
+				return invalid
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("algorithm %q does not match the signing key", alg)
+}
+
+// keySet holds the keys of a JWKS by key ID and reloads them when they are stale. Keys are loaded outside the lock,
+// so a slow key server never holds up requests signed with a known key.
+type keySet struct {
+	// source is the file or URL of the keys, for logging
+	source  string
+	load    func(ctx context.Context) ([]byte, error)
+	refresh time.Duration
+	now     func() time.Time
+
+	mu     sync.Mutex
+	keys   map[string]crypto.PublicKey
+	loaded time.Time
+	// reloading is closed when the reload in flight completes, it is nil when no reload is in flight
+	reloading chan struct{}
+}
+
+// key returns the key with the ID. Tokens without a key ID can be verified when the set holds a single key.
+func (s *keySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	key, ok := s.lookup(kid)
+	age := s.now().Sub(s.loaded)
+	// An unknown key may have been added by the issuer when it rotated its keys
+	if age > s.refresh || (!ok && age > jwksMinRefresh) {
+		s.startReload(ctx)
+	}
+	reloading := s.reloading
+	s.mu.Unlock()
+
+	// Known keys are used right away, only a request with an unknown key waits for the reload in flight
+	if !ok && reloading != nil {
+		select {
+		case <-reloading:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		s.mu.Lock()
+		key, ok = s.lookup(kid)
+		s.mu.Unlock()
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (s *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// startReload reloads the keys in the background unless a reload is already in flight, s.mu must be held. On failure
+// the previous keys stay in use until the next attempt.
+func (s *keySet) startReload(ctx context.Context) {
+	if s.reloading != nil {
+		return
+	}
+	s.loaded = s.now()
+	s.reloading = make(chan struct{})
+
+	// The request that triggered the reload should not cut it short
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		data, err := s.load(ctx)
+		var keys map[string]crypto.PublicKey
+		if err == nil {
+			keys, err = parseJWKS(data)
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "failed to reload jwks", "source", s.source, "error", err)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err == nil {
+			s.keys = keys
+		}
+		close(s.reloading)
+		s.reloading = nil
+	}()
+}
+
+func fetchJWKS(url string) func(ctx context.Context) ([]byte, error) {
+	client := &http.Client{Timeout: jwksFetchTimeout}
+
+	return func(ctx context.Context) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	}
+}
+
+// jwk is a public key of a JSON Web Key Set (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the signing keys of the set by key ID, keys of unsupported types are skipped
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.New("invalid modulus")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		return k.ecdsaKey()
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func (k jwk) ecdsaKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	var check ecdh.Curve
+	switch k.Crv {
+	case "P-256":
+		curve, check = elliptic.P256(), ecdh.P256()
+	case "P-384":
+		curve, check = elliptic.P384(), ecdh.P384()
+	case "P-521":
+		curve, check = elliptic.P521(), ecdh.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+
+	x, errX := base64.RawURLEncoding.DecodeString(k.X)
+	y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+	size := (curve.Params().BitSize + 7) / 8
+	if errX != nil || errY != nil || len(x) != size || len(y) != size {
+		return nil, errors.New("invalid coordinates")
+	}
+
+	// Parsing the uncompressed point makes sure it is on the curve
+	if _, err := check.NewPublicKey(slices.Concat([]byte{4}, x, y)); err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
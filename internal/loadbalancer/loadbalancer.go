@@ -1,44 +1,91 @@
 package loadbalancer
 
 import (
+	"context"
 	"errors"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
+	"net/http/httptrace"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/jeroenpf/coda-homework-assignment/internal/servicediscovery"
+	"github.com/jeroenpf/coda-homework-assignment/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// LoadBalancer implements a weighted round robin load balancer
+const tracerName = "github.com/jeroenpf/coda-homework-assignment/internal/loadbalancer"
+
+// tracer returns the tracer of the package
+func tracer() trace.Tracer {
+	return tracing.Tracer(tracerName)
+}
+
+// LoadBalancer balances requests over the backends of a single pool, by default with weighted round robin
 type LoadBalancer struct {
 	Backends       []*Backend
 	RRCounter      atomic.Uint32
+	name           string
+	strategy       string
 	serviceName    string
 	serviceWatcher servicediscovery.ServiceWatcher
-	mu             sync.RWMutex
+	transport      http.RoundTripper
+	// timeouts apply to all requests, the timeouts of the route and of the backend override them
+	timeouts TimeoutConfig
+	// limiters bound the requests in flight, the limiter of the pool comes before the global limiter
+	limiters []*ConcurrencyLimiter
+	// mirror duplicates a sample of the requests to a shadow pool, it is nil when requests are not mirrored
+	mirror *mirror
+	mu     sync.RWMutex
 }
 
-// NewLoadBalancer creates a new loadbalancer with the given backends
-func NewLoadBalancer(watcher servicediscovery.ServiceWatcher, serviceName string) *LoadBalancer {
+// NewLoadBalancer creates a new loadbalancer for the backends found by the watcher, the transport is used for all
+// requests to these backends
+func NewLoadBalancer(watcher servicediscovery.ServiceWatcher, serviceName string, transport http.RoundTripper) *LoadBalancer {
 	slog.Info("initializing load balancer")
 	return &LoadBalancer{
+		name:           serviceName,
+		strategy:       StrategyRoundRobin,
 		serviceName:    serviceName,
 		serviceWatcher: watcher,
+		transport:      transport,
 	}
 }
 
 func (lb *LoadBalancer) updateBackends(urls []string) {
-	backends, err := NewBackends(urls)
-	if err != nil {
-		slog.Error("failed to create backends", "error", err)
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	// Keep known backends so their health, administrative state and statistics survive discovery updates
+	existing := make(map[string]*Backend, len(lb.Backends))
+	for _, backend := range lb.Backends {
+		existing[backend.Addr] = backend
+	}
+
+	backends := make([]*Backend, 0, len(urls))
+	for _, addr := range urls {
+		if backend, ok := existing[addr]; ok {
+			backends = append(backends, backend)
+			continue
+		}
+
+		backend, err := NewBackend(addr, lb.transport)
+		if err != nil {
+			slog.Error("failed to create backend", "addr", addr, "error", err)
+			continue
+		}
+		backend.Pool = lb.name
+		backends = append(backends, backend)
 	}
 
-	lb.mu.Lock()
 	lb.Backends = backends
-	lb.mu.Unlock()
 
-	slog.Info("updated backend list", "count", len(lb.Backends))
+	slog.Info("updated backend list", "pool", lb.name, "count", len(lb.Backends))
 }
 
 func (lb *LoadBalancer) StartServiceWatcher() error {
@@ -51,43 +98,295 @@ func (lb *LoadBalancer) StopServiceWatcher() error {
 
 // ServeHTTP serves a request that is proxied to one of available (and healthy) backends
 func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	backend, err := lb.NextBackend()
+	// Continue the trace of the caller, if any
+	ctx, span := tracer().Start(tracing.Extract(r), "loadbalancer.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(tracing.RequestAttributes(r)...),
+		trace.WithAttributes(attribute.String("loadbalancer.pool", lb.name)),
+	)
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	if err := lb.acquire(ctx); err != nil {
+		slog.WarnContext(ctx, "shedding request", "pool", lb.name, "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "service overloaded: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	var mirrored *mirroredRequest
+	if lb.mirror != nil {
+		w, r, mirrored = lb.mirror.sample(w, r)
+	}
+
+	rec := newResponseRecorder(w)
+	backend, err := lb.selectBackend(ctx)
 	if err != nil {
-		slog.Error("failed to get next backend", "error", err)
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		// No backend saw the request, so it tells nothing about their load
+		for _, limiter := range lb.limiters {
+			limiter.abandon()
+		}
+		slog.ErrorContext(ctx, "failed to get next backend", "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		http.Error(rec, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
-	slog.Info("proxying request", "method", r.Method, "path", r.URL.Path, "backend", backend.Addr)
-	backend.ReverseProxy.ServeHTTP(w, r)
+	start := time.Now()
+	defer func() {
+		for _, limiter := range lb.limiters {
+			limiter.Release(time.Since(start), upstreamOverloaded(rec.status))
+		}
+	}()
+
+	slog.DebugContext(ctx, "proxying request", "method", r.Method, "path", r.URL.Path, "backend", backend.Addr)
+	lb.proxy(rec, r, backend)
+	if mirrored != nil {
+		lb.mirror.send(ctx, mirrored, rec.status)
+	}
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+	if rec.status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(rec.status))
+	}
+}
+
+// upstreamOverloaded reports whether the status of a proxied request shows an overloaded backend: the backend shed
+// or throttled the request, or it timed out or could not be reached
+func upstreamOverloaded(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// selectBackend picks the next backend inside its own span
+func (lb *LoadBalancer) selectBackend(ctx context.Context) (*Backend, error) {
+	_, span := tracer().Start(ctx, "loadbalancer.select_backend")
+	defer span.End()
+
+	backend, err := lb.NextBackend(ctx)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.String("backend.addr", backend.Addr))
+	return backend, nil
+}
+
+// proxy forwards the request to the backend inside a client span, the backend injects the span into the upstream
+// request headers
+func (lb *LoadBalancer) proxy(w *responseRecorder, r *http.Request, backend *Backend) {
+	ctx, span := tracer().Start(r.Context(), "loadbalancer.upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("backend.addr", backend.Addr)),
+	)
+	defer span.End()
+
+	info := requestInfoFrom(ctx)
+	info.Pool = lb.name
+	info.Backend = backend.Addr
+	info.upstreamStart = time.Now()
+
+	backend.requests.Add(1)
+	backend.inFlight.Add(1)
+	defer backend.inFlight.Add(-1)
+
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{GotConn: backend.gotConn})
+
+	lb.mu.RLock()
+	timeouts := lb.timeouts.merge(routeTimeouts(ctx)).merge(backend.Timeouts)
+	lb.mu.RUnlock()
+
+	ctx, stop := withUpstreamTimeouts(ctx, timeouts)
+	defer stop()
+
+	backend.ReverseProxy.ServeHTTP(w, r.WithContext(ctx))
+
+	if w.status >= http.StatusInternalServerError {
+		backend.errors.Add(1)
+	}
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(w.status))
+	if w.status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(w.status))
+	}
+}
+
+// acquire takes a slot of every limiter, when one of them rejects the request the slots already taken are freed
+func (lb *LoadBalancer) acquire(ctx context.Context) error {
+	for i, limiter := range lb.limiters {
+		if err := limiter.Acquire(ctx); err != nil {
+			for _, acquired := range lb.limiters[:i] {
+				acquired.abandon()
+			}
+			return err
+		}
+	}
+	return nil
 }
 
-// NextBackend tries to find the next healthy backend to proxy a request to
-func (lb *LoadBalancer) NextBackend() (*Backend, error) {
+// NextBackend tries to find the next healthy backend to proxy a request to, using the strategy of the pool
+func (lb *LoadBalancer) NextBackend(ctx context.Context) (*Backend, error) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
-	// Consider only healthy backends
-	healthyBackends := make([]*Backend, 0, len(lb.Backends))
+	// Consider only healthy and active backends
+	candidates := make([]*Backend, 0, len(lb.Backends))
 	for _, backend := range lb.Backends {
 		if !backend.Healthy {
-			slog.Debug("skipping unhealthy backend", "backend", backend.Addr)
+			slog.DebugContext(ctx, "skipping unhealthy backend", "backend", backend.Addr)
+			continue
+		}
+
+		if backend.State != BackendActive {
+			slog.DebugContext(ctx, "skipping inactive backend", "backend", backend.Addr, "state", backend.State)
 			continue
 		}
 
-		healthyBackends = append(healthyBackends, backend)
+		candidates = append(candidates, backend)
 	}
 
-	if len(healthyBackends) == 0 {
-		slog.Error("no healthy backends available", "total_backends", len(lb.Backends))
+	if len(candidates) == 0 {
+		slog.ErrorContext(ctx, "no healthy backends available", "total_backends", len(lb.Backends))
 		return nil, errors.New("no backends available")
 	}
 
+	switch lb.strategy {
+	case StrategyLeastConnections:
+		return lb.leastConnections(candidates), nil
+	case StrategyRandom:
+		return weightedRandom(candidates), nil
+	default:
+		return lb.roundRobin(ctx, candidates), nil
+	}
+}
+
+// roundRobin picks the backends in turn, backends with a higher weight appear multiple times
+func (lb *LoadBalancer) roundRobin(ctx context.Context, candidates []*Backend) *Backend {
+	weighted := make([]*Backend, 0, len(candidates))
+	for _, backend := range candidates {
+		for i := 0; i < backend.Weight; i++ {
+			weighted = append(weighted, backend)
+		}
+	}
+
 	current := lb.RRCounter.Load()
-	nextBackend := current % uint32(len(healthyBackends))
+	nextBackend := current % uint32(len(weighted))
 	lb.RRCounter.Add(1)
-	slog.Debug("selected backend",
-		"backend", healthyBackends[nextBackend].Addr,
+	slog.DebugContext(ctx, "selected backend",
+		"backend", weighted[nextBackend].Addr,
 		"counter", current,
 		"index", nextBackend)
-	return healthyBackends[nextBackend], nil
+	return weighted[nextBackend]
+}
+
+// leastConnections picks the backend with the fewest in-flight requests per unit of weight. The search starts at a
+// rotating offset so ties are spread over the backends.
+func (lb *LoadBalancer) leastConnections(candidates []*Backend) *Backend {
+	offset := int(lb.RRCounter.Add(1))
+
+	var best *Backend
+	var bestLoad float64
+	for i := range candidates {
+		backend := candidates[(offset+i)%len(candidates)]
+		load := float64(backend.inFlight.Load()) / float64(backend.Weight)
+		if best == nil || load < bestLoad {
+			best, bestLoad = backend, load
+		}
+	}
+	return best
+}
+
+// weightedRandom picks a random backend with a probability proportional to its weight
+func weightedRandom(candidates []*Backend) *Backend {
+	total := 0
+	for _, backend := range candidates {
+		total += backend.Weight
+	}
+
+	n := rand.IntN(total)
+	for _, backend := range candidates {
+		if n < backend.Weight {
+			return backend
+		}
+		n -= backend.Weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+// AvailableBackends returns the number of backends that can currently receive traffic
+func (lb *LoadBalancer) AvailableBackends() int {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	available := 0
+	for _, backend := range lb.Backends {
+		if backend.Healthy && backend.State == BackendActive {
+			available++
+		}
+	}
+	return available
+}
+
+// ErrBackendNotFound is returned when an administrative action refers to an unknown backend
+var ErrBackendNotFound = errors.New("backend not found")
+
+// BackendStatuses returns a snapshot of all backends
+func (lb *LoadBalancer) BackendStatuses() []BackendStatus {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	statuses := make([]BackendStatus, 0, len(lb.Backends))
+	for _, backend := range lb.Backends {
+		statuses = append(statuses, backend.status())
+	}
+	return statuses
+}
+
+// SetBackendState changes the administrative state of the backend with the given ID
+func (lb *LoadBalancer) SetBackendState(id string, state BackendState) (BackendStatus, error) {
+	return lb.updateBackend(id, func(backend *Backend) {
+		slog.Info("changing backend state", "backend", backend.Addr, "from", backend.State, "to", state)
+		backend.State = state
+	})
+}
+
+// SetBackendWeight changes the round robin weight of the backend with the given ID
+func (lb *LoadBalancer) SetBackendWeight(id string, weight int) (BackendStatus, error) {
+	if weight < 1 {
+		return BackendStatus{}, errors.New("weight must be at least 1")
+	}
+
+	return lb.updateBackend(id, func(backend *Backend) {
+		backend.Weight = weight
+	})
+}
+
+// SetBackendTimeouts overrides the route timeouts for requests to the backend with the given ID, zero values keep the
+// timeouts of the route
+func (lb *LoadBalancer) SetBackendTimeouts(id string, timeouts TimeoutConfig) (BackendStatus, error) {
+	if err := timeouts.validate(); err != nil {
+		return BackendStatus{}, err
+	}
+
+	return lb.updateBackend(id, func(backend *Backend) {
+		backend.Timeouts = timeouts
+	})
+}
+
+func (lb *LoadBalancer) updateBackend(id string, update func(*Backend)) (BackendStatus, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	for _, backend := range lb.Backends {
+		if backend.ID == id {
+			update(backend)
+			return backend.status(), nil
+		}
+	}
+
+	return BackendStatus{}, ErrBackendNotFound
 }
@@ -1,14 +1,37 @@
 package loadbalancer
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/compression"
+	"github.com/jeroenpf/coda-homework-assignment/internal/limits"
+	"github.com/jeroenpf/coda-homework-assignment/internal/servicediscovery"
 )
 
+// newTestLoadBalancer creates a load balancer that serves the given backend URLs
+func newTestLoadBalancer(t *testing.T, urls ...string) *LoadBalancer {
+	t.Helper()
+
+	lb := NewLoadBalancer(servicediscovery.NewStaticServiceWatcher(urls), "backend", http.DefaultTransport)
+	if err := lb.StartServiceWatcher(); err != nil {
+		t.Fatalf("Failed to start service watcher: %v", err)
+	}
+	t.Cleanup(func() {
+		lb.StopServiceWatcher()
+	})
+
+	return lb
+}
+
 func TestLoadBalancer(t *testing.T) {
 	// create mock backends
 	backend1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -23,14 +46,12 @@ func TestLoadBalancer(t *testing.T) {
 	}))
 	defer backend2.Close()
 
-	backends, err := NewBackends([]string{backend1.URL, backend2.URL})
-	if err != nil {
-		t.Fatalf("Failed to create backends: %v", err)
-	}
-
-	lb := NewLoadBalancer(backends)
+	lb := newTestLoadBalancer(t, backend1.URL, backend2.URL)
 
 	req, err := http.NewRequest("GET", "/test", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
 
 	t.Run("Round Robin will distribute requests", func(t *testing.T) {
 		response := make([]string, 4)
@@ -85,13 +106,8 @@ func TestBackendHealthChecker(t *testing.T) {
 	}))
 	defer backend2.Close()
 
-	backends, err := NewBackends([]string{backend1.URL, backend2.URL})
-	if err != nil {
-		t.Fatalf("Failed to create backends: %v", err)
-	}
-
-	hc := NewHealthChecker(backends, 100*time.Millisecond)
-	lb := NewLoadBalancer(backends)
+	lb := newTestLoadBalancer(t, backend1.URL, backend2.URL)
+	hc := NewHealthChecker(lb, 100*time.Millisecond)
 
 	hc.Start()
 	defer hc.Stop()
@@ -145,3 +161,89 @@ func TestBackendHealthChecker(t *testing.T) {
 		}
 	})
 }
+
+func TestRequestBodyLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+
+	lb := newTestLoadBalancer(t, backend.URL)
+	server := httptest.NewServer(limits.Middleware(limits.Config{MaxBodyBytes: 16}, lb))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		body   io.Reader
+		status int
+	}{
+		{name: "within limit", body: strings.NewReader(`{"points":20}`), status: http.StatusOK},
+		{name: "content length over limit", body: strings.NewReader(strings.Repeat("a", 1024)), status: http.StatusRequestEntityTooLarge},
+		// The limit is only hit while the body is streamed to the backend
+		{name: "chunked over limit", body: io.MultiReader(strings.NewReader(strings.Repeat("a", 1024))), status: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(server.URL, "application/json", tt.body)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestCompressedRequestBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+
+	lb := newTestLoadBalancer(t, backend.URL)
+	config := compression.Config{DecompressRequests: true, MaxDecompressedBytes: 64}
+	server := httptest.NewServer(compression.Middleware(config, lb))
+	defer server.Close()
+
+	compress := func(data string) io.Reader {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, _ = gz.Write([]byte(data))
+		_ = gz.Close()
+		return &buf
+	}
+
+	tests := []struct {
+		name   string
+		body   io.Reader
+		status int
+	}{
+		{name: "decoded for the backend", body: compress(`{"points":20}`), status: http.StatusOK},
+		{name: "corrupt", body: strings.NewReader("not gzip"), status: http.StatusBadRequest},
+		{name: "too large once decoded", body: compress(strings.Repeat("a", 1024)), status: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, server.URL, tt.body)
+			req.Header.Set("Content-Encoding", "gzip")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+			if tt.status == http.StatusOK && string(body) != `{"points":20}` {
+				t.Errorf("Expected the backend to receive the decoded body, got %q", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons reported by the rejected requests counter
+const (
+	reasonQueueFull = "queue_full"
+	reasonTimeout   = "timeout"
+	reasonPreempted = "preempted"
+	reasonCancelled = "cancelled"
+)
+
+// Metrics holds the Prometheus collectors of the load balancer, a nil Metrics records nothing
+type Metrics struct {
+	registry      *prometheus.Registry
+	queuedGauge   *prometheus.GaugeVec
+	admittedTotal *prometheus.CounterVec
+	rejectedTotal *prometheus.CounterVec
+	queueWait     *prometheus.HistogramVec
+	cacheTotal    *prometheus.CounterVec
+	cacheBytes    prometheus.Gauge
+	mirrorTotal   *prometheus.CounterVec
+}
+
+// NewMetrics creates the load balancer collectors and registers them on a dedicated registry
+func NewMetrics() *Metrics {
+	labels := []string{"limiter", "class"}
+
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		queuedGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "loadbalancer_queue_requests",
+			Help: "Number of requests waiting for a concurrency slot by priority class.",
+		}, labels),
+		admittedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "loadbalancer_queue_admitted_total",
+			Help: "Number of requests that got a concurrency slot by priority class.",
+		}, labels),
+		rejectedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "loadbalancer_queue_rejected_total",
+			Help: "Number of requests shed by the concurrency limiter by priority class and reason.",
+		}, append(labels, "reason")),
+		queueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "loadbalancer_queue_wait_seconds",
+			Help:    "Time admitted requests waited for a concurrency slot by priority class.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}, labels),
+		cacheTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "loadbalancer_cache_requests_total",
+			Help: "Number of requests handled by the response cache by cache status.",
+		}, []string{"status"}),
+		cacheBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "loadbalancer_cache_bytes",
+			Help: "Size of the responses stored in the response cache.",
+		}),
+		mirrorTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "loadbalancer_mirror_requests_total",
+			Help: "Number of sampled requests mirrored to a shadow pool by pool and comparison result.",
+		}, []string{"pool", "result"}),
+	}
+
+	m.registry.MustRegister(
+		m.queuedGauge,
+		m.admittedTotal,
+		m.rejectedTotal,
+		m.queueWait,
+		m.cacheTotal,
+		m.cacheBytes,
+		m.mirrorTotal,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Handler returns the handler that exposes the collected metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+func (m *Metrics) queued(limiter, class string, n int) {
+	if m != nil {
+		m.queuedGauge.WithLabelValues(limiter, class).Set(float64(n))
+	}
+}
+
+func (m *Metrics) admitted(limiter, class string, wait time.Duration) {
+	if m != nil {
+		m.admittedTotal.WithLabelValues(limiter, class).Inc()
+		m.queueWait.WithLabelValues(limiter, class).Observe(wait.Seconds())
+	}
+}
+
+func (m *Metrics) rejected(limiter, class string, err error) {
+	if m == nil {
+		return
+	}
+
+	reason := reasonCancelled
+	switch {
+	case errors.Is(err, ErrQueueFull):
+		reason = reasonQueueFull
+	case errors.Is(err, ErrQueueTimeout), errors.Is(err, context.DeadlineExceeded):
+		reason = reasonTimeout
+	case errors.Is(err, ErrPreempted):
+		reason = reasonPreempted
+	}
+	m.rejectedTotal.WithLabelValues(limiter, class, reason).Inc()
+}
+
+func (m *Metrics) cacheRequest(status string) {
+	if m != nil {
+		m.cacheTotal.WithLabelValues(status).Inc()
+	}
+}
+
+func (m *Metrics) cacheSize(bytes int64) {
+	if m != nil {
+		m.cacheBytes.Set(float64(bytes))
+	}
+}
+
+func (m *Metrics) mirrorRequest(pool, result string) {
+	if m != nil {
+		m.mirrorTotal.WithLabelValues(pool, result).Inc()
+	}
+}
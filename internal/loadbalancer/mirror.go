@@ -0,0 +1,371 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Results reported by the mirrored requests counter
+const (
+	mirrorMatch          = "match"
+	mirrorStatusMismatch = "status_mismatch"
+	mirrorBodyMismatch   = "body_mismatch"
+	mirrorError          = "error"
+	mirrorSkipped        = "skipped"
+)
+
+// MirrorConfig duplicates a percentage of the requests of a pool to a shadow pool. The responses of the shadow pool
+// are only compared with the primary responses, clients never see them.
+type MirrorConfig struct {
+	// Pool is the name of the shadow pool
+	Pool string `json:"pool"`
+	// Percent of the requests that is mirrored, between 0 and 100
+	Percent float64 `json:"percent"`
+	// MaxBodyBytes is the largest request body that is buffered for the shadow pool, requests with larger bodies are
+	// not mirrored. It defaults to 1 MiB.
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+	// MaxInFlight bounds the mirrored requests waiting for the shadow pool, further requests are not mirrored. It
+	// defaults to 100.
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+}
+
+func (c MirrorConfig) validate() error {
+	switch {
+	case c.Pool == "":
+		return errors.New("mirror requires a pool")
+	case c.Percent <= 0 || c.Percent > 100:
+		return fmt.Errorf("mirror percent %g must be above 0 and at most 100", c.Percent)
+	case c.MaxBodyBytes < 0 || c.MaxInFlight < 0:
+		return errors.New("mirror limits must not be negative")
+	}
+	return nil
+}
+
+// MirrorStatus counts how the mirrored requests of a pool compared
+type MirrorStatus struct {
+	Pool    string  `json:"pool"`
+	Percent float64 `json:"percent"`
+	Matches uint64  `json:"matches"`
+	// Mismatches are mirrored requests with a different status or response body
+	Mismatches uint64 `json:"mismatches"`
+	Errors     uint64 `json:"errors"`
+	Skipped    uint64 `json:"skipped"`
+}
+
+// mirror sends copies of sampled requests to the load balancer of the shadow pool once the primary response is
+// complete, so the shadow pool never delays the client
+type mirror struct {
+	pool    string
+	config  MirrorConfig
+	target  *LoadBalancer
+	slots   chan struct{}
+	metrics *Metrics
+
+	matches    atomic.Uint64
+	mismatches atomic.Uint64
+	errors     atomic.Uint64
+	skipped    atomic.Uint64
+}
+
+// linkMirrors connects the pools that mirror their requests to their shadow pools
+func linkMirrors(pools []*Pool, metrics *Metrics) error {
+	byName := make(map[string]*Pool, len(pools))
+	for _, pool := range pools {
+		byName[pool.Name] = pool
+	}
+
+	for _, pool := range pools {
+		config := pool.config.Mirror
+		if config == nil {
+			continue
+		}
+		if err := config.validate(); err != nil {
+			return fmt.Errorf("pool %s: %w", pool.Name, err)
+		}
+		target, ok := byName[config.Pool]
+		if !ok {
+			return fmt.Errorf("pool %s: unknown mirror pool %q", pool.Name, config.Pool)
+		}
+		if target == pool {
+			return fmt.Errorf("pool %s: can not mirror to itself", pool.Name)
+		}
+
+		pool.lb.mirror = newMirror(pool.Name, *config, target.lb, metrics)
+		target.shadow = true
+	}
+	return nil
+}
+
+func newMirror(pool string, config MirrorConfig, target *LoadBalancer, metrics *Metrics) *mirror {
+	if config.MaxBodyBytes == 0 {
+		config.MaxBodyBytes = 1 << 20
+	}
+	if config.MaxInFlight == 0 {
+		config.MaxInFlight = 100
+	}
+	return &mirror{
+		pool:    pool,
+		config:  config,
+		target:  target,
+		slots:   make(chan struct{}, config.MaxInFlight),
+		metrics: metrics,
+	}
+}
+
+// sample decides whether the request is mirrored, it then records the request body and the primary response body
+// as they pass. The returned writer and request replace w and r for the primary pool.
+func (m *mirror) sample(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, *mirroredRequest) {
+	if rand.Float64()*100 >= m.config.Percent {
+		return w, r, nil
+	}
+
+	mr := &mirroredRequest{
+		method:     r.Method,
+		uri:        r.URL.String(),
+		host:       r.Host,
+		remoteAddr: r.RemoteAddr,
+		header:     r.Header.Clone(),
+		hash:       sha256.New(),
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		mr.body = &mirrorBody{ReadCloser: r.Body, max: m.config.MaxBodyBytes}
+		r.Body = mr.body
+	}
+	return &hashWriter{ResponseWriter: w, hash: mr.hash}, r, mr
+}
+
+// send mirrors the request in the background, ctx is the context of the primary request
+func (m *mirror) send(ctx context.Context, mr *mirroredRequest, primaryStatus int) {
+	body, ok := mr.requestBody()
+	if !ok {
+		slog.DebugContext(ctx, "request not mirrored, body was not read completely or is too large", "pool", m.pool)
+		m.record(mirrorSkipped)
+		return
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		slog.DebugContext(ctx, "request not mirrored, too many mirrored requests in flight", "pool", m.pool)
+		m.record(mirrorSkipped)
+		return
+	}
+
+	primaryHash := mr.hash.Sum(nil)
+	go func() {
+		defer func() { <-m.slots }()
+		m.compare(ctx, mr, body, primaryStatus, primaryHash)
+	}()
+}
+
+// compare proxies the copy of the request to the shadow pool and compares the response with the primary response
+func (m *mirror) compare(ctx context.Context, mr *mirroredRequest, body []byte, primaryStatus int, primaryHash []byte) {
+	// The shadow request outlives the client request, it gets its own request info so the access log of the primary
+	// request is not changed
+	primary := requestInfoFrom(ctx)
+	ctx = withRequestInfo(context.WithoutCancel(ctx),
+		&requestInfo{RequestID: primary.RequestID, Route: primary.Route, User: primary.User})
+
+	// Without the client deadline, the total timeout of the route bounds the time the request holds its slot
+	m.target.mu.RLock()
+	total := m.target.timeouts.merge(routeTimeouts(ctx)).Total
+	m.target.mu.RUnlock()
+	if total > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, total)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, mr.method, mr.uri, bytes.NewReader(body))
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to create mirrored request", "pool", m.pool, "error", err)
+		m.record(mirrorError)
+		return
+	}
+	req.Host = mr.host
+	req.RemoteAddr = mr.remoteAddr
+	req.Header = mr.header
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+
+	// The shadow pool sheds mirrored requests like any other when its limiters are full
+	if err := m.target.acquire(ctx); err != nil {
+		slog.DebugContext(ctx, "request not mirrored, shadow pool overloaded", "pool", m.pool,
+			"mirror_pool", m.target.name, "error", err)
+		m.record(mirrorSkipped)
+		return
+	}
+
+	backend, err := m.target.selectBackend(ctx)
+	if err != nil {
+		for _, limiter := range m.target.limiters {
+			limiter.abandon()
+		}
+		slog.WarnContext(ctx, "mirrored request failed", "pool", m.pool, "mirror_pool", m.target.name, "error", err)
+		m.record(mirrorError)
+		return
+	}
+
+	shadowHash := sha256.New()
+	rec := newResponseRecorder(&hashWriter{ResponseWriter: discardWriter{header: http.Header{}}, hash: shadowHash})
+	start := time.Now()
+	m.target.proxy(rec, req, backend)
+	for _, limiter := range m.target.limiters {
+		limiter.Release(time.Since(start), upstreamOverloaded(rec.status))
+	}
+
+	result := mirrorMatch
+	switch {
+	case rec.status != primaryStatus:
+		result = mirrorStatusMismatch
+	case !bytes.Equal(shadowHash.Sum(nil), primaryHash):
+		result = mirrorBodyMismatch
+	}
+	m.record(result)
+
+	if result != mirrorMatch {
+		slog.WarnContext(ctx, "mirrored response differs",
+			"pool", m.pool,
+			"mirror_pool", m.target.name,
+			"mirror_backend", backend.Addr,
+			"method", mr.method,
+			"uri", mr.uri,
+			"result", result,
+			"status", primaryStatus,
+			"mirror_status", rec.status,
+			"body_hash", hex.EncodeToString(primaryHash),
+			"mirror_body_hash", hex.EncodeToString(shadowHash.Sum(nil)),
+		)
+	}
+}
+
+func (m *mirror) record(result string) {
+	switch result {
+	case mirrorMatch:
+		m.matches.Add(1)
+	case mirrorStatusMismatch, mirrorBodyMismatch:
+		m.mismatches.Add(1)
+	case mirrorError:
+		m.errors.Add(1)
+	default:
+		m.skipped.Add(1)
+	}
+	m.metrics.mirrorRequest(m.pool, result)
+}
+
+func (m *mirror) status() MirrorStatus {
+	return MirrorStatus{
+		Pool:       m.config.Pool,
+		Percent:    m.config.Percent,
+		Matches:    m.matches.Load(),
+		Mismatches: m.mismatches.Load(),
+		Errors:     m.errors.Load(),
+		Skipped:    m.skipped.Load(),
+	}
+}
+
+// mirroredRequest is what is kept of a sampled request until the primary response is complete
+type mirroredRequest struct {
+	method     string
+	uri        string
+	host       string
+	remoteAddr string
+	header     http.Header
+	// body is nil when the request has no body
+	body *mirrorBody
+	// hash is the hash of the primary response body
+	hash hash.Hash
+}
+
+// requestBody returns the request body, it is only available when the primary pool read all of it within the limit
+func (mr *mirroredRequest) requestBody() ([]byte, bool) {
+	if mr.body == nil {
+		return nil, true
+	}
+	return mr.body.recorded()
+}
+
+// mirrorBody keeps a copy of the request body as the primary pool reads it. The transport may still read the body
+// after the response arrived, so the copy is guarded by a lock.
+type mirrorBody struct {
+	io.ReadCloser
+	max int64
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	complete bool
+	tooLarge bool
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.tooLarge {
+		if int64(b.buf.Len()+n) > b.max {
+			b.tooLarge = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.complete = true
+	}
+	return n, err
+}
+
+func (b *mirrorBody) recorded() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.complete || b.tooLarge {
+		return nil, false
+	}
+	return bytes.Clone(b.buf.Bytes()), true
+}
+
+// hashWriter hashes the response body that is written through it
+type hashWriter struct {
+	http.ResponseWriter
+	hash hash.Hash
+}
+
+func (h *hashWriter) Write(b []byte) (int, error) {
+	n, err := h.ResponseWriter.Write(b)
+	h.hash.Write(b[:n])
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (h *hashWriter) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
+// discardWriter is the response writer of mirrored requests, their responses are hashed and dropped
+type discardWriter struct {
+	header http.Header
+}
+
+func (d discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d discardWriter) WriteHeader(int) {}
@@ -0,0 +1,176 @@
+package loadbalancer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForMirror waits until the mirror has compared the expected number of requests
+func waitForMirror(t *testing.T, pool *Pool, expected uint64) MirrorStatus {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		status := pool.lb.mirror.status()
+		if status.Matches+status.Mismatches+status.Errors+status.Skipped >= expected || time.Now().After(deadline) {
+			return status
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	primaryBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer primaryBackend.Close()
+
+	received := make(chan string, 10)
+	release := make(chan struct{})
+	shadowBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r.Header.Get("X-Player") + " " + string(body)
+		switch r.URL.Path {
+		case "/status":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/body":
+			_, _ = w.Write([]byte("changed"))
+		case "/slow":
+			<-release
+		default:
+			_, _ = w.Write(body)
+		}
+	}))
+	defer shadowBackend.Close()
+
+	newPools := func(t *testing.T, mirror MirrorConfig) (*Pool, *Pool) {
+		primary := newTestPool(t, PoolConfig{Name: "primary", BackendUrls: []string{primaryBackend.URL}, Mirror: &mirror})
+		shadow := newTestPool(t, PoolConfig{Name: "shadow", BackendUrls: []string{shadowBackend.URL}})
+		if err := linkMirrors([]*Pool{primary, shadow}, nil); err != nil {
+			t.Fatalf("Failed to link mirrors: %v", err)
+		}
+		return primary, shadow
+	}
+
+	send := func(pool *Pool, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("X-Player", "one")
+		rr := httptest.NewRecorder()
+		pool.lb.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("responses are compared", func(t *testing.T) {
+		primary, shadow := newPools(t, MirrorConfig{Pool: "shadow", Percent: 100})
+		if !shadow.shadow {
+			t.Error("Expected the mirror target to be marked as a shadow pool")
+		}
+
+		for _, path := range []string{"/same", "/status", "/body"} {
+			rr := send(primary, path, `{"points":20}`)
+			if rr.Code != http.StatusOK || rr.Body.String() != `{"points":20}` {
+				t.Errorf("Expected the primary response, got %d %q", rr.Code, rr.Body.String())
+			}
+		}
+
+		status := waitForMirror(t, primary, 3)
+		if status.Matches != 1 || status.Mismatches != 2 {
+			t.Errorf("Expected 1 match and 2 mismatches, got %+v", status)
+		}
+		for range 3 {
+			if got := <-received; got != `one {"points":20}` {
+				t.Errorf("Expected the shadow pool to get a copy of the request, got %q", got)
+			}
+		}
+	})
+
+	t.Run("the shadow pool does not delay clients", func(t *testing.T) {
+		primary, _ := newPools(t, MirrorConfig{Pool: "shadow", Percent: 100, MaxInFlight: 1})
+		defer close(release)
+
+		// The shadow pool holds on to the first request, the second does not fit and is skipped
+		for range 2 {
+			done := make(chan struct{})
+			go func() {
+				send(primary, "/slow", "data")
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("Expected the primary response while the shadow pool is busy")
+			}
+		}
+
+		if status := waitForMirror(t, primary, 1); status.Skipped != 1 {
+			t.Errorf("Expected the request over the in-flight limit to be skipped, got %+v", status)
+		}
+		<-received
+	})
+
+	t.Run("the shadow pool limits mirrored requests", func(t *testing.T) {
+		mirror := MirrorConfig{Pool: "shadow", Percent: 100}
+		primary := newTestPool(t, PoolConfig{Name: "primary", BackendUrls: []string{primaryBackend.URL}, Mirror: &mirror})
+		shadow := newTestPool(t, PoolConfig{
+			Name:        "shadow",
+			BackendUrls: []string{shadowBackend.URL},
+			Concurrency: ConcurrencyConfig{Limit: 1, QueueSize: 1, QueueTimeout: time.Minute},
+		})
+		shadow.lb.timeouts = TimeoutConfig{Total: 50 * time.Millisecond}
+		if err := linkMirrors([]*Pool{primary, shadow}, nil); err != nil {
+			t.Fatalf("Failed to link mirrors: %v", err)
+		}
+
+		// The mirrored request waits in the queue of the busy shadow pool until the total timeout ends it
+		if err := shadow.limiter.Acquire(context.Background()); err != nil {
+			t.Fatalf("Failed to acquire the shadow pool: %v", err)
+		}
+		defer shadow.limiter.abandon()
+		send(primary, "/same", "data")
+
+		if status := waitForMirror(t, primary, 1); status.Skipped != 1 {
+			t.Errorf("Expected the request to be skipped, got %+v", status)
+		}
+		select {
+		case got := <-received:
+			t.Errorf("Expected the shadow backend not to get the request, got %q", got)
+		default:
+		}
+	})
+
+	t.Run("bodies over the limit are not mirrored", func(t *testing.T) {
+		primary, _ := newPools(t, MirrorConfig{Pool: "shadow", Percent: 100, MaxBodyBytes: 4})
+		send(primary, "/same", "too large")
+
+		if status := waitForMirror(t, primary, 1); status.Skipped != 1 {
+			t.Errorf("Expected the request to be skipped, got %+v", status)
+		}
+	})
+}
+
+func TestLinkMirrorsValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		mirror MirrorConfig
+	}{
+		{"unknown pool", MirrorConfig{Pool: "missing", Percent: 10}},
+		{"itself", MirrorConfig{Pool: "primary", Percent: 10}},
+		{"no percent", MirrorConfig{Pool: "shadow"}},
+		{"percent above 100", MirrorConfig{Pool: "shadow", Percent: 150}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := newTestPool(t, PoolConfig{Name: "primary", BackendUrls: []string{"http://127.0.0.1:1"}, Mirror: &tt.mirror})
+			shadow := newTestPool(t, PoolConfig{Name: "shadow", BackendUrls: []string{"http://127.0.0.1:2"}})
+			if err := linkMirrors([]*Pool{primary, shadow}, nil); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/servicediscovery"
+)
+
+// Strategies for selecting the backend of a request
+const (
+	// StrategyRoundRobin sends requests to the backends in turn, backends with a higher weight get more turns
+	StrategyRoundRobin = "round_robin"
+	// StrategyLeastConnections sends requests to the backend with the fewest in-flight requests relative to its weight
+	StrategyLeastConnections = "least_connections"
+	// StrategyRandom picks a random backend, weighted by the backend weights
+	StrategyRandom = "random"
+)
+
+// DefaultHealthCheckPath is the path that is checked when a pool does not configure one
+const DefaultHealthCheckPath = "/healthz"
+
+// HealthCheckConfig configures the active health checks of a pool
+type HealthCheckConfig struct {
+	Path     string
+	Interval time.Duration
+	// Timeout limits a single check, it defaults to the interval
+	Timeout time.Duration
+}
+
+func (c HealthCheckConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(healthCheckJSON{Path: c.Path, Interval: formatDuration(c.Interval), Timeout: formatDuration(c.Timeout)})
+}
+
+func (c *HealthCheckConfig) UnmarshalJSON(data []byte) error {
+	var raw healthCheckJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	var err error
+	c.Path = raw.Path
+	if c.Interval, err = parseDuration("interval", raw.Interval); err != nil {
+		return err
+	}
+	if c.Timeout, err = parseDuration("timeout", raw.Timeout); err != nil {
+		return err
+	}
+	return nil
+}
+
+type healthCheckJSON struct {
+	Path     string `json:"path,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+}
+
+// PoolConfig describes a named group of backends
+type PoolConfig struct {
+	Name string `json:"name"`
+	// Service is the Consul service the backends are discovered from, it defaults to the pool name
+	Service string `json:"service,omitempty"`
+	// BackendUrls is a static list of backends, Consul is not used when it is set
+	BackendUrls []string `json:"backend_urls,omitempty"`
+	// Strategy is one of StrategyRoundRobin, StrategyLeastConnections or StrategyRandom
+	Strategy    string            `json:"strategy,omitempty"`
+	HealthCheck HealthCheckConfig `json:"health_check"`
+	// Concurrency limits the requests in flight to the backends of the pool
+	Concurrency ConcurrencyConfig `json:"concurrency"`
+	// Mirror duplicates a percentage of the requests to a shadow pool
+	Mirror *MirrorConfig `json:"mirror,omitempty"`
+	// UpstreamTLS replaces the upstream TLS flags for the connections to the backends of the pool
+	UpstreamTLS *UpstreamTLSConfig `json:"upstream_tls,omitempty"`
+}
+
+// withDefaults fills in the settings the pool does not configure
+func (c PoolConfig) withDefaults(healthCheckInterval time.Duration) PoolConfig {
+	if c.Service == "" {
+		c.Service = c.Name
+	}
+	if c.Strategy == "" {
+		c.Strategy = StrategyRoundRobin
+	}
+	if c.HealthCheck.Path == "" {
+		c.HealthCheck.Path = DefaultHealthCheckPath
+	}
+	if c.HealthCheck.Interval == 0 {
+		c.HealthCheck.Interval = healthCheckInterval
+	}
+	if c.HealthCheck.Timeout == 0 {
+		c.HealthCheck.Timeout = c.HealthCheck.Interval
+	}
+	return c
+}
+
+// Pool is a load balancer for a group of backends together with its health checks
+type Pool struct {
+	Name    string
+	config  PoolConfig
+	lb      *LoadBalancer
+	hc      *HealthChecker
+	limiter *ConcurrencyLimiter
+	// shadow pools only receive mirrored requests, they do not count towards readiness
+	shadow bool
+}
+
+// NewPool creates a pool that discovers its backends with the watcher, the config must have its defaults applied
+func NewPool(config PoolConfig, watcher servicediscovery.ServiceWatcher, transport http.RoundTripper) (*Pool, error) {
+	switch config.Strategy {
+	case StrategyRoundRobin, StrategyLeastConnections, StrategyRandom:
+	default:
+		return nil, fmt.Errorf("pool %s: unknown strategy %q", config.Name, config.Strategy)
+	}
+
+	limiter, err := NewConcurrencyLimiter(config.Concurrency)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: invalid concurrency: %w", config.Name, err)
+	}
+
+	lb := NewLoadBalancer(watcher, config.Service, transport)
+	lb.name = config.Name
+	lb.strategy = config.Strategy
+	if limiter != nil {
+		lb.limiters = append(lb.limiters, limiter)
+	}
+
+	return &Pool{
+		Name:    config.Name,
+		config:  config,
+		lb:      lb,
+		hc:      newHealthChecker(lb, config.HealthCheck),
+		limiter: limiter,
+	}, nil
+}
+
+// Start starts the discovery and health checks of the backends
+func (p *Pool) Start() error {
+	if err := p.lb.StartServiceWatcher(); err != nil {
+		return fmt.Errorf("pool %s: %w", p.Name, err)
+	}
+	p.hc.Start()
+	return nil
+}
+
+// Stop stops the discovery and health checks of the backends
+func (p *Pool) Stop() error {
+	p.hc.Stop()
+	if err := p.lb.StopServiceWatcher(); err != nil {
+		return fmt.Errorf("pool %s: %w", p.Name, err)
+	}
+	return nil
+}
+
+// PoolStatus is a point in time view of a pool
+type PoolStatus struct {
+	Name        string            `json:"name"`
+	Service     string            `json:"service"`
+	Strategy    string            `json:"strategy"`
+	HealthCheck HealthCheckConfig `json:"health_check"`
+	Backends    []BackendStatus   `json:"backends"`
+	// Concurrency is only set when the concurrency of the pool is limited
+	Concurrency *ConcurrencyStatus `json:"concurrency,omitempty"`
+	// Mirror is only set when the pool mirrors its requests
+	Mirror *MirrorStatus `json:"mirror,omitempty"`
+	Shadow bool          `json:"shadow,omitempty"`
+}
+
+func (p *Pool) status() PoolStatus {
+	status := PoolStatus{
+		Name:        p.Name,
+		Service:     p.config.Service,
+		Strategy:    p.config.Strategy,
+		HealthCheck: p.config.HealthCheck,
+		Backends:    p.lb.BackendStatuses(),
+		Shadow:      p.shadow,
+	}
+	if p.limiter != nil {
+		concurrency := p.limiter.Status()
+		status.Concurrency = &concurrency
+	}
+	if p.lb.mirror != nil {
+		mirror := p.lb.mirror.status()
+		status.Mirror = &mirror
+	}
+	return status
+}
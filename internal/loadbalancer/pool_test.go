@@ -0,0 +1,139 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPoolStrategies(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			<-release
+		}
+		w.Header().Set("X-Server-Id", "slow")
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Server-Id", "fast")
+	}))
+	defer fast.Close()
+
+	t.Run("Least connections avoids busy backends", func(t *testing.T) {
+		pool := newTestPool(t, PoolConfig{Name: "lc", Strategy: StrategyLeastConnections, BackendUrls: []string{slow.URL, fast.URL}})
+
+		// Occupy the slow backend with a request that blocks until released
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				rec := httptest.NewRecorder()
+				pool.lb.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/block", nil))
+				if rec.Header().Get("X-Server-Id") == "slow" {
+					return
+				}
+			}
+		}()
+
+		deadline := time.Now().Add(time.Second)
+		for pool.lb.Backends[0].inFlight.Load() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		for i := 0; i < 4; i++ {
+			rec := httptest.NewRecorder()
+			pool.lb.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Header().Get("X-Server-Id") != "fast" {
+				t.Errorf("Expected request %d to go to the idle backend, got %q", i, rec.Header().Get("X-Server-Id"))
+			}
+		}
+
+		close(release)
+		<-done
+	})
+
+	t.Run("Random respects weights", func(t *testing.T) {
+		pool := newTestPool(t, PoolConfig{Name: "random", Strategy: StrategyRandom, BackendUrls: []string{slow.URL, fast.URL}})
+		if _, err := pool.lb.SetBackendWeight(mustParseURL(t, fast.URL).Host, 4); err != nil {
+			t.Fatalf("SetBackendWeight() error = %v", err)
+		}
+
+		counts := make(map[string]int)
+		for i := 0; i < 500; i++ {
+			backend, err := pool.lb.NextBackend(context.Background())
+			if err != nil {
+				t.Fatalf("NextBackend() error = %v", err)
+			}
+			counts[backend.Addr]++
+		}
+
+		if counts[slow.URL] == 0 || counts[fast.URL] < 2*counts[slow.URL] {
+			t.Errorf("Unexpected distribution %v", counts)
+		}
+	})
+
+	t.Run("Unknown strategy", func(t *testing.T) {
+		if _, err := NewPool(PoolConfig{Name: "p", Strategy: "fastest"}, nil, http.DefaultTransport); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
+
+func TestPoolHealthCheckPath(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+
+	pool := newTestPool(t, PoolConfig{Name: "p", BackendUrls: []string{backend.URL}, HealthCheck: HealthCheckConfig{Path: "/status"}})
+	pool.hc.Check()
+
+	if !pool.lb.Backends[0].Healthy {
+		t.Error("Expected backend to be healthy on the configured path")
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	content := `{
+		"pools": [
+			{"name": "api", "service": "backend", "strategy": "least_connections", "health_check": {"path": "/status", "interval": "5s"}},
+			{"name": "games", "backend_urls": ["http://localhost:9001"]}
+		],
+		"routes": [
+			{"name": "games", "path_prefix": "/games/", "methods": ["GET"], "pool": "games", "timeouts": {"total": "2s"}},
+			{"name": "default", "pool": "api"}
+		]
+	}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	config := DefaultConfig()
+	if err := LoadConfigFile(path, &config); err != nil {
+		t.Fatalf("LoadConfigFile() error = %v", err)
+	}
+
+	if len(config.Pools) != 2 || config.Pools[0].HealthCheck.Interval != 5*time.Second || config.Pools[0].Strategy != StrategyLeastConnections {
+		t.Errorf("Unexpected pools %+v", config.Pools)
+	}
+
+	if len(config.Routes) != 2 || config.Routes[0].Timeouts.Total != 2*time.Second || config.Routes[0].Methods[0] != http.MethodGet {
+		t.Errorf("Unexpected routes %+v", config.Routes)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"pools": [{"name": "api", "weight": 2}]}`), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if err := LoadConfigFile(path, &config); err == nil {
+		t.Error("Expected unknown fields to be rejected")
+	}
+}
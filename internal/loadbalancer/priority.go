@@ -0,0 +1,190 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// ErrPreempted is returned to a queued request that gave up its place to a request of a higher priority class
+var ErrPreempted = errors.New("preempted by a request of a higher priority")
+
+// PriorityClass groups requests that are treated alike when requests have to wait for a free slot. Classes are listed
+// from the highest to the lowest priority.
+type PriorityClass struct {
+	Name string `json:"name"`
+	// Weight is the share of the freed slots the class gets while several classes are waiting, it defaults to 1
+	Weight int `json:"weight,omitempty"`
+	// A request belongs to the first class of which it matches a route, header or authenticated subject. A class
+	// without conditions matches every request, requests that match no class belong to the last class. An empty
+	// header value only requires the header to be present.
+	Routes  []string          `json:"routes,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Subjects are the names of API keys and the subjects of JWTs, as verified by the authenticator
+	Subjects []string `json:"subjects,omitempty"`
+}
+
+// matches reports whether the request belongs to the class
+func (c PriorityClass) matches(r *http.Request, rt *route) bool {
+	if len(c.Routes) == 0 && len(c.Headers) == 0 && len(c.Subjects) == 0 {
+		return true
+	}
+
+	if rt != nil && slices.Contains(c.Routes, rt.config.Name) {
+		return true
+	}
+	for name, value := range c.Headers {
+		values := r.Header.Values(name)
+		if len(values) > 0 && (value == "" || slices.Contains(values, value)) {
+			return true
+		}
+	}
+	// The authenticator removes the subject header of clients, so it only holds a verified identity
+	if subject := r.Header.Get(AuthSubjectHeader); subject != "" && slices.Contains(c.Subjects, subject) {
+		return true
+	}
+	return false
+}
+
+// priority is the class of a request, a lower rank is a higher priority
+type priority struct {
+	class  string
+	rank   int
+	weight int
+}
+
+// defaultPriority is used for all requests when no classes are configured
+var defaultPriority = priority{class: "default", weight: 1}
+
+type priorityKey struct{}
+
+// priorityFrom returns the priority of the request
+func priorityFrom(ctx context.Context) priority {
+	if p, ok := ctx.Value(priorityKey{}).(priority); ok {
+		return p
+	}
+	return defaultPriority
+}
+
+// priorityClassifier assigns requests to the configured priority classes
+type priorityClassifier struct {
+	classes []PriorityClass
+}
+
+func newPriorityClassifier(classes []PriorityClass) (*priorityClassifier, error) {
+	if len(classes) == 0 {
+		return nil, nil
+	}
+
+	classes = slices.Clone(classes)
+	seen := make(map[string]bool, len(classes))
+	for i, class := range classes {
+		if class.Name == "" || seen[class.Name] {
+			return nil, fmt.Errorf("priority class %d: missing or duplicate name %q", i, class.Name)
+		}
+		if class.Weight < 0 {
+			return nil, fmt.Errorf("priority class %s: weight must not be negative", class.Name)
+		}
+		if class.Weight == 0 {
+			classes[i].Weight = 1
+		}
+		seen[class.Name] = true
+	}
+	return &priorityClassifier{classes: classes}, nil
+}
+
+// classify returns the request with its priority in the context
+func (c *priorityClassifier) classify(r *http.Request, rt *route) *http.Request {
+	rank := len(c.classes) - 1
+	for i, class := range c.classes {
+		if class.matches(r, rt) {
+			rank = i
+			break
+		}
+	}
+
+	p := priority{class: c.classes[rank].Name, rank: rank, weight: c.classes[rank].Weight}
+	return r.WithContext(context.WithValue(r.Context(), priorityKey{}, p))
+}
+
+// waiter is a request waiting for a free slot
+type waiter struct {
+	class    *classQueue
+	elem     *list.Element
+	enqueued time.Time
+	// ready is closed when the request got a slot, or with err set when it was preempted
+	ready chan struct{}
+	err   error
+}
+
+// classQueue holds the waiting requests of a priority class
+type classQueue struct {
+	priority
+	waiters *list.List
+	// finish is the virtual time at which the class is served next, it advances by the inverse of the weight
+	finish float64
+}
+
+// fairQueue is a weighted fair queue of waiting requests. Freed slots go to the class with the lowest virtual finish
+// time, so under sustained overload every waiting class is served in proportion to its weight.
+type fairQueue struct {
+	classes []*classQueue
+	len     int
+	// clock is the virtual time of the last request that was served
+	clock float64
+}
+
+// class returns the queue of the priority, creating it on first use
+func (q *fairQueue) class(p priority) *classQueue {
+	i, found := slices.BinarySearchFunc(q.classes, p.rank, func(c *classQueue, rank int) int { return c.rank - rank })
+	if !found {
+		q.classes = slices.Insert(q.classes, i, &classQueue{priority: p, waiters: list.New()})
+	}
+	return q.classes[i]
+}
+
+func (q *fairQueue) push(w *waiter) {
+	// A class that starts waiting does not get credit for the time it was idle
+	if w.class.waiters.Len() == 0 {
+		w.class.finish = max(w.class.finish, q.clock)
+	}
+	w.elem = w.class.waiters.PushBack(w)
+	q.len++
+}
+
+// pop removes the next request to serve
+func (q *fairQueue) pop() *waiter {
+	var next *classQueue
+	for _, class := range q.classes {
+		if class.waiters.Len() > 0 && (next == nil || class.finish < next.finish) {
+			next = class
+		}
+	}
+	if next == nil {
+		return nil
+	}
+
+	q.clock = next.finish
+	next.finish += 1 / float64(next.weight)
+	return q.remove(next.waiters.Front().Value.(*waiter))
+}
+
+func (q *fairQueue) remove(w *waiter) *waiter {
+	w.class.waiters.Remove(w.elem)
+	q.len--
+	return w
+}
+
+// victim returns the most recently queued request of the lowest class below the given rank, if any
+func (q *fairQueue) victim(rank int) *waiter {
+	for i := len(q.classes) - 1; i >= 0 && q.classes[i].rank > rank; i-- {
+		if back := q.classes[i].waiters.Back(); back != nil {
+			return back.Value.(*waiter)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPriorityClassifier(t *testing.T) {
+	classifier, err := newPriorityClassifier([]PriorityClass{
+		{Name: "premium", Weight: 4, Headers: map[string]string{"X-Player-Tier": "premium"}, Subjects: []string{"partner"}},
+		{Name: "internal", Routes: []string{"admin"}},
+		{Name: "beta", Headers: map[string]string{"X-Beta": ""}},
+		{Name: "free"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create classifier: %v", err)
+	}
+
+	admin := &route{config: RouteConfig{Name: "admin"}}
+	tests := []struct {
+		name    string
+		header  string
+		value   string
+		route   *route
+		class   string
+		weight  int
+		ranking int
+	}{
+		{name: "header", header: "X-Player-Tier", value: "premium", class: "premium", weight: 4},
+		{name: "subject", header: AuthSubjectHeader, value: "partner", class: "premium", weight: 4},
+		{name: "route", route: admin, class: "internal", weight: 1, ranking: 1},
+		{name: "header present", header: "X-Beta", value: "1", class: "beta", weight: 1, ranking: 2},
+		{name: "other header value", header: "X-Player-Tier", value: "free", class: "free", weight: 1, ranking: 3},
+		{name: "no match", class: "free", weight: 1, ranking: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+
+			p := priorityFrom(classifier.classify(r, tt.route).Context())
+			if p.class != tt.class || p.weight != tt.weight || p.rank != tt.ranking {
+				t.Errorf("Expected class %s with weight %d and rank %d, got %+v", tt.class, tt.weight, tt.ranking, p)
+			}
+		})
+	}
+
+	for _, classes := range [][]PriorityClass{
+		{{Name: "a"}, {Name: "a"}},
+		{{Name: ""}},
+		{{Name: "a", Weight: -1}},
+	} {
+		if _, err := newPriorityClassifier(classes); err == nil {
+			t.Errorf("Expected classes %+v to be rejected", classes)
+		}
+	}
+}
+
+func TestWeightedFairQueue(t *testing.T) {
+	var queue fairQueue
+	high := queue.class(priority{class: "high", rank: 0, weight: 3})
+	low := queue.class(priority{class: "low", rank: 1, weight: 1})
+
+	for range 8 {
+		queue.push(&waiter{class: low})
+		queue.push(&waiter{class: high})
+	}
+
+	// While both classes wait, slots are shared in proportion to their weights
+	served := make(map[string]int)
+	for range 8 {
+		served[queue.pop().class.class]++
+	}
+	if served["high"] != 6 || served["low"] != 2 {
+		t.Errorf("Expected a 3:1 share, got %v", served)
+	}
+
+	// The lower class is drained once the higher class is empty
+	for queue.len > 0 {
+		served[queue.pop().class.class]++
+	}
+	if served["high"] != 8 || served["low"] != 8 || queue.pop() != nil {
+		t.Errorf("Expected all waiters to be served, got %v", served)
+	}
+}
+
+func TestPriorityPreemption(t *testing.T) {
+	limiter := newTestConcurrencyLimiter(t, ConcurrencyConfig{Limit: 1, QueueSize: 1, QueueTimeout: time.Second})
+	metrics := NewMetrics()
+	limiter.instrument("global", metrics)
+
+	high := context.WithValue(context.Background(), priorityKey{}, priority{class: "premium", rank: 0, weight: 1})
+	low := context.WithValue(context.Background(), priorityKey{}, priority{class: "free", rank: 1, weight: 1})
+
+	if err := limiter.Acquire(low); err != nil {
+		t.Fatalf("Expected a free slot, got %v", err)
+	}
+
+	lowResult := make(chan error, 1)
+	go func() { lowResult <- limiter.Acquire(low) }()
+	for limiter.Status().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A full queue rejects requests of the same class, but makes room for a higher class
+	if err := limiter.Acquire(low); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Expected the queue to be full, got %v", err)
+	}
+
+	highResult := make(chan error, 1)
+	go func() { highResult <- limiter.Acquire(high) }()
+	if err := <-lowResult; !errors.Is(err, ErrPreempted) {
+		t.Fatalf("Expected the queued request to be preempted, got %v", err)
+	}
+	if status := limiter.Status(); status.QueuedByClass["premium"] != 1 || status.Rejected != 2 {
+		t.Errorf("Expected the premium request to wait, got %+v", status)
+	}
+
+	limiter.Release(time.Millisecond, false)
+	if err := <-highResult; err != nil {
+		t.Fatalf("Expected the premium request to get the released slot, got %v", err)
+	}
+
+	if got := testutil.ToFloat64(metrics.rejectedTotal.WithLabelValues("global", "free", reasonPreempted)); got != 1 {
+		t.Errorf("Expected one preempted request, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.rejectedTotal.WithLabelValues("global", "free", reasonQueueFull)); got != 1 {
+		t.Errorf("Expected one request rejected on a full queue, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.admittedTotal.WithLabelValues("global", "premium")); got != 1 {
+		t.Errorf("Expected one admitted premium request, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.queuedGauge.WithLabelValues("global", "premium")); got != 0 {
+		t.Errorf("Expected the premium queue to be empty, got %v", got)
+	}
+}
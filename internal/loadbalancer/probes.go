@@ -0,0 +1,65 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Probes answers the liveness and readiness checks of the load balancer itself instead of proxying them
+type Probes struct {
+	lb                 backendCounter
+	minHealthyBackends int
+	shuttingDown       atomic.Bool
+}
+
+type readiness struct {
+	Status             string `json:"status"`
+	Reason             string `json:"reason,omitempty"`
+	HealthyBackends    int    `json:"healthy_backends"`
+	MinHealthyBackends int    `json:"min_healthy_backends"`
+}
+
+// backendCounter is implemented by the LoadBalancer and the Router
+type backendCounter interface {
+	AvailableBackends() int
+}
+
+// NewProbes creates probes that report ready once at least minHealthyBackends backends can receive traffic
+func NewProbes(lb backendCounter, minHealthyBackends int) *Probes {
+	return &Probes{
+		lb:                 lb,
+		minHealthyBackends: minHealthyBackends,
+	}
+}
+
+// ShuttingDown makes the readiness check fail so that upstream balancers stop sending traffic
+func (p *Probes) ShuttingDown() {
+	p.shuttingDown.Store(true)
+}
+
+// Liveness reports that the process is up and serving requests
+func (p *Probes) Liveness(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readiness reports whether the load balancer should receive traffic
+func (p *Probes) Readiness(w http.ResponseWriter, r *http.Request) {
+	result := readiness{
+		Status:             "ready",
+		HealthyBackends:    p.lb.AvailableBackends(),
+		MinHealthyBackends: p.minHealthyBackends,
+	}
+
+	switch {
+	case p.shuttingDown.Load():
+		result.Reason = "shutting down"
+	case result.HealthyBackends < p.minHealthyBackends:
+		result.Reason = "not enough healthy backends"
+	default:
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	result.Status = "not ready"
+	writeJSON(w, http.StatusServiceUnavailable, result)
+}
@@ -0,0 +1,45 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	backend1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend1.Close()
+
+	backend2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend2.Close()
+
+	lb := newTestLoadBalancer(t, backend1.URL, backend2.URL)
+	probes := NewProbes(lb, 2)
+
+	readiness := func() int {
+		rec := httptest.NewRecorder()
+		probes.Readiness(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+
+	if status := readiness(); status != http.StatusOK {
+		t.Errorf("Expected ready with two healthy backends, got %d", status)
+	}
+
+	if _, err := lb.SetBackendState(mustParseURL(t, backend2.URL).Host, BackendDisabled); err != nil {
+		t.Fatalf("Failed to disable backend: %v", err)
+	}
+
+	if status := readiness(); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready with one available backend, got %d", status)
+	}
+
+	if _, err := lb.SetBackendState(mustParseURL(t, backend2.URL).Host, BackendActive); err != nil {
+		t.Fatalf("Failed to enable backend: %v", err)
+	}
+
+	probes.ShuttingDown()
+	if status := readiness(); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready while shutting down, got %d", status)
+	}
+}
@@ -0,0 +1,235 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitKeyIP     = "ip"
+	RateLimitKeyAPIKey = "api_key"
+	RateLimitKeyHeader = "header"
+
+	// DefaultAPIKeyHeader carries the API key when rate limiting by API key
+	DefaultAPIKeyHeader = "X-API-Key"
+	// DefaultRateLimitKeys is the number of keys whose buckets are kept before the least recently used is evicted
+	DefaultRateLimitKeys = 10000
+)
+
+// RateLimitConfig configures a token bucket per client. A rate of 0 disables rate limiting.
+type RateLimitConfig struct {
+	// Rate is the number of requests per second a client may make on average
+	Rate float64 `json:"rate"`
+	// Burst is the number of requests a client may make at once, it defaults to the rate rounded up
+	Burst int `json:"burst,omitempty"`
+	// Key identifies clients by ip (the default), api_key or header. Requests without the key are limited by IP.
+	Key string `json:"key,omitempty"`
+	// Header carries the key for api_key and header, it defaults to X-API-Key for api_key
+	Header string `json:"header,omitempty"`
+	// MaxKeys bounds the number of buckets kept in memory
+	MaxKeys int `json:"max_keys,omitempty"`
+}
+
+// withDefaults fills in the burst, key and key table size
+func (cfg RateLimitConfig) withDefaults() RateLimitConfig {
+	if cfg.Burst == 0 {
+		cfg.Burst = int(math.Ceil(cfg.Rate))
+	}
+	if cfg.Key == "" {
+		cfg.Key = RateLimitKeyIP
+	}
+	if cfg.Key == RateLimitKeyAPIKey && cfg.Header == "" {
+		cfg.Header = DefaultAPIKeyHeader
+	}
+	if cfg.MaxKeys == 0 {
+		cfg.MaxKeys = DefaultRateLimitKeys
+	}
+	return cfg
+}
+
+func (cfg RateLimitConfig) validate() error {
+	switch {
+	case cfg.Rate < 0 || cfg.Burst < 0 || cfg.MaxKeys < 0:
+		return errors.New("rate limit values must not be negative")
+	case cfg.Key != RateLimitKeyIP && cfg.Key != RateLimitKeyAPIKey && cfg.Key != RateLimitKeyHeader:
+		return fmt.Errorf("unknown rate limit key %q", cfg.Key)
+	case cfg.Key == RateLimitKeyHeader && cfg.Header == "":
+		return errors.New("rate limit key header requires a header name")
+	}
+	return nil
+}
+
+// RateLimiter limits the request rate of every client with a token bucket
+type RateLimiter struct {
+	config RateLimitConfig
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets *keyTable[*tokenBucket]
+	// window replaces the token buckets when the counters are shared with other replicas
+	window *slidingWindow
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a rate limiter, it returns nil when the config does not limit anything
+func NewRateLimiter(cfg RateLimitConfig) (*RateLimiter, error) {
+	if cfg.Rate == 0 {
+		return nil, nil
+	}
+
+	cfg = cfg.withDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return &RateLimiter{
+		config:  cfg,
+		now:     time.Now,
+		buckets: newKeyTable[*tokenBucket](cfg.MaxKeys),
+	}, nil
+}
+
+// key returns the key the request is limited by
+func (l *RateLimiter) key(r *http.Request) string {
+	if l.config.Key != RateLimitKeyIP {
+		if value := r.Header.Get(l.config.Header); value != "" {
+			return l.config.Key + ":" + value
+		}
+	}
+	return RateLimitKeyIP + ":" + forwardedFrom(r).clientIP
+}
+
+// rateLimitResult is the state of a bucket after taking a token
+type rateLimitResult struct {
+	allowed   bool
+	limit     int
+	remaining int
+	// retryAfter is the time until the next token is available, reset the time until the bucket is full
+	retryAfter time.Duration
+	reset      time.Duration
+}
+
+// take removes a token from the bucket of the key
+func (l *RateLimiter) take(key string) rateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	burst := float64(l.config.Burst)
+
+	bucket, found := l.buckets.get(key, func() *tokenBucket {
+		return &tokenBucket{tokens: burst, last: now}
+	})
+	if found {
+		bucket.tokens = min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.config.Rate)
+		bucket.last = now
+	}
+
+	result := rateLimitResult{allowed: bucket.tokens >= 1, limit: l.config.Burst}
+	if result.allowed {
+		bucket.tokens--
+	} else {
+		result.retryAfter = l.duration(1 - bucket.tokens)
+	}
+	result.remaining = int(bucket.tokens)
+	result.reset = l.duration(burst - bucket.tokens)
+	return result
+}
+
+// duration returns the time it takes to refill the given number of tokens
+func (l *RateLimiter) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.config.Rate * float64(time.Second))
+}
+
+// Allow takes a token for the request and sets the RateLimit headers. When the client exceeded its limit the request
+// is answered with 429 and false is returned.
+func (l *RateLimiter) Allow(w http.ResponseWriter, r *http.Request) bool {
+	var result rateLimitResult
+	if l.window != nil {
+		result = l.window.take(l.key(r))
+	} else {
+		result = l.take(l.key(r))
+	}
+
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(result.limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.reset)))
+
+	if !result.allowed {
+		h.Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(result.retryAfter))))
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// keyTable keeps the state of the most recently used keys, the least recently used key is evicted when it is full
+type keyTable[T any] struct {
+	size  int
+	items map[string]*list.Element
+	// lru orders the entries from most to least recently used
+	lru *list.List
+}
+
+type keyEntry[T any] struct {
+	key   string
+	value T
+}
+
+func newKeyTable[T any](size int) *keyTable[T] {
+	return &keyTable[T]{size: size, items: make(map[string]*list.Element), lru: list.New()}
+}
+
+// get returns the state of the key and whether it was present, absent keys are added with the value of create
+func (t *keyTable[T]) get(key string, create func() T) (T, bool) {
+	if elem, ok := t.items[key]; ok {
+		t.lru.MoveToFront(elem)
+		return elem.Value.(*keyEntry[T]).value, true
+	}
+
+	entry := &keyEntry[T]{key: key, value: create()}
+	t.items[key] = t.lru.PushFront(entry)
+	if t.lru.Len() > t.size {
+		oldest := t.lru.Remove(t.lru.Back()).(*keyEntry[T])
+		delete(t.items, oldest.key)
+	}
+	return entry.value, false
+}
+
+// lookup returns the state of the key without marking it as used
+func (t *keyTable[T]) lookup(key string) (T, bool) {
+	if elem, ok := t.items[key]; ok {
+		return elem.Value.(*keyEntry[T]).value, true
+	}
+	var zero T
+	return zero, false
+}
+
+// len returns the number of keys in the table
+func (t *keyTable[T]) len() int {
+	return t.lru.Len()
+}
+
+// each calls fn for every key from most to least recently used
+func (t *keyTable[T]) each(fn func(key string, value T)) {
+	for elem := t.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*keyEntry[T])
+		fn(entry.key, entry.value)
+	}
+}
+
+// ceilSeconds rounds the duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
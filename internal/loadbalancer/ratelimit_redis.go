@@ -0,0 +1,165 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisDialTimeout bounds connecting to the Redis server when the context has no deadline
+const redisDialTimeout = 2 * time.Second
+
+// RedisStore keeps the counters in a server that speaks the Redis protocol. Every increment is a single round trip
+// that pipelines INCRBY, PEXPIRE and GET over one connection.
+type RedisStore struct {
+	addr string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewRedisStore(addr string) *RedisStore {
+	return &RedisStore{addr: addr}
+}
+
+func (s *RedisStore) Increment(ctx context.Context, key, previousKey string, delta int64, ttl time.Duration) (int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, previous, err := s.increment(ctx, key, previousKey, delta, ttl)
+	if err != nil {
+		// The connection is in an unknown state after a failure, the next increment reconnects
+		s.closeConn()
+		return 0, 0, fmt.Errorf("redis %s: %w", s.addr, err)
+	}
+	return current, previous, nil
+}
+
+func (s *RedisStore) increment(ctx context.Context, key, previousKey string, delta int64, ttl time.Duration) (int64, int64, error) {
+	if s.conn == nil {
+		dialer := net.Dialer{Timeout: redisDialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+		if err != nil {
+			return 0, 0, err
+		}
+		s.conn, s.reader = conn, bufio.NewReader(conn)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisDialTimeout)
+	}
+	if err := s.conn.SetDeadline(deadline); err != nil {
+		return 0, 0, err
+	}
+
+	var cmds []byte
+	cmds = appendRedisCommand(cmds, "INCRBY", key, strconv.FormatInt(delta, 10))
+	cmds = appendRedisCommand(cmds, "PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10))
+	cmds = appendRedisCommand(cmds, "GET", previousKey)
+	if _, err := s.conn.Write(cmds); err != nil {
+		return 0, 0, err
+	}
+
+	current, err := s.readInteger()
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := s.readInteger(); err != nil {
+		return 0, 0, err
+	}
+
+	value, null, err := s.readBulk()
+	if err != nil || null {
+		return current, 0, err
+	}
+	previous, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid counter %s: %w", previousKey, err)
+	}
+	return current, previous, nil
+}
+
+// appendRedisCommand encodes a command as an array of bulk strings
+func appendRedisCommand(b []byte, args ...string) []byte {
+	b = fmt.Appendf(b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		b = fmt.Appendf(b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b
+}
+
+// readLine reads a reply line, error replies are returned as errors
+func (s *RedisStore) readLine() (byte, string, error) {
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return 0, "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return 0, "", fmt.Errorf("malformed reply %q", line)
+	}
+
+	kind, value := line[0], line[1:len(line)-2]
+	if kind == '-' {
+		return 0, "", errors.New(value)
+	}
+	return kind, value, nil
+}
+
+func (s *RedisStore) readInteger() (int64, error) {
+	kind, value, err := s.readLine()
+	if err != nil {
+		return 0, err
+	}
+	if kind != ':' {
+		return 0, fmt.Errorf("expected an integer reply, got %q", kind)
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// readBulk reads a bulk string reply, null reports a missing key
+func (s *RedisStore) readBulk() (value string, null bool, err error) {
+	kind, length, err := s.readLine()
+	if err != nil {
+		return "", false, err
+	}
+	if kind != '$' {
+		return "", false, fmt.Errorf("expected a bulk reply, got %q", kind)
+	}
+
+	n, err := strconv.Atoi(length)
+	if err != nil {
+		return "", false, err
+	}
+	if n < 0 {
+		return "", true, nil
+	}
+
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(s.reader, buf); err != nil {
+		return "", false, err
+	}
+	return string(buf[:n]), false, nil
+}
+
+func (s *RedisStore) closeConn() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn, s.reader = nil, nil
+	}
+}
+
+func (s *RedisStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeConn()
+	return nil
+}
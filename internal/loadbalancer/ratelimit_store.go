@@ -0,0 +1,278 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// RateLimitStoreLocal keeps a token bucket per client in every replica
+	RateLimitStoreLocal  = "local"
+	RateLimitStoreMemory = "memory"
+	RateLimitStoreConsul = "consul"
+	RateLimitStoreRedis  = "redis"
+)
+
+// RateLimitStoreConfig configures where the replicas of the load balancer share their rate limit counters
+type RateLimitStoreConfig struct {
+	// Type is local, memory (counters shared within the process, for tests), consul or redis
+	Type string
+	// Addr is the address of the Consul agent or the Redis server
+	Addr string
+	// Prefix namespaces the counters in the store
+	Prefix string
+	// Window is the length of the sliding window, a client may make the rate times the window requests per window
+	Window time.Duration
+	// SyncInterval is how often locally counted requests are sent to the store and the shared counters are read back
+	SyncInterval time.Duration
+	// BatchSize triggers a sync as soon as a client made that many requests since the last sync
+	BatchSize int
+}
+
+func DefaultRateLimitStoreConfig() RateLimitStoreConfig {
+	return RateLimitStoreConfig{
+		Type:         RateLimitStoreLocal,
+		Prefix:       "loadbalancer/ratelimit",
+		Window:       time.Second,
+		SyncInterval: 100 * time.Millisecond,
+		BatchSize:    10,
+	}
+}
+
+// RateLimitStore holds counters that are shared by all replicas of the load balancer
+type RateLimitStore interface {
+	// Increment adds delta to the counter of key and returns its new value together with the value of previousKey.
+	// Counters expire after ttl.
+	Increment(ctx context.Context, key, previousKey string, delta int64, ttl time.Duration) (current, previous int64, err error)
+	Close() error
+}
+
+// NewRateLimitStore connects to the configured store, it returns nil for local rate limiting
+func NewRateLimitStore(cfg RateLimitStoreConfig) (RateLimitStore, error) {
+	switch cfg.Type {
+	case RateLimitStoreLocal, "":
+		return nil, nil
+	case RateLimitStoreMemory:
+		return NewMemoryStore(), nil
+	case RateLimitStoreConsul:
+		consulConfig := api.DefaultConfig()
+		if cfg.Addr != "" {
+			consulConfig.Address = cfg.Addr
+		}
+
+		client, err := api.NewClient(consulConfig)
+		if err != nil {
+			return nil, fmt.Errorf("could not create consul client: %w", err)
+		}
+		return NewConsulStore(client.KV(), cfg.Prefix), nil
+	case RateLimitStoreRedis:
+		if cfg.Addr == "" {
+			return nil, errors.New("redis rate limit store requires an address")
+		}
+		return NewRedisStore(cfg.Addr), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", cfg.Type)
+	}
+}
+
+// MemoryStore keeps the counters in memory, it is shared by load balancers running in the same process
+type MemoryStore struct {
+	mu       sync.Mutex
+	counters map[string]memoryCounter
+	swept    time.Time
+	now      func() time.Time
+}
+
+type memoryCounter struct {
+	value   int64
+	expires time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{counters: make(map[string]memoryCounter), now: time.Now}
+}
+
+func (s *MemoryStore) Increment(_ context.Context, key, previousKey string, delta int64, ttl time.Duration) (int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Expired counters are removed at most once per second
+	now := s.now()
+	if now.Sub(s.swept) > time.Second {
+		for k, counter := range s.counters {
+			if now.After(counter.expires) {
+				delete(s.counters, k)
+			}
+		}
+		s.swept = now
+	}
+
+	counter := s.counters[key]
+	counter.value += delta
+	counter.expires = now.Add(ttl)
+	s.counters[key] = counter
+
+	previous := s.counters[previousKey]
+	if now.After(previous.expires) {
+		previous.value = 0
+	}
+	return counter.value, previous.value, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// consulKV is the part of the Consul KV API used by the store
+type consulKV interface {
+	Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error)
+	List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error)
+	CAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error)
+	Delete(key string, w *api.WriteOptions) (*api.WriteMeta, error)
+	DeleteCAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error)
+}
+
+// ConsulStore keeps the counters in the Consul KV store. Consul keys do not expire, so every counter carries its
+// expiry in the flags of the key. The counter two windows back is deleted when a window starts, the counters of
+// clients that went idle are swept periodically.
+type ConsulStore struct {
+	kv     consulKV
+	prefix string
+	now    func() time.Time
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+const (
+	// consulCASAttempts bounds the retries of an increment that races with other replicas
+	consulCASAttempts = 10
+	// consulSweepInterval is how often expired counters are removed
+	consulSweepInterval = time.Minute
+)
+
+// NewConsulStore creates a store for the counters below prefix and starts sweeping expired counters until it is closed
+func NewConsulStore(kv consulKV, prefix string) *ConsulStore {
+	s := &ConsulStore{kv: kv, prefix: prefix, now: time.Now, stop: make(chan struct{}), done: make(chan struct{})}
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(consulSweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), consulSweepInterval)
+				if err := s.sweep(ctx); err != nil {
+					slog.Warn("could not remove expired rate limit counters", "error", err)
+				}
+				cancel()
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *ConsulStore) Increment(ctx context.Context, key, previousKey string, delta int64, ttl time.Duration) (int64, int64, error) {
+	q := (&api.QueryOptions{}).WithContext(ctx)
+	w := (&api.WriteOptions{}).WithContext(ctx)
+
+	var current int64
+	for attempt := 0; ; attempt++ {
+		if attempt == consulCASAttempts {
+			return 0, 0, fmt.Errorf("could not update %s: too many concurrent updates", key)
+		}
+
+		pair, _, err := s.kv.Get(key, q)
+		if err != nil {
+			return 0, 0, fmt.Errorf("could not read %s: %w", key, err)
+		}
+
+		var index uint64
+		current = 0
+		if pair != nil {
+			index = pair.ModifyIndex
+			if current, err = strconv.ParseInt(string(pair.Value), 10, 64); err != nil {
+				return 0, 0, fmt.Errorf("invalid counter %s: %w", key, err)
+			}
+		}
+		if delta == 0 {
+			break
+		}
+
+		current += delta
+		expires := uint64(s.now().Add(ttl).UnixMilli())
+		ok, _, err := s.kv.CAS(&api.KVPair{Key: key, Value: []byte(strconv.FormatInt(current, 10)), Flags: expires, ModifyIndex: index}, w)
+		if err != nil {
+			return 0, 0, fmt.Errorf("could not update %s: %w", key, err)
+		}
+		if ok {
+			if index == 0 {
+				s.expire(previousKey, w)
+			}
+			break
+		}
+	}
+
+	pair, _, err := s.kv.Get(previousKey, q)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not read %s: %w", previousKey, err)
+	}
+
+	var previous int64
+	if pair != nil {
+		if previous, err = strconv.ParseInt(string(pair.Value), 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid counter %s: %w", previousKey, err)
+		}
+	}
+	return current, previous, nil
+}
+
+// expire deletes the counter of the window before previousKey, which no longer affects any sliding window
+func (s *ConsulStore) expire(previousKey string, w *api.WriteOptions) {
+	key, window, ok := splitWindowKey(previousKey)
+	if !ok {
+		return
+	}
+	if _, err := s.kv.Delete(windowKey(key, window-1), w); err != nil {
+		slog.Debug("could not delete expired rate limit counter", "key", key, "error", err)
+	}
+}
+
+// sweep deletes the counters that expired, a counter that is updated in the meantime is kept
+func (s *ConsulStore) sweep(ctx context.Context) error {
+	pairs, _, err := s.kv.List(s.prefix+"/", (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("could not list counters: %w", err)
+	}
+
+	now := uint64(s.now().UnixMilli())
+	w := (&api.WriteOptions{}).WithContext(ctx)
+	for _, pair := range pairs {
+		if pair.Flags == 0 || pair.Flags > now {
+			continue
+		}
+		if _, _, err := s.kv.DeleteCAS(pair, w); err != nil {
+			return fmt.Errorf("could not delete %s: %w", pair.Key, err)
+		}
+	}
+	return nil
+}
+
+// Close stops sweeping expired counters
+func (s *ConsulStore) Close() error {
+	close(s.stop)
+	<-s.done
+	return nil
+}
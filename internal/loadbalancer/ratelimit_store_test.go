@@ -0,0 +1,444 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// newSharedTestLimiter creates a rate limiter of a replica that shares its counters through the store. The window
+// starts at the returned clock, which only moves when it is advanced.
+func newSharedTestLimiter(t *testing.T, store RateLimitStore, clock *time.Time) (*RateLimiter, *sharedRateLimits) {
+	t.Helper()
+
+	limiter, err := NewRateLimiter(RateLimitConfig{Rate: 10})
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+
+	cfg := DefaultRateLimitStoreConfig()
+	cfg.BatchSize = 100
+	shared, err := newSharedRateLimits(store, cfg)
+	if err != nil {
+		t.Fatalf("Failed to create shared rate limits: %v", err)
+	}
+	shared.share(limiter, "global")
+	limiter.window.now = func() time.Time { return *clock }
+
+	return limiter, shared
+}
+
+// takeAll takes tokens for the key until it is limited and returns the number of allowed requests
+func takeAll(l *RateLimiter, key string) int {
+	for i := 0; ; i++ {
+		if !l.window.take(key).allowed {
+			return i
+		}
+	}
+}
+
+func TestSharedRateLimits(t *testing.T) {
+	store := NewMemoryStore()
+	clock := time.Unix(1_000_000, 0)
+	replicaA, sharedA := newSharedTestLimiter(t, store, &clock)
+	replicaB, sharedB := newSharedTestLimiter(t, store, &clock)
+
+	for range 6 {
+		if !replicaA.window.take("ip:192.0.2.1").allowed {
+			t.Fatal("Expected the first requests to be allowed")
+		}
+	}
+	sharedA.sync(context.Background())
+
+	// Replica B only learns about the requests of replica A once it synced the client
+	if !replicaB.window.take("ip:192.0.2.1").allowed {
+		t.Fatal("Expected the first request on replica B to be allowed")
+	}
+	sharedB.sync(context.Background())
+
+	if allowed := takeAll(replicaB, "ip:192.0.2.1"); allowed != 3 {
+		t.Errorf("Expected replica B to allow 3 more requests, got %d", allowed)
+	}
+
+	// Halfway through the next window half of the previous window still counts
+	clock = clock.Add(1500 * time.Millisecond)
+	sharedB.sync(context.Background())
+	sharedA.sync(context.Background())
+	if !replicaA.window.take("ip:192.0.2.1").allowed {
+		t.Fatal("Expected a request in the next window to be allowed")
+	}
+	sharedA.sync(context.Background())
+
+	// The previous window had 10 requests, half of them and the request above leave room for 4
+	if allowed := takeAll(replicaA, "ip:192.0.2.1"); allowed != 4 {
+		t.Errorf("Expected 4 requests to be allowed in the sliding window, got %d", allowed)
+	}
+
+	result := replicaA.window.take("ip:192.0.2.1")
+	if result.allowed || result.retryAfter <= 0 || result.retryAfter > time.Second {
+		t.Errorf("Expected a retry within a second, got %+v", result)
+	}
+}
+
+func TestSharedRateLimitsBatching(t *testing.T) {
+	store := &countingStore{RateLimitStore: NewMemoryStore()}
+	limiter, _ := NewRateLimiter(RateLimitConfig{Rate: 1000})
+
+	cfg := DefaultRateLimitStoreConfig()
+	cfg.SyncInterval = time.Hour
+	cfg.BatchSize = 50
+	shared, _ := newSharedRateLimits(store, cfg)
+	shared.share(limiter, "global")
+	clock := time.Unix(1_000_000, 0)
+	limiter.window.now = func() time.Time { return clock }
+	shared.Start()
+
+	for range 120 {
+		limiter.window.take("ip:192.0.2.1")
+	}
+
+	// A full batch triggers a sync, well before the sync interval
+	deadline := time.Now().Add(2 * time.Second)
+	for store.calls() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if store.calls() == 0 {
+		t.Fatal("Expected a full batch to be sent to the store")
+	}
+
+	if err := shared.Stop(); err != nil {
+		t.Fatalf("Failed to stop: %v", err)
+	}
+
+	// Stopping sends the remaining requests, all in far fewer round trips than requests
+	current, _, _ := store.Increment(context.Background(), windowKey(limiter.window.prefix+"/"+hashKey("ip:192.0.2.1"), clock.Unix()), "", 0, time.Minute)
+	if current != 120 || store.calls() > 4 {
+		t.Errorf("Expected 120 requests in at most 3 round trips, got %d in %d", current, store.calls()-1)
+	}
+}
+
+func TestSharedRateLimitsSyncFailures(t *testing.T) {
+	store := &failingStore{RateLimitStore: NewMemoryStore(), fail: hashKey("ip:192.0.2.1")}
+	clock := time.Unix(1_000_000, 0)
+	limiter, shared := newSharedTestLimiter(t, store, &clock)
+
+	for _, key := range []string{"ip:192.0.2.1", "ip:192.0.2.2"} {
+		for range 3 {
+			limiter.window.take(key)
+		}
+	}
+	if err := limiter.window.sync(context.Background(), store); err == nil {
+		t.Fatal("Expected the failing counter to be reported")
+	}
+
+	// The other client is synced despite the failure, the failed requests are sent again once the store recovers
+	counter := func(key string) int64 {
+		current, _, _ := store.RateLimitStore.Increment(context.Background(), windowKey(limiter.window.prefix+"/"+hashKey(key), clock.Unix()), "", 0, time.Minute)
+		return current
+	}
+	if got := counter("ip:192.0.2.2"); got != 3 {
+		t.Errorf("Expected 3 requests of the healthy client in the store, got %d", got)
+	}
+
+	store.fail = ""
+	shared.sync(context.Background())
+	if got := counter("ip:192.0.2.1"); got != 3 {
+		t.Errorf("Expected the failed requests to be sent again, got %d", got)
+	}
+}
+
+// failingStore fails the increments of the counters containing fail
+type failingStore struct {
+	RateLimitStore
+	fail string
+}
+
+func (s *failingStore) Increment(ctx context.Context, key, previousKey string, delta int64, ttl time.Duration) (int64, int64, error) {
+	if s.fail != "" && strings.Contains(key, s.fail) {
+		return 0, 0, errors.New("unavailable")
+	}
+	return s.RateLimitStore.Increment(ctx, key, previousKey, delta, ttl)
+}
+
+// countingStore counts the round trips to the store
+type countingStore struct {
+	RateLimitStore
+	mu sync.Mutex
+	n  int
+}
+
+func (s *countingStore) Increment(ctx context.Context, key, previousKey string, delta int64, ttl time.Duration) (int64, int64, error) {
+	s.mu.Lock()
+	s.n++
+	s.mu.Unlock()
+	return s.RateLimitStore.Increment(ctx, key, previousKey, delta, ttl)
+}
+
+func (s *countingStore) calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+// fakeRedis is a stand-in for a Redis server that supports the commands used by the store
+type fakeRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	values   map[string]int64
+	expiries map[string]time.Duration
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	r := &fakeRedis{listener: listener, values: make(map[string]int64), expiries: make(map[string]time.Duration)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for {
+		args, err := readFakeRedisCommand(reader)
+		if err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		var reply string
+		switch strings.ToUpper(args[0]) {
+		case "INCRBY":
+			delta, _ := strconv.ParseInt(args[2], 10, 64)
+			r.values[args[1]] += delta
+			reply = fmt.Sprintf(":%d\r\n", r.values[args[1]])
+		case "PEXPIRE":
+			ms, _ := strconv.ParseInt(args[2], 10, 64)
+			r.expiries[args[1]] = time.Duration(ms) * time.Millisecond
+			reply = ":1\r\n"
+		case "GET":
+			if value, ok := r.values[args[1]]; ok {
+				s := strconv.FormatInt(value, 10)
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+			} else {
+				reply = "$-1\r\n"
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		r.mu.Unlock()
+
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readFakeRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func TestRedisStore(t *testing.T) {
+	server := newFakeRedis(t)
+	store := NewRedisStore(server.listener.Addr().String())
+	defer store.Close()
+
+	ctx := context.Background()
+	if _, _, err := store.Increment(ctx, "rl/a/1", "rl/a/0", 3, time.Second); err != nil {
+		t.Fatalf("Failed to increment: %v", err)
+	}
+
+	current, previous, err := store.Increment(ctx, "rl/a/2", "rl/a/1", 2, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to increment: %v", err)
+	}
+	if current != 2 || previous != 3 {
+		t.Errorf("Expected current 2 and previous 3, got %d and %d", current, previous)
+	}
+
+	server.mu.Lock()
+	ttl := server.expiries["rl/a/2"]
+	server.mu.Unlock()
+	if ttl != 2*time.Second {
+		t.Errorf("Expected the counter to expire after 2s, got %s", ttl)
+	}
+
+	// The store reconnects after the connection was lost
+	store.mu.Lock()
+	_ = store.conn.Close()
+	store.mu.Unlock()
+	if _, _, err := store.Increment(ctx, "rl/a/2", "rl/a/1", 1, time.Second); err == nil {
+		t.Fatal("Expected an error on a closed connection")
+	}
+	if current, _, err := store.Increment(ctx, "rl/a/2", "rl/a/1", 1, time.Second); err != nil || current != 3 {
+		t.Errorf("Expected the store to reconnect, got %d, %v", current, err)
+	}
+}
+
+// fakeConsulKV is an in-memory stand-in for the Consul KV API
+type fakeConsulKV struct {
+	mu    sync.Mutex
+	pairs map[string]*api.KVPair
+	index uint64
+	// conflicts makes the next CAS calls fail as if another replica updated the key
+	conflicts int
+}
+
+func (kv *fakeConsulKV) Get(key string, _ *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if pair, ok := kv.pairs[key]; ok {
+		copied := *pair
+		return &copied, nil, nil
+	}
+	return nil, nil, nil
+}
+
+func (kv *fakeConsulKV) CAS(p *api.KVPair, _ *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.conflicts > 0 {
+		kv.conflicts--
+		return false, nil, nil
+	}
+
+	var index uint64
+	if existing, ok := kv.pairs[p.Key]; ok {
+		index = existing.ModifyIndex
+	}
+	if index != p.ModifyIndex {
+		return false, nil, nil
+	}
+
+	kv.index++
+	kv.pairs[p.Key] = &api.KVPair{Key: p.Key, Value: p.Value, Flags: p.Flags, ModifyIndex: kv.index}
+	return true, nil, nil
+}
+
+func (kv *fakeConsulKV) List(prefix string, _ *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	var pairs api.KVPairs
+	for key, pair := range kv.pairs {
+		if strings.HasPrefix(key, prefix) {
+			copied := *pair
+			pairs = append(pairs, &copied)
+		}
+	}
+	return pairs, nil, nil
+}
+
+func (kv *fakeConsulKV) DeleteCAS(p *api.KVPair, _ *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if existing, ok := kv.pairs[p.Key]; !ok || existing.ModifyIndex != p.ModifyIndex {
+		return false, nil, nil
+	}
+	delete(kv.pairs, p.Key)
+	return true, nil, nil
+}
+
+func (kv *fakeConsulKV) Delete(key string, _ *api.WriteOptions) (*api.WriteMeta, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	delete(kv.pairs, key)
+	return nil, nil
+}
+
+func TestConsulStore(t *testing.T) {
+	kv := &fakeConsulKV{pairs: make(map[string]*api.KVPair)}
+	store := NewConsulStore(kv, "rl")
+	defer store.Close()
+	clock := time.Unix(1_000_000, 0)
+	store.now = func() time.Time { return clock }
+	ctx := context.Background()
+
+	for _, key := range []string{"rl/a/1", "rl/a/2"} {
+		if _, _, err := store.Increment(ctx, key, "", 4, time.Second); err != nil {
+			t.Fatalf("Failed to increment: %v", err)
+		}
+	}
+
+	// Concurrent updates are retried
+	kv.conflicts = 2
+	current, previous, err := store.Increment(ctx, "rl/a/3", "rl/a/2", 5, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to increment: %v", err)
+	}
+	if current != 5 || previous != 4 {
+		t.Errorf("Expected current 5 and previous 4, got %d and %d", current, previous)
+	}
+
+	// Starting window 3 deletes window 1
+	if pair, _, _ := kv.Get("rl/a/1", nil); pair != nil {
+		t.Error("Expected the counter two windows back to be deleted")
+	}
+
+	kv.conflicts = consulCASAttempts
+	if _, _, err := store.Increment(ctx, "rl/a/3", "rl/a/2", 1, time.Second); err == nil {
+		t.Error("Expected an error after too many conflicts")
+	}
+
+	// The counters of a client that went idle are swept once they expire, active clients keep theirs
+	clock = clock.Add(1500 * time.Millisecond)
+	if _, _, err := store.Increment(ctx, "rl/b/4", "rl/b/3", 1, time.Second); err != nil {
+		t.Fatalf("Failed to increment: %v", err)
+	}
+	if err := store.sweep(ctx); err != nil {
+		t.Fatalf("Failed to sweep: %v", err)
+	}
+	pairs, _, _ := kv.List("rl/", nil)
+	if len(pairs) != 1 || pairs[0].Key != "rl/b/4" {
+		t.Errorf("Expected only the counter of the active client to remain, got %d counters", len(pairs))
+	}
+}
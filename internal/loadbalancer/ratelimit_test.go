@@ -0,0 +1,181 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestRateLimiter creates a rate limiter whose clock only moves when the returned function is called
+func newTestRateLimiter(t *testing.T, cfg RateLimitConfig) (*RateLimiter, func(time.Duration)) {
+	t.Helper()
+
+	limiter, err := NewRateLimiter(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create rate limiter: %v", err)
+	}
+
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	return limiter, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter, advance := newTestRateLimiter(t, RateLimitConfig{Rate: 2, Burst: 3})
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		if limiter.Allow(rr, req) {
+			rr.WriteHeader(http.StatusOK)
+		}
+		return rr
+	}
+
+	// The burst is available at once, after that the client has to wait for new tokens
+	for i := range 3 {
+		rr := request("192.0.2.1:1000")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected request %d to be allowed, got %d", i+1, rr.Code)
+		}
+		if got, expected := rr.Header().Get("RateLimit-Remaining"), strconv.Itoa(2-i); got != expected {
+			t.Errorf("Expected %s remaining, got %s", expected, got)
+		}
+	}
+
+	rr := request("192.0.2.1:1000")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Expected Retry-After 1, got %q", got)
+	}
+	if got := rr.Header().Get("RateLimit-Limit"); got != "3" {
+		t.Errorf("Expected RateLimit-Limit 3, got %q", got)
+	}
+	if got := rr.Header().Get("RateLimit-Reset"); got != "2" {
+		t.Errorf("Expected RateLimit-Reset 2, got %q", got)
+	}
+
+	// Other clients have their own bucket
+	if rr := request("192.0.2.2:1000"); rr.Code != http.StatusOK {
+		t.Errorf("Expected another client to be allowed, got %d", rr.Code)
+	}
+
+	// Two tokens per second are added
+	advance(500 * time.Millisecond)
+	if rr := request("192.0.2.1:1000"); rr.Code != http.StatusOK {
+		t.Errorf("Expected a request to be allowed after a token was added, got %d", rr.Code)
+	}
+	if rr := request("192.0.2.1:1000"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the next request to be limited, got %d", rr.Code)
+	}
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   RateLimitConfig
+		headers  map[string]string
+		expected string
+	}{
+		{"Client IP", RateLimitConfig{Rate: 1}, map[string]string{"X-API-Key": "secret"}, "ip:192.0.2.1"},
+		{"API key", RateLimitConfig{Rate: 1, Key: RateLimitKeyAPIKey}, map[string]string{"X-API-Key": "secret"}, "api_key:secret"},
+		{"Missing API key", RateLimitConfig{Rate: 1, Key: RateLimitKeyAPIKey}, nil, "ip:192.0.2.1"},
+		{"Header", RateLimitConfig{Rate: 1, Key: RateLimitKeyHeader, Header: "X-Tenant"}, map[string]string{"X-Tenant": "acme"}, "header:acme"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, _ := newTestRateLimiter(t, tt.config)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "192.0.2.1:1000"
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			if got := limiter.key(req); got != tt.expected {
+				t.Errorf("Expected key %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	for _, cfg := range []RateLimitConfig{
+		{Rate: -1},
+		{Rate: 1, Key: "cookie"},
+		{Rate: 1, Key: RateLimitKeyHeader},
+	} {
+		if _, err := NewRateLimiter(cfg); err == nil {
+			t.Errorf("Expected config %+v to be rejected", cfg)
+		}
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	limiter, _ := newTestRateLimiter(t, RateLimitConfig{Rate: 1, MaxKeys: 2})
+
+	limiter.take("a")
+	limiter.take("b")
+	limiter.take("a")
+	limiter.take("c")
+
+	if limiter.buckets.len() != 2 || len(limiter.buckets.items) != 2 {
+		t.Fatalf("Expected 2 buckets, got %d", limiter.buckets.len())
+	}
+	if _, ok := limiter.buckets.items["b"]; ok {
+		t.Error("Expected the least recently used bucket to be evicted")
+	}
+
+	if result := limiter.take("a"); result.allowed {
+		t.Error("Expected a key that was kept to still be limited")
+	}
+
+	// An evicted key starts with a full bucket again
+	if result := limiter.take("b"); !result.allowed {
+		t.Error("Expected an evicted key to be allowed")
+	}
+}
+
+func TestRouteRateLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	pool := newTestPool(t, PoolConfig{Name: "backend", BackendUrls: []string{backend.URL}})
+	router, err := NewRouter([]RouteConfig{
+		{Name: "login", PathPrefix: "/login", Pool: "backend", RateLimit: RateLimitConfig{Rate: 0.1, Burst: 1}},
+		{Name: "default", Pool: "backend"},
+	}, []*Pool{pool})
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	router.limiter, _ = NewRateLimiter(RateLimitConfig{Rate: 100})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+
+	if rr := serve("/login"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the first login to be allowed, got %d", rr.Code)
+	}
+	rr := serve("/login")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the second login to be limited by the route, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("Expected Retry-After 10, got %q", got)
+	}
+
+	rr = serve("/other")
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected other routes to use the global limit, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("RateLimit-Limit"); got != "100" {
+		t.Errorf("Expected the global RateLimit-Limit of 100, got %q", got)
+	}
+}
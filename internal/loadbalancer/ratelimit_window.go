@@ -0,0 +1,283 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// finalSyncTimeout bounds sending the remaining counts to the store on shutdown
+const finalSyncTimeout = 2 * time.Second
+
+// sharedRateLimits turns rate limiters into sliding windows whose counters are shared through a store. Requests are
+// admitted from the local view of the counters and sent to the store in batches.
+type sharedRateLimits struct {
+	store   RateLimitStore
+	config  RateLimitStoreConfig
+	windows []*slidingWindow
+	flush   chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newSharedRateLimits(store RateLimitStore, cfg RateLimitStoreConfig) (*sharedRateLimits, error) {
+	if cfg.Window <= 0 || cfg.SyncInterval <= 0 || cfg.BatchSize <= 0 {
+		return nil, errors.New("rate limit window, sync interval and batch size must be positive")
+	}
+
+	return &sharedRateLimits{
+		store:  store,
+		config: cfg,
+		flush:  make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// share makes the limiter count requests in a shared sliding window, the scope separates the counters of limiters
+func (s *sharedRateLimits) share(l *RateLimiter, scope string) {
+	w := &slidingWindow{
+		prefix:   s.config.Prefix + "/" + scope,
+		limit:    max(1, int64(math.Ceil(l.config.Rate*s.config.Window.Seconds()))),
+		size:     s.config.Window,
+		batch:    int64(s.config.BatchSize),
+		now:      time.Now,
+		flush:    s.flush,
+		counters: newKeyTable[*windowCounter](l.config.MaxKeys),
+	}
+
+	l.window = w
+	s.windows = append(s.windows, w)
+}
+
+// Start syncs the counters with the store until Stop is called
+func (s *sharedRateLimits) Start() {
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(s.config.SyncInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			case <-s.flush:
+			}
+			s.sync(context.Background())
+		}
+	}()
+}
+
+// Stop sends the remaining counts to the store and closes it
+func (s *sharedRateLimits) Stop() error {
+	close(s.stop)
+	<-s.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), finalSyncTimeout)
+	defer cancel()
+	s.sync(ctx)
+
+	return s.store.Close()
+}
+
+func (s *sharedRateLimits) sync(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Window)
+	defer cancel()
+
+	for _, w := range s.windows {
+		if err := w.sync(ctx, s.store); err != nil {
+			slog.Warn("could not sync rate limit counters, limiting with local counts", "error", err)
+		}
+	}
+}
+
+// slidingWindow limits the requests of every client in a sliding window. The count is estimated from the counts of
+// the current and previous window, where the previous window is weighted by the part of it still inside the sliding
+// window.
+type slidingWindow struct {
+	prefix string
+	limit  int64
+	size   time.Duration
+	batch  int64
+	now    func() time.Time
+	flush  chan<- struct{}
+
+	mu       sync.Mutex
+	counters *keyTable[*windowCounter]
+	// late are requests of a window that ended, or whose sync failed, before they were sent to the store
+	late []windowDelta
+}
+
+type windowCounter struct {
+	window int64
+	// current and previous are the shared counts of the window and the window before as of the last sync
+	current  int64
+	previous int64
+	// pending are the requests admitted since the last sync
+	pending int64
+	// active is set when the client made requests since the last sync, so its shared counts are read back
+	active bool
+}
+
+type windowDelta struct {
+	key    string
+	window int64
+	delta  int64
+}
+
+// take counts a request of the key if it fits in the window
+func (w *slidingWindow) take(key string) rateLimitResult {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now().UnixNano()
+	window := now / int64(w.size)
+	elapsed := float64(now%int64(w.size)) / float64(w.size)
+
+	counter, _ := w.counters.get(key, func() *windowCounter { return &windowCounter{window: window} })
+	w.roll(key, counter, window)
+	counter.active = true
+
+	count := counter.current + counter.pending
+	estimate := float64(counter.previous)*(1-elapsed) + float64(count)
+
+	result := rateLimitResult{allowed: estimate+1 <= float64(w.limit), limit: int(w.limit)}
+	if result.allowed {
+		counter.pending++
+		estimate++
+		if counter.pending >= w.batch {
+			select {
+			case w.flush <- struct{}{}:
+			default:
+			}
+		}
+	} else {
+		result.retryAfter = w.retryAfter(counter.previous, count, elapsed)
+	}
+
+	result.remaining = max(0, int(float64(w.limit)-estimate))
+	result.reset = time.Duration((1 - elapsed) * float64(w.size))
+	return result
+}
+
+// roll moves the counter to the given window, requests not yet sent to the store are kept for the next sync
+func (w *slidingWindow) roll(key string, counter *windowCounter, window int64) {
+	if counter.window == window {
+		return
+	}
+
+	if counter.pending > 0 {
+		w.late = append(w.late, windowDelta{key: key, window: counter.window, delta: counter.pending})
+	}
+
+	counter.previous = 0
+	if window == counter.window+1 {
+		counter.previous = counter.current + counter.pending
+	}
+	counter.window, counter.current, counter.pending = window, 0, 0
+}
+
+// retryAfter returns the time until the estimate drops enough to admit another request
+func (w *slidingWindow) retryAfter(previous, count int64, elapsed float64) time.Duration {
+	// The weight of the previous window drops until the requests of this window leave room for another one
+	if room := float64(w.limit - 1 - count); room >= 0 && previous > 0 {
+		return time.Duration((1 - room/float64(previous) - elapsed) * float64(w.size))
+	}
+
+	// Otherwise the requests of this window have to slide out of the next window
+	next := max(0, 1-float64(w.limit-1)/float64(count))
+	return time.Duration((1 - elapsed + next) * float64(w.size))
+}
+
+// sync sends the requests since the last sync to the store and reads back the counts of all replicas
+func (w *slidingWindow) sync(ctx context.Context, store RateLimitStore) error {
+	w.mu.Lock()
+	deltas := w.late
+	w.late = nil
+	w.counters.each(func(key string, counter *windowCounter) {
+		if !counter.active && counter.pending == 0 {
+			return
+		}
+		deltas = append(deltas, windowDelta{key: key, window: counter.window, delta: counter.pending})
+
+		// Until the store answers, the requests of this replica count as shared
+		counter.current += counter.pending
+		counter.pending = 0
+		counter.active = false
+	})
+	w.mu.Unlock()
+
+	// A failing key does not hold up the others, its requests are sent again on the next sync while they still count
+	var failed []windowDelta
+	var errs int
+	var first error
+	for _, d := range deltas {
+		key := w.prefix + "/" + hashKey(d.key)
+		current, previous, err := store.Increment(ctx, windowKey(key, d.window), windowKey(key, d.window-1), d.delta, 2*w.size)
+		if err != nil {
+			if d.delta > 0 {
+				failed = append(failed, d)
+			}
+			errs++
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+
+		w.mu.Lock()
+		if counter, ok := w.counters.lookup(d.key); ok && counter.window == d.window {
+			counter.current, counter.previous = current, previous
+		}
+		w.mu.Unlock()
+	}
+
+	if first == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	window := w.now().UnixNano() / int64(w.size)
+	for _, d := range failed {
+		if d.window >= window-1 {
+			w.late = append(w.late, d)
+		}
+	}
+	w.mu.Unlock()
+	return fmt.Errorf("%d of %d counters: %w", errs, len(deltas), first)
+}
+
+// hashKey hides API keys and other client identifiers from the store
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// windowKey returns the store key of the counter of a window
+func windowKey(key string, window int64) string {
+	return key + "/" + strconv.FormatInt(window, 10)
+}
+
+// splitWindowKey splits a store key into the key and window
+func splitWindowKey(windowKey string) (string, int64, bool) {
+	i := strings.LastIndexByte(windowKey, '/')
+	if i < 0 {
+		return "", 0, false
+	}
+
+	window, err := strconv.ParseInt(windowKey[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return windowKey[:i], window, true
+}
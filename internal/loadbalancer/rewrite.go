@@ -0,0 +1,93 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RewriteConfig changes the path and query of requests before they are proxied. The prefix is replaced first, then
+// the regex substitution is applied to the result.
+type RewriteConfig struct {
+	// Prefix is replaced with ReplacePrefix when the path starts with it, an empty ReplacePrefix strips the prefix
+	Prefix        string `json:"prefix,omitempty"`
+	ReplacePrefix string `json:"replace_prefix,omitempty"`
+	// Regex is replaced with Replacement, which can refer to capture groups as $1 or ${name}
+	Regex       string `json:"regex,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+	// AddQuery appends query parameters, RemoveQuery deletes them before anything is added
+	AddQuery    map[string]string `json:"add_query,omitempty"`
+	RemoveQuery []string          `json:"remove_query,omitempty"`
+}
+
+// pathRewriter is a compiled RewriteConfig
+type pathRewriter struct {
+	config RewriteConfig
+	regex  *regexp.Regexp
+}
+
+// newPathRewriter compiles the config, it returns nil when the config does not change anything
+func newPathRewriter(config RewriteConfig) (*pathRewriter, error) {
+	if config.Prefix == "" && config.Regex == "" && len(config.AddQuery) == 0 && len(config.RemoveQuery) == 0 {
+		if config.ReplacePrefix != "" || config.Replacement != "" {
+			return nil, errors.New("rewrite replacement without prefix or regex")
+		}
+		return nil, nil
+	}
+
+	rw := &pathRewriter{config: config}
+	if config.Regex != "" {
+		var err error
+		if rw.regex, err = regexp.Compile(config.Regex); err != nil {
+			return nil, fmt.Errorf("invalid rewrite regex: %w", err)
+		}
+	}
+	return rw, nil
+}
+
+// rewrite changes the path and query of the URL. Rewritten paths lose their original escaping.
+func (rw *pathRewriter) rewrite(u *url.URL) {
+	path := u.Path
+	if rw.config.Prefix != "" && hasPathPrefix(path, rw.config.Prefix) {
+		path = joinPath(rw.config.ReplacePrefix, path[len(rw.config.Prefix):])
+	}
+	if rw.regex != nil {
+		path = rw.regex.ReplaceAllString(path, rw.config.Replacement)
+	}
+	if path == "" || path[0] != '/' {
+		path = "/" + path
+	}
+
+	if path != u.Path {
+		u.Path = path
+		u.RawPath = ""
+	}
+
+	if len(rw.config.AddQuery) == 0 && len(rw.config.RemoveQuery) == 0 {
+		return
+	}
+
+	query := u.Query()
+	for _, name := range rw.config.RemoveQuery {
+		query.Del(name)
+	}
+	for name, value := range rw.config.AddQuery {
+		query.Add(name, value)
+	}
+	u.RawQuery = query.Encode()
+}
+
+// joinPath joins a prefix and the rest of a path with a single slash
+func joinPath(prefix, rest string) string {
+	switch {
+	case rest == "":
+		return prefix
+	case strings.HasSuffix(prefix, "/") && strings.HasPrefix(rest, "/"):
+		return prefix + rest[1:]
+	case prefix != "" && !strings.HasSuffix(prefix, "/") && !strings.HasPrefix(rest, "/"):
+		return prefix + "/" + rest
+	}
+	return prefix + rest
+}
@@ -0,0 +1,110 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPathRewrite(t *testing.T) {
+	// The backend responds with the request URI it received
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.RequestURI)
+	}))
+	defer backend.Close()
+
+	pool := newTestPool(t, PoolConfig{Name: "backend", BackendUrls: []string{backend.URL}})
+	router, err := NewRouter([]RouteConfig{
+		{Name: "strip", PathPrefix: "/echo/", Pool: "backend", Rewrite: RewriteConfig{Prefix: "/echo/v1"}},
+		{Name: "replace", PathPrefix: "/old/", Pool: "backend", Rewrite: RewriteConfig{Prefix: "/old/", ReplacePrefix: "/new/"}},
+		{
+			Name:       "regex",
+			PathPrefix: "/users/",
+			Pool:       "backend",
+			Rewrite: RewriteConfig{
+				Regex:       `^/users/(?P<id>[0-9]+)/posts/([0-9]+)$`,
+				Replacement: "/authors/${id}/posts/$2",
+			},
+		},
+		{
+			Name:       "query",
+			PathPrefix: "/search",
+			Pool:       "backend",
+			Rewrite: RewriteConfig{
+				Prefix:      "/search",
+				AddQuery:    map[string]string{"source": "lb"},
+				RemoveQuery: []string{"debug"},
+			},
+		},
+		{Name: "default", Pool: "backend"},
+	}, []*Pool{pool})
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		uri      string
+		expected string
+	}{
+		{"Strip prefix", "/echo/v1/status?verbose=1", "/status?verbose=1"},
+		{"Strip whole path", "/echo/v1/", "/"},
+		{"Prefix matches whole segments", "/echo/v1x", "/echo/v1x"},
+		{"Replace prefix", "/old/items/1", "/new/items/1"},
+		{"Regex with capture groups", "/users/42/posts/7", "/authors/42/posts/7"},
+		{"Regex without match", "/users/me", "/users/me"},
+		{"Query parameters", "/search?q=go&debug=1", "/?q=go&source=lb"},
+		{"Other routes are unchanged", "/plain%2Fpath?a=1", "/plain%2Fpath?a=1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.uri, nil))
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", rr.Code)
+			}
+			if got := rr.Body.String(); got != tt.expected {
+				t.Errorf("Expected the backend to receive %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestJoinPath(t *testing.T) {
+	tests := []struct {
+		prefix, rest, expected string
+	}{
+		{"", "/a", "/a"},
+		{"/api/", "/a", "/api/a"},
+		{"/api", "a", "/api/a"},
+		{"/api", "/a", "/api/a"},
+		{"/api", "", "/api"},
+	}
+
+	for _, tt := range tests {
+		if got := joinPath(tt.prefix, tt.rest); got != tt.expected {
+			t.Errorf("joinPath(%q, %q): expected %q, got %q", tt.prefix, tt.rest, tt.expected, got)
+		}
+	}
+
+	if _, err := newPathRewriter(RewriteConfig{ReplacePrefix: "/api"}); err == nil {
+		t.Error("Expected a replacement without prefix to be rejected")
+	}
+	if _, err := newPathRewriter(RewriteConfig{Regex: "("}); err == nil {
+		t.Error("Expected an invalid regex to be rejected")
+	}
+	if rw, err := newPathRewriter(RewriteConfig{}); rw != nil || err != nil {
+		t.Errorf("Expected no rewriter for an empty config, got %v, %v", rw, err)
+	}
+
+	u, _ := url.Parse("/a%2Fb")
+	rw, _ := newPathRewriter(RewriteConfig{Prefix: "/x"})
+	rw.rewrite(u)
+	if u.EscapedPath() != "/a%2Fb" {
+		t.Errorf("Expected the escaping of unchanged paths to be kept, got %q", u.EscapedPath())
+	}
+}
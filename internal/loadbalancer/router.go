@@ -0,0 +1,286 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// RouteConfig maps the requests matching all of its conditions to a pool. Conditions that are not set match any
+// request.
+type RouteConfig struct {
+	Name string `json:"name"`
+	// Host matches the host of the request without port, either exactly or with a leading wildcard as *.example.com
+	Host       string   `json:"host,omitempty"`
+	PathPrefix string   `json:"path_prefix,omitempty"`
+	PathRegex  string   `json:"path_regex,omitempty"`
+	Methods    []string `json:"methods,omitempty"`
+	// Headers must be present with the given value, an empty value only requires the header to be present
+	Headers  map[string]string `json:"headers,omitempty"`
+	Pool     string            `json:"pool"`
+	Timeouts TimeoutConfig     `json:"timeouts"`
+	// RequestHeaders are applied to requests before they are proxied, ResponseHeaders to the responses of the backends
+	RequestHeaders  HeaderRules `json:"request_headers"`
+	ResponseHeaders HeaderRules `json:"response_headers"`
+	// Rewrite changes the path and query sent to the backend, routes always match the original request
+	Rewrite RewriteConfig `json:"rewrite"`
+	// RateLimit replaces the global rate limit for the requests of the route
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	// Auth replaces the global auth policy for the requests of the route
+	Auth *RouteAuthConfig `json:"auth,omitempty"`
+	// IPAccess restricts the clients of the route, in addition to the global IP access lists
+	IPAccess IPAccessConfig `json:"ip_access"`
+	// CORS lets browsers on other origins call the route, preflights are answered without reaching the backends
+	CORS *CORSConfig `json:"cors,omitempty"`
+}
+
+// route is a compiled route
+type route struct {
+	config    RouteConfig
+	pathRegex *regexp.Regexp
+	rewriter  *pathRewriter
+	limiter   *RateLimiter
+	cors      *corsPolicy
+	pool      *Pool
+}
+
+// hasPathPrefix reports whether the path is the prefix or lies below it, /api matches /api and /api/users but not /apix
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// matches reports whether the request meets all conditions of the route
+func (rt *route) matches(r *http.Request) bool {
+	if rt.config.Host != "" && !matchHost(rt.config.Host, r.Host) {
+		return false
+	}
+
+	if !hasPathPrefix(r.URL.Path, rt.config.PathPrefix) {
+		return false
+	}
+
+	if rt.pathRegex != nil && !rt.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+
+	// Preflights are matched by the method of the request they announce
+	method := r.Method
+	if isPreflight(r) {
+		method = r.Header.Get("Access-Control-Request-Method")
+	}
+	if len(rt.config.Methods) > 0 && !slices.Contains(rt.config.Methods, method) {
+		return false
+	}
+
+	for name, value := range rt.config.Headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (value != "" && !slices.Contains(values, value)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchHost compares the host of a request with a configured host that may start with a wildcard label
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	pattern = strings.ToLower(pattern)
+
+	if parent, ok := strings.CutPrefix(pattern, "*."); ok {
+		_, hostParent, found := strings.Cut(host, ".")
+		return found && hostParent == parent
+	}
+	return host == pattern
+}
+
+type routeKey struct{}
+
+func withRoute(ctx context.Context, rt *route) context.Context {
+	return context.WithValue(ctx, routeKey{}, rt)
+}
+
+// routeFrom returns the route the request was matched by, or nil when it was not routed
+func routeFrom(ctx context.Context) *route {
+	rt, _ := ctx.Value(routeKey{}).(*route)
+	return rt
+}
+
+// routeTimeouts returns the timeouts of the route the request was matched by, if any
+func routeTimeouts(ctx context.Context) TimeoutConfig {
+	if rt := routeFrom(ctx); rt != nil {
+		return rt.config.Timeouts
+	}
+	return TimeoutConfig{}
+}
+
+// Router sends every request to the pool of the first route it matches
+type Router struct {
+	routes []*route
+	pools  []*Pool
+	// limiter applies to the routes without a rate limit of their own
+	limiter *RateLimiter
+	// classifier assigns requests to priority classes, all requests share one class when it is nil
+	classifier *priorityClassifier
+	auth       *Authenticator
+	// access checks the client IP of requests, every client is allowed when it is nil
+	access *IPAccessControl
+	// cache answers requests with stored responses, all requests are proxied when it is nil
+	cache *Cache
+}
+
+// NewRouter compiles the routes, every route must refer to one of the pools
+func NewRouter(routes []RouteConfig, pools []*Pool) (*Router, error) {
+	byName := make(map[string]*Pool, len(pools))
+	for _, pool := range pools {
+		if _, ok := byName[pool.Name]; ok {
+			return nil, fmt.Errorf("duplicate pool %q", pool.Name)
+		}
+		byName[pool.Name] = pool
+	}
+
+	// Route names key the IP access rules and rate limit scopes, so they must be unique
+	names := make(map[string]bool, len(routes))
+	router := &Router{pools: pools}
+	for _, config := range routes {
+		if names[config.Name] {
+			return nil, fmt.Errorf("duplicate route %q", config.Name)
+		}
+		names[config.Name] = true
+
+		pool, ok := byName[config.Pool]
+		if !ok {
+			return nil, fmt.Errorf("route %s: unknown pool %q", config.Name, config.Pool)
+		}
+
+		if err := config.Timeouts.validate(); err != nil {
+			return nil, fmt.Errorf("route %s: %w", config.Name, err)
+		}
+
+		var err error
+		rt := &route{config: config, pool: pool}
+		if config.PathRegex != "" {
+			if rt.pathRegex, err = regexp.Compile(config.PathRegex); err != nil {
+				return nil, fmt.Errorf("route %s: invalid path regex: %w", config.Name, err)
+			}
+		}
+
+		if rt.rewriter, err = newPathRewriter(config.Rewrite); err != nil {
+			return nil, fmt.Errorf("route %s: %w", config.Name, err)
+		}
+
+		if rt.limiter, err = NewRateLimiter(config.RateLimit); err != nil {
+			return nil, fmt.Errorf("route %s: invalid rate limit: %w", config.Name, err)
+		}
+
+		if rt.cors, err = newCORSPolicy(config.CORS); err != nil {
+			return nil, fmt.Errorf("route %s: %w", config.Name, err)
+		}
+
+		router.routes = append(router.routes, rt)
+	}
+
+	return router, nil
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if router.access != nil && !router.access.allow(w, r, nil) {
+		return
+	}
+
+	for _, rt := range router.routes {
+		if !rt.matches(r) {
+			continue
+		}
+
+		requestInfoFrom(r.Context()).Route = rt.config.Name
+		if router.access != nil && !router.access.allow(w, r, rt) {
+			return
+		}
+		// Preflights carry no credentials, so they are answered before authentication
+		if rt.cors != nil && !rt.cors.handle(w, r, rt) {
+			return
+		}
+		if router.auth != nil && !router.auth.authorize(w, r, rt) {
+			return
+		}
+		if router.classifier != nil {
+			r = router.classifier.classify(r, rt)
+		}
+
+		limiter := rt.limiter
+		if limiter == nil {
+			limiter = router.limiter
+		}
+		if limiter != nil && !limiter.Allow(w, r) {
+			return
+		}
+
+		r = r.WithContext(withRoute(r.Context(), rt))
+		if router.cache != nil {
+			router.cache.ServeHTTP(w, r, rt, rt.pool.lb)
+		} else {
+			rt.pool.lb.ServeHTTP(w, r)
+		}
+		return
+	}
+
+	http.Error(w, "no route matches the request", http.StatusNotFound)
+}
+
+// useAuthenticator checks the routes against the authenticator and applies it to every request
+func (router *Router) useAuthenticator(auth *Authenticator) error {
+	for _, rt := range router.routes {
+		if rt.config.Auth == nil {
+			continue
+		}
+		if err := auth.validate(*rt.config.Auth); err != nil {
+			return fmt.Errorf("route %s: %w", rt.config.Name, err)
+		}
+	}
+
+	router.auth = auth
+	return nil
+}
+
+// shareRateLimits makes all rate limiters of the router share their counters with the other replicas
+func (router *Router) shareRateLimits(shared *sharedRateLimits) {
+	if router.limiter != nil {
+		shared.share(router.limiter, "global")
+	}
+	for _, rt := range router.routes {
+		if rt.limiter != nil {
+			shared.share(rt.limiter, "route/"+rt.config.Name)
+		}
+	}
+}
+
+// Pools returns the pools of the router
+func (router *Router) Pools() []*Pool {
+	return router.pools
+}
+
+// AvailableBackends returns the number of backends that can receive traffic in the pool that has the fewest, so the
+// load balancer is only ready when it can serve every pool. Shadow pools are left out, clients never depend on them.
+func (router *Router) AvailableBackends() int {
+	available := -1
+	for _, pool := range router.pools {
+		if pool.shadow {
+			continue
+		}
+		if n := pool.lb.AvailableBackends(); available == -1 || n < available {
+			available = n
+		}
+	}
+	return max(available, 0)
+}
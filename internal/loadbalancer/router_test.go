@@ -0,0 +1,150 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/servicediscovery"
+)
+
+// newTestPool creates a started pool that serves the given backend URLs
+func newTestPool(t *testing.T, config PoolConfig) *Pool {
+	t.Helper()
+
+	config = config.withDefaults(time.Second)
+	pool, err := NewPool(config, servicediscovery.NewStaticServiceWatcher(config.BackendUrls), http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+
+	if err := pool.lb.StartServiceWatcher(); err != nil {
+		t.Fatalf("Failed to start service watcher: %v", err)
+	}
+	return pool
+}
+
+func TestRouter(t *testing.T) {
+	newBackend := func(id string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				time.Sleep(200 * time.Millisecond)
+			}
+			w.Header().Set("X-Server-Id", id)
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+
+	api := newBackend("api")
+	defer api.Close()
+	games := newBackend("games")
+	defer games.Close()
+
+	pools := []*Pool{
+		newTestPool(t, PoolConfig{Name: "api", BackendUrls: []string{api.URL}}),
+		newTestPool(t, PoolConfig{Name: "games", BackendUrls: []string{games.URL}}),
+	}
+
+	router, err := NewRouter([]RouteConfig{
+		{Name: "api-host", Host: "api.example.com", Pool: "api"},
+		{Name: "beta", Headers: map[string]string{"X-Beta": "1"}, Pool: "games"},
+		{Name: "games", PathPrefix: "/games/", Methods: []string{http.MethodGet}, Pool: "games"},
+		{Name: "versioned", PathRegex: `^/v[0-9]+/`, Pool: "api"},
+		{Name: "slow", PathPrefix: "/slow", Pool: "api", Timeouts: TimeoutConfig{Total: 50 * time.Millisecond}},
+	}, pools)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		host           string
+		path           string
+		headers        map[string]string
+		expectedStatus int
+		expectedServer string
+		expectedRoute  string
+	}{
+		{name: "Host", host: "API.example.com:8080", path: "/games/1", expectedServer: "api", expectedRoute: "api-host"},
+		{name: "Header", path: "/", headers: map[string]string{"X-Beta": "1"}, expectedServer: "games", expectedRoute: "beta"},
+		{name: "Header with another value", path: "/", headers: map[string]string{"X-Beta": "0"}, expectedStatus: http.StatusNotFound},
+		{name: "Path prefix and method", path: "/games/1", expectedServer: "games", expectedRoute: "games"},
+		{name: "Method mismatch", method: http.MethodPost, path: "/games/1", expectedStatus: http.StatusNotFound},
+		{name: "Path regex", path: "/v2/echo", expectedServer: "api", expectedRoute: "versioned"},
+		{name: "Route timeout", path: "/slow", expectedStatus: http.StatusGatewayTimeout, expectedRoute: "slow"},
+		{name: "No matching route", path: "/unknown", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			req := httptest.NewRequest(method, tt.path, nil)
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			info := &requestInfo{}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req.WithContext(withRequestInfo(req.Context(), info)))
+
+			expectedStatus := tt.expectedStatus
+			if expectedStatus == 0 {
+				expectedStatus = http.StatusOK
+			}
+
+			if rec.Code != expectedStatus || rec.Header().Get("X-Server-Id") != tt.expectedServer {
+				t.Errorf("Unexpected response: %d from %q", rec.Code, rec.Header().Get("X-Server-Id"))
+			}
+
+			if info.Route != tt.expectedRoute {
+				t.Errorf("Unexpected route %q, expected %q", info.Route, tt.expectedRoute)
+			}
+		})
+	}
+
+	t.Run("Ready only when every pool has backends", func(t *testing.T) {
+		if available := router.AvailableBackends(); available != 1 {
+			t.Errorf("Expected 1 available backend, got %d", available)
+		}
+
+		pools[1].lb.SetBackendState(mustParseURL(t, games.URL).Host, BackendDisabled)
+		defer pools[1].lb.SetBackendState(mustParseURL(t, games.URL).Host, BackendActive)
+
+		if available := router.AvailableBackends(); available != 0 {
+			t.Errorf("Expected no available backends, got %d", available)
+		}
+	})
+}
+
+func TestNewRouterValidation(t *testing.T) {
+	pools := []*Pool{{Name: "api"}}
+
+	tests := []struct {
+		name   string
+		routes []RouteConfig
+		pools  []*Pool
+	}{
+		{name: "Unknown pool", routes: []RouteConfig{{Name: "r", Pool: "games"}}, pools: pools},
+		{name: "Invalid regex", routes: []RouteConfig{{Name: "r", PathRegex: "(", Pool: "api"}}, pools: pools},
+		{name: "Negative timeout", routes: []RouteConfig{{Name: "r", Pool: "api", Timeouts: TimeoutConfig{Total: -1}}}, pools: pools},
+		{name: "Duplicate pool", pools: []*Pool{{Name: "api"}, {Name: "api"}}},
+		{name: "Duplicate route", routes: []RouteConfig{{Name: "r", Pool: "api"}, {Name: "r", PathPrefix: "/a", Pool: "api"}}, pools: pools},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRouter(tt.routes, tt.pools); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
@@ -12,72 +12,379 @@ import (
 	"time"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/jeroenpf/coda-homework-assignment/internal/compression"
+	"github.com/jeroenpf/coda-homework-assignment/internal/limits"
+	"github.com/jeroenpf/coda-homework-assignment/internal/requestid"
 	"github.com/jeroenpf/coda-homework-assignment/internal/servicediscovery"
+	"github.com/jeroenpf/coda-homework-assignment/internal/tracing"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/sync/errgroup"
 )
 
 type Config struct {
-	Port                string
-	ReadTimeout         time.Duration
-	WriteTimeout        time.Duration
-	IdleTimeout         time.Duration
-	ShutdownTimeout     time.Duration
+	Port            string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	// ShutdownDelay is how long /readyz reports failure before the listener closes, so upstream balancers can react
+	ShutdownDelay       time.Duration
 	HealthCheckInterval time.Duration
+	// MinHealthyBackends is the number of backends that must be available for /readyz to succeed
+	MinHealthyBackends int
+	// AdminAddr is the address of the admin API listener, it is disabled when empty
+	AdminAddr string
+	// BackendUrls is a static list of backends, when empty the backends are discovered through Consul
+	BackendUrls []string
+	// MirrorBackendUrls are the backends of a shadow pool that receives MirrorPercent of the requests to the
+	// BackendUrls, they are only used when no pools are configured
+	MirrorBackendUrls []string
+	MirrorPercent     float64
+	// Pools and Routes configure routing to several groups of backends. When no pools are configured, all requests are
+	// sent to a single pool of the BackendUrls or the Consul service "backend".
+	Pools  []PoolConfig
+	Routes []RouteConfig
+	// TrustRequestID reuses the X-Request-ID sent by clients instead of always generating a new one
+	TrustRequestID bool
+	Forwarding     ForwardingConfig
+	// IPAccess allows or denies clients by IP on all routes, routes can restrict their clients further
+	IPAccess IPAccessConfig
+	// ConfigFile is the file the pools and routes were loaded from, its IP access lists are reloaded when it changes
+	ConfigFile           string
+	ConfigReloadInterval time.Duration
+	// flagIPAccess are the IP access lists from before the config file was loaded, they apply again when a reloaded
+	// file no longer sets any
+	flagIPAccess IPAccessConfig
+	// Auth authenticates requests before they are proxied
+	Auth AuthConfig
+	// RateLimit limits the request rate of every client on routes without a rate limit of their own
+	RateLimit RateLimitConfig
+	// Concurrency limits the requests in flight to all pools together, pools can set a limit of their own as well
+	Concurrency ConcurrencyConfig
+	// PriorityClasses decide which queued requests get a free slot first when the concurrency limits are reached
+	PriorityClasses []PriorityClass
+	// RateLimitStore shares the rate limit counters between replicas, by default every replica limits on its own
+	RateLimitStore RateLimitStoreConfig
+	// Limits bounds the size of requests and how slowly clients may send them
+	Limits limits.Config
+	// Cache stores cacheable responses of GET requests in memory
+	Cache CacheConfig
+	// Compression compresses responses for clients that accept it and decodes compressed request bodies
+	Compression compression.Config
+	// H2C accepts cleartext HTTP/2 on the plain HTTP listener, HTTP/2 is always offered on the TLS listener
+	H2C       bool
+	TLS       TLSConfig
+	Transport TransportConfig
+	// Timeouts apply to all upstream requests, the timeouts of a route override them and the timeouts of a backend set
+	// through the admin API override both. RouteTimeouts become routes with timeouts when no pools are configured. The
+	// total timeout should stay below WriteTimeout so clients get a 504 instead of a dropped connection.
+	Timeouts      TimeoutConfig
+	RouteTimeouts []RouteTimeoutConfig
+	UpstreamTLS   UpstreamTLSConfig
+	Tracing       tracing.Config
+	AccessLog     AccessLogConfig
 }
 
 func DefaultConfig() Config {
 	return Config{
-		Port:                "8080",
-		ReadTimeout:         15 * time.Second,
-		WriteTimeout:        15 * time.Second,
-		IdleTimeout:         60 * time.Second,
-		ShutdownTimeout:     5 * time.Second,
-		HealthCheckInterval: 15 * time.Second,
+		Port:                 "8080",
+		ReadTimeout:          15 * time.Second,
+		WriteTimeout:         15 * time.Second,
+		IdleTimeout:          60 * time.Second,
+		ShutdownTimeout:      5 * time.Second,
+		ShutdownDelay:        5 * time.Second,
+		HealthCheckInterval:  15 * time.Second,
+		MinHealthyBackends:   1,
+		AdminAddr:            "127.0.0.1:9080",
+		ConfigReloadInterval: 5 * time.Second,
+		TLS:                  DefaultTLSConfig(),
+		Transport:            DefaultTransportConfig(),
+		Timeouts:             TimeoutConfig{Total: 10 * time.Second},
+		RateLimitStore:       DefaultRateLimitStoreConfig(),
+		Limits:               limits.DefaultConfig(),
+		Cache:                DefaultCacheConfig(),
+		Compression:          compression.DefaultConfig(),
+		Tracing:              tracing.DefaultConfig("loadbalancer"),
+		AccessLog:            DefaultAccessLogConfig(),
 	}
 }
 
 type Server struct {
-	config Config
-	srv    *http.Server
-	lb     *LoadBalancer
+	config    Config
+	srv       *http.Server
+	tlsSrv    *http.Server
+	certStore *CertStore
+	admin     *http.Server
+	router    *Router
+	access    *IPAccessControl
+	// transports are the shared upstream transport followed by those of the pools with their own upstream TLS
+	transports []*UpstreamTransport
+	probes     *Probes
+	accessLog  *AccessLogger
+	// rateLimits is nil unless the rate limit counters are shared with other replicas
+	rateLimits *sharedRateLimits
 }
 
 // NewServer creates a new serve
 func NewServer(config Config) (*Server, error) {
-	consulConfig := api.DefaultConfig()
-	consulConfig.Address = "localhost:8500"
+	transport, err := newUpstreamTransport(config.Transport, config.UpstreamTLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream transport config: %w", err)
+	}
 
-	consulClient, err := api.NewClient(consulConfig)
+	if len(config.Pools) > 0 && len(config.RouteTimeouts) > 0 {
+		return nil, errors.New("route timeouts by path prefix only apply without pools, set the timeouts of the routes instead")
+	}
+
+	poolConfigs, routeConfigs := config.routing()
+
+	limiter, err := NewConcurrencyLimiter(config.Concurrency)
 	if err != nil {
-		return nil, fmt.Errorf("could not create consul client: %w", err)
+		return nil, fmt.Errorf("invalid concurrency: %w", err)
+	}
+
+	metrics := NewMetrics()
+	limiter.instrument("global", metrics)
+
+	transports := []*UpstreamTransport{transport}
+	pools := make([]*Pool, 0, len(poolConfigs))
+	for _, poolConfig := range poolConfigs {
+		poolConfig = poolConfig.withDefaults(config.HealthCheckInterval)
+
+		watcher, err := newServiceWatcher(poolConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		poolTransport := transport
+		if poolConfig.UpstreamTLS != nil {
+			if poolTransport, err = newUpstreamTransport(config.Transport, *poolConfig.UpstreamTLS); err != nil {
+				return nil, fmt.Errorf("pool %s: invalid upstream tls: %w", poolConfig.Name, err)
+			}
+			transports = append(transports, poolTransport)
+		}
+
+		pool, err := NewPool(poolConfig, watcher, poolTransport)
+		if err != nil {
+			return nil, err
+		}
+		pool.lb.timeouts = config.Timeouts
+		pool.limiter.instrument(pool.Name, metrics)
+		if limiter != nil {
+			pool.lb.limiters = append(pool.lb.limiters, limiter)
+		}
+		pools = append(pools, pool)
+	}
+
+	if err := linkMirrors(pools, metrics); err != nil {
+		return nil, fmt.Errorf("invalid mirror: %w", err)
 	}
 
-	watcher := servicediscovery.NewConsulServiceWatcher(consulClient)
-	lb := NewLoadBalancer(watcher, "backend")
+	router, err := NewRouter(routeConfigs, pools)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routes: %w", err)
+	}
+
+	if router.limiter, err = NewRateLimiter(config.RateLimit); err != nil {
+		return nil, fmt.Errorf("invalid rate limit: %w", err)
+	}
+
+	if router.access, err = NewIPAccessControl(config.IPAccess, routeConfigs); err != nil {
+		return nil, fmt.Errorf("invalid ip access config: %w", err)
+	}
+
+	auth, err := NewAuthenticator(config.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth config: %w", err)
+	}
+	if err := router.useAuthenticator(auth); err != nil {
+		return nil, fmt.Errorf("invalid auth config: %w", err)
+	}
+
+	if router.classifier, err = newPriorityClassifier(config.PriorityClasses); err != nil {
+		return nil, fmt.Errorf("invalid priority classes: %w", err)
+	}
+
+	if config.Cache.Enabled {
+		router.cache = NewCache(config.Cache, metrics)
+		router.cache.credentialHeaders = []string{"Authorization", auth.config.APIKeyHeader}
+	}
+
+	var rateLimits *sharedRateLimits
+	rateLimitStore, err := NewRateLimitStore(config.RateLimitStore)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit store: %w", err)
+	}
+	if rateLimitStore != nil {
+		if rateLimits, err = newSharedRateLimits(rateLimitStore, config.RateLimitStore); err != nil {
+			return nil, fmt.Errorf("invalid rate limit store: %w", err)
+		}
+		router.shareRateLimits(rateLimits)
+	}
+
+	forwarding, err := NewForwarding(config.Forwarding)
+	if err != nil {
+		return nil, fmt.Errorf("invalid forwarding config: %w", err)
+	}
+
+	if err := config.Compression.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid compression config: %w", err)
+	}
+
+	handler := compression.Middleware(config.Compression, router)
+	var accessLog *AccessLogger
+	if config.AccessLog.Enabled {
+		accessLog, err = NewAccessLogger(config.AccessLog)
+		if err != nil {
+			return nil, fmt.Errorf("could not create access log: %w", err)
+		}
+		handler = accessLog.Middleware(handler)
+	}
+	handler = forwarding.Middleware(handler)
+	handler = requestid.Middleware(config.TrustRequestID, handler)
+
+	// The probes are answered by the load balancer itself, everything else is proxied
+	probes := NewProbes(router, config.MinHealthyBackends)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", probes.Liveness)
+	mux.HandleFunc("GET /readyz", probes.Readiness)
+	mux.Handle("/", handler)
+	root := limits.Middleware(config.Limits, mux)
 
 	srv := &http.Server{
-		Addr:         ":" + config.Port,
-		ReadTimeout:  config.ReadTimeout,
-		WriteTimeout: config.WriteTimeout,
-		IdleTimeout:  config.IdleTimeout,
-		Handler:      lb,
+		Addr:           ":" + config.Port,
+		ReadTimeout:    config.ReadTimeout,
+		WriteTimeout:   config.WriteTimeout,
+		IdleTimeout:    config.IdleTimeout,
+		MaxHeaderBytes: config.Limits.MaxHeaderBytes,
+		Handler:        root,
+	}
+
+	// Registering the HTTP/2 server with the HTTP server lets a graceful shutdown close the h2c connections as well
+	if config.H2C {
+		h2s := &http2.Server{IdleTimeout: config.IdleTimeout}
+		if err := http2.ConfigureServer(srv, h2s); err != nil {
+			return nil, fmt.Errorf("could not enable h2c: %w", err)
+		}
+		srv.Handler = h2c.NewHandler(root, h2s)
+	}
+
+	// The HTTPS listener serves the same handler as the plain HTTP listener
+	var tlsSrv *http.Server
+	var certStore *CertStore
+	if config.TLS.Port != "" {
+		certStore, err = NewCertStore(config.TLS.Certificates)
+		if err != nil {
+			return nil, fmt.Errorf("could not load certificates: %w", err)
+		}
+
+		tlsConfig, err := NewServerTLSConfig(config.TLS, certStore)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls config: %w", err)
+		}
+
+		tlsSrv = &http.Server{
+			Addr:           ":" + config.TLS.Port,
+			ReadTimeout:    config.ReadTimeout,
+			WriteTimeout:   config.WriteTimeout,
+			IdleTimeout:    config.IdleTimeout,
+			MaxHeaderBytes: config.Limits.MaxHeaderBytes,
+			Handler:        root,
+			TLSConfig:      tlsConfig,
+		}
+
+		if err := http2.ConfigureServer(tlsSrv, &http2.Server{IdleTimeout: config.IdleTimeout}); err != nil {
+			return nil, fmt.Errorf("could not enable http/2: %w", err)
+		}
+	}
+
+	var admin *http.Server
+	if config.AdminAddr != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("GET /metrics", metrics.Handler())
+		adminMux.Handle("/", NewAdminHandler(pools, config))
+
+		admin = &http.Server{
+			Addr:           config.AdminAddr,
+			ReadTimeout:    config.ReadTimeout,
+			WriteTimeout:   config.WriteTimeout,
+			MaxHeaderBytes: config.Limits.MaxHeaderBytes,
+			Handler:        limits.Middleware(config.Limits, adminMux),
+		}
 	}
 
 	return &Server{
-		config: config,
-		srv:    srv,
-		lb:     lb,
+		config:     config,
+		srv:        srv,
+		tlsSrv:     tlsSrv,
+		certStore:  certStore,
+		admin:      admin,
+		router:     router,
+		access:     router.access,
+		transports: transports,
+		probes:     probes,
+		accessLog:  accessLog,
+		rateLimits: rateLimits,
 	}, nil
 }
 
+// routing returns the configured pools and routes, or a single pool that receives all requests when there are none. The
+// single pool gets a route for every route timeout in front of its default route.
+func (config Config) routing() ([]PoolConfig, []RouteConfig) {
+	if len(config.Pools) > 0 {
+		return config.Pools, config.Routes
+	}
+
+	pool := PoolConfig{Name: "backend", BackendUrls: config.BackendUrls}
+	pools := []PoolConfig{pool}
+	if len(config.MirrorBackendUrls) > 0 {
+		pools[0].Mirror = &MirrorConfig{Pool: "shadow", Percent: config.MirrorPercent}
+		pools = append(pools, PoolConfig{Name: "shadow", BackendUrls: config.MirrorBackendUrls})
+	}
+	routes := append(timeoutRoutes(pool.Name, config.RouteTimeouts), RouteConfig{Name: "default", Pool: pool.Name})
+	return pools, routes
+}
+
+func newServiceWatcher(pool PoolConfig) (servicediscovery.ServiceWatcher, error) {
+	if len(pool.BackendUrls) > 0 {
+		return servicediscovery.NewStaticServiceWatcher(pool.BackendUrls), nil
+	}
+
+	consulConfig := api.DefaultConfig()
+	consulConfig.Address = "localhost:8500"
+
+	consulClient, err := api.NewClient(consulConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not create consul client: %w", err)
+	}
+
+	return servicediscovery.NewConsulServiceWatcher(consulClient), nil
+}
+
 // Start starts the server
 func (s *Server) Start(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	g, ctx := errgroup.WithContext(ctx)
 
-	if err := s.lb.StartServiceWatcher(); err != nil {
-		return fmt.Errorf("could not start service watcher: %w", err)
+	shutdownTracing, err := tracing.Setup(ctx, s.config.Tracing)
+	if err != nil {
+		return fmt.Errorf("could not set up tracing: %w", err)
+	}
+
+	for _, pool := range s.router.Pools() {
+		if err := pool.Start(); err != nil {
+			return fmt.Errorf("could not start pool: %w", err)
+		}
+	}
+
+	if s.rateLimits != nil {
+		s.rateLimits.Start()
+	}
+
+	if s.config.ConfigFile != "" && s.config.ConfigReloadInterval > 0 {
+		go s.access.Watch(ctx, s.config, s.config.ConfigReloadInterval)
 	}
 
 	// Starting the HTTP server
@@ -89,6 +396,30 @@ func (s *Server) Start(ctx context.Context) error {
 		return nil
 	})
 
+	// Starting the HTTPS server, certificates are provided by the cert store
+	if s.tlsSrv != nil {
+		go s.certStore.Watch(ctx, s.config.TLS.ReloadInterval)
+
+		g.Go(func() error {
+			slog.Info("starting tls listener", "addr", s.tlsSrv.Addr)
+			if err := s.tlsSrv.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return fmt.Errorf("tls server failed to start: %w", err)
+			}
+			return nil
+		})
+	}
+
+	// Starting the admin API
+	if s.admin != nil {
+		g.Go(func() error {
+			slog.Info("starting admin api", "addr", s.admin.Addr)
+			if err := s.admin.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return fmt.Errorf("admin server failed to start: %w", err)
+			}
+			return nil
+		})
+	}
+
 	// Handle shutdown signals
 	g.Go(func() error {
 		sigs := make(chan os.Signal, 1)
@@ -102,9 +433,18 @@ func (s *Server) Start(ctx context.Context) error {
 			slog.Info("Context cancelled")
 		}
 
-		// Stop the service serviceWatcher
-		if err := s.lb.StopServiceWatcher(); err != nil {
-			slog.Error("failed to stop load balancer", "error", err)
+		// Fail readiness while still serving traffic, so upstream balancers stop sending requests first
+		s.probes.ShuttingDown()
+		if s.config.ShutdownDelay > 0 {
+			slog.Info("delaying shutdown until upstream balancers noticed", "delay", s.config.ShutdownDelay)
+			time.Sleep(s.config.ShutdownDelay)
+		}
+
+		// Stop discovering and checking backends
+		for _, pool := range s.router.Pools() {
+			if err := pool.Stop(); err != nil {
+				slog.Error("failed to stop pool", "error", err)
+			}
 		}
 
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
@@ -113,11 +453,45 @@ func (s *Server) Start(ctx context.Context) error {
 			return fmt.Errorf("server failed to shutdown: %v", err)
 		}
 
+		if s.tlsSrv != nil {
+			if err := s.tlsSrv.Shutdown(shutdownCtx); err != nil {
+				return fmt.Errorf("tls server failed to shutdown: %v", err)
+			}
+		}
+
+		if s.admin != nil {
+			if err := s.admin.Shutdown(shutdownCtx); err != nil {
+				return fmt.Errorf("admin server failed to shutdown: %v", err)
+			}
+		}
+
+		for _, transport := range s.transports {
+			transport.CloseIdleConnections()
+		}
+
+		// Send the requests counted since the last sync to the shared rate limit store
+		if s.rateLimits != nil {
+			if err := s.rateLimits.Stop(); err != nil {
+				slog.Error("failed to close rate limit store", "error", err)
+			}
+		}
+
+		// Flush the spans of the requests that completed during shutdown
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			slog.Error("failed to shutdown tracing", "error", err)
+		}
+
+		if s.accessLog != nil {
+			if err := s.accessLog.Close(); err != nil {
+				slog.Error("failed to close access log", "error", err)
+			}
+		}
+
 		slog.Info("Server shutdown completed")
 		return nil
 	})
 
-	err := g.Wait()
+	err = g.Wait()
 	slog.Info("Server fully stopped - all goroutines cleaned up")
 	return err
 }
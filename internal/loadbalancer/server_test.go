@@ -8,6 +8,8 @@ import (
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/requestid"
 )
 
 func TestServer(t *testing.T) {
@@ -26,6 +28,7 @@ func TestServer(t *testing.T) {
 	t.Run("Server starts and shuts dowwn gracefully", func(t *testing.T) {
 		config := DefaultConfig()
 		config.Port = "8099"
+		config.ShutdownDelay = 0
 		config.BackendUrls = []string{backend1.URL, backend2.URL}
 
 		srv, err := NewServer(config)
@@ -51,7 +54,56 @@ func TestServer(t *testing.T) {
 			resp.Body.Close()
 		}
 
+		// The load balancer answers its own health check instead of proxying it
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Server-Id") != "" {
+			t.Errorf("Unexpected healthz response: %d %v", resp.StatusCode, resp.Header)
+		}
+
+		cancel()
+
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Fatalf("Failed to stop server: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Failed to stop server within timeout")
+		}
+	})
+
+	t.Run("Readiness fails during graceful shutdown", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Port = "8099"
+		config.ShutdownDelay = 500 * time.Millisecond
+		config.BackendUrls = []string{backend1.URL, backend2.URL}
+
+		srv, err := NewServer(config)
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- srv.Start(ctx)
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+
+		if status := getStatus(t, "http://localhost:8099/readyz"); status != http.StatusOK {
+			t.Errorf("Expected ready before shutdown, got %d", status)
+		}
+
 		cancel()
+		time.Sleep(100 * time.Millisecond)
+
+		if status := getStatus(t, "http://localhost:8099/readyz"); status != http.StatusServiceUnavailable {
+			t.Errorf("Expected not ready during shutdown, got %d", status)
+		}
+
+		if status := getStatus(t, "http://localhost:8099/healthz"); status != http.StatusOK {
+			t.Errorf("Expected live during shutdown, got %d", status)
+		}
 
 		select {
 		case err := <-errCh:
@@ -66,6 +118,7 @@ func TestServer(t *testing.T) {
 	t.Run("Handle shutdown signals", func(t *testing.T) {
 		config := DefaultConfig()
 		config.Port = "8099"
+		config.ShutdownDelay = 0
 		config.BackendUrls = []string{backend1.URL, backend2.URL}
 
 		srv, err := NewServer(config)
@@ -101,3 +154,45 @@ func TestServer(t *testing.T) {
 		}
 	})
 }
+
+func getStatus(t *testing.T, url string) int {
+	t.Helper()
+
+	// Avoid spare keep-alive connections that would delay the graceful shutdown of the server
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to get %s: %v", url, err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestServerRequestID(t *testing.T) {
+	// Like the API server, the backend returns the request ID it was sent
+	backend := httptest.NewServer(requestid.Middleware(true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	defer backend.Close()
+
+	config := DefaultConfig()
+	config.AdminAddr = ""
+	config.AccessLog.Enabled = false
+	config.BackendUrls = []string{backend.URL}
+	srv, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	lb := srv.router.Pools()[0].lb
+	if err := lb.StartServiceWatcher(); err != nil {
+		t.Fatalf("Failed to discover backends: %v", err)
+	}
+	defer lb.StopServiceWatcher()
+
+	rr := httptest.NewRecorder()
+	srv.srv.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if ids := rr.Header().Values(requestid.Header); rr.Code != http.StatusOK || len(ids) != 1 || ids[0] == "" {
+		t.Errorf("Expected a single request ID, got %d %v", rr.Code, ids)
+	}
+}
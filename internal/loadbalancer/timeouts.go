@@ -0,0 +1,198 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptrace"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TimeoutConfig limits the phases of an upstream request, zero disables a limit
+type TimeoutConfig struct {
+	// Connect limits the time to obtain a connection, including waiting for a free connection to the backend
+	Connect time.Duration
+	// FirstByte limits the time between sending the request and receiving the first byte of the response
+	FirstByte time.Duration
+	// Total limits the whole upstream request including the response body
+	Total time.Duration
+}
+
+// RouteTimeoutConfig overrides the timeouts of requests below PathPrefix. It is a shorthand for a route with timeouts
+// when the load balancer runs without pools, see timeoutRoutes.
+type RouteTimeoutConfig struct {
+	PathPrefix string
+	Timeouts   TimeoutConfig
+}
+
+// merge returns the timeouts with the non-zero values of override applied
+func (c TimeoutConfig) merge(override TimeoutConfig) TimeoutConfig {
+	if override.Connect > 0 {
+		c.Connect = override.Connect
+	}
+	if override.FirstByte > 0 {
+		c.FirstByte = override.FirstByte
+	}
+	if override.Total > 0 {
+		c.Total = override.Total
+	}
+	return c
+}
+
+func (c TimeoutConfig) validate() error {
+	if c.Connect < 0 || c.FirstByte < 0 || c.Total < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	return nil
+}
+
+// timeoutJSON shows timeouts as duration strings such as "1.5s" in the admin API
+type timeoutJSON struct {
+	Connect   string `json:"connect,omitempty"`
+	FirstByte string `json:"first_byte,omitempty"`
+	Total     string `json:"total,omitempty"`
+}
+
+func (c TimeoutConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(timeoutJSON{
+		Connect:   formatDuration(c.Connect),
+		FirstByte: formatDuration(c.FirstByte),
+		Total:     formatDuration(c.Total),
+	})
+}
+
+func (c *TimeoutConfig) UnmarshalJSON(data []byte) error {
+	var raw timeoutJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	var err error
+	if c.Connect, err = parseDuration("connect timeout", raw.Connect); err != nil {
+		return err
+	}
+	if c.FirstByte, err = parseDuration("first_byte timeout", raw.FirstByte); err != nil {
+		return err
+	}
+	if c.Total, err = parseDuration("total timeout", raw.Total); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ParseRouteTimeout parses a route timeout in the form /prefix:total=5s,first_byte=2s,connect=500ms
+func ParseRouteTimeout(value string) (RouteTimeoutConfig, error) {
+	prefix, settings, ok := strings.Cut(value, ":")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return RouteTimeoutConfig{}, fmt.Errorf("expected /prefix:total=5s,first_byte=2s,connect=500ms, got %q", value)
+	}
+
+	route := RouteTimeoutConfig{PathPrefix: prefix}
+	for _, setting := range strings.Split(settings, ",") {
+		name, raw, _ := strings.Cut(setting, "=")
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return RouteTimeoutConfig{}, fmt.Errorf("invalid %s timeout: %w", name, err)
+		}
+
+		switch name {
+		case "connect":
+			route.Timeouts.Connect = d
+		case "first_byte":
+			route.Timeouts.FirstByte = d
+		case "total":
+			route.Timeouts.Total = d
+		default:
+			return RouteTimeoutConfig{}, fmt.Errorf("unknown timeout %q", name)
+		}
+	}
+
+	return route, route.Timeouts.validate()
+}
+
+// timeoutRoutes turns the route timeouts into routes to the pool, the longest prefix comes first so it wins
+func timeoutRoutes(pool string, timeouts []RouteTimeoutConfig) []RouteConfig {
+	sorted := slices.Clone(timeouts)
+	slices.SortStableFunc(sorted, func(a, b RouteTimeoutConfig) int {
+		return len(b.PathPrefix) - len(a.PathPrefix)
+	})
+
+	routes := make([]RouteConfig, 0, len(sorted))
+	for _, timeout := range sorted {
+		routes = append(routes, RouteConfig{
+			Name:       "timeout " + timeout.PathPrefix,
+			PathPrefix: timeout.PathPrefix,
+			Pool:       pool,
+			Timeouts:   timeout.Timeouts,
+		})
+	}
+	return routes
+}
+
+// upstreamTimeoutError is the cancellation cause of a request that ran out of time in one of its phases
+type upstreamTimeoutError struct {
+	phase   string
+	timeout time.Duration
+}
+
+func (e *upstreamTimeoutError) Error() string {
+	return fmt.Sprintf("upstream %s timeout of %s exceeded", e.phase, e.timeout)
+}
+
+// withUpstreamTimeouts returns a context that is cancelled when one of the timeouts expires. The total timeout sets
+// the deadline of the context, so it is propagated to the backend. The returned function releases the timers.
+func withUpstreamTimeouts(ctx context.Context, cfg TimeoutConfig) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	cancelTotal := func() {}
+	if cfg.Total > 0 {
+		ctx, cancelTotal = context.WithTimeoutCause(ctx, cfg.Total, &upstreamTimeoutError{phase: "total", timeout: cfg.Total})
+	}
+
+	var mu sync.Mutex
+	var timers []*time.Timer
+	start := func(timer **time.Timer, timeout time.Duration, phase string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		*timer = time.AfterFunc(timeout, func() {
+			cancel(&upstreamTimeoutError{phase: phase, timeout: timeout})
+		})
+		timers = append(timers, *timer)
+	}
+	stop := func(timer **time.Timer) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if *timer != nil {
+			(*timer).Stop()
+		}
+	}
+
+	// The connect and first byte phases are timed with the events of the transport
+	trace := &httptrace.ClientTrace{}
+	if cfg.Connect > 0 {
+		var connect *time.Timer
+		trace.GetConn = func(string) { start(&connect, cfg.Connect, "connect") }
+		trace.GotConn = func(httptrace.GotConnInfo) { stop(&connect) }
+	}
+	if cfg.FirstByte > 0 {
+		var firstByte *time.Timer
+		trace.WroteRequest = func(httptrace.WroteRequestInfo) { start(&firstByte, cfg.FirstByte, "first byte") }
+		trace.GotFirstResponseByte = func() { stop(&firstByte) }
+	}
+
+	return httptrace.WithClientTrace(ctx, trace), func() {
+		mu.Lock()
+		for _, timer := range timers {
+			timer.Stop()
+		}
+		mu.Unlock()
+
+		cancelTotal()
+		cancel(nil)
+	}
+}
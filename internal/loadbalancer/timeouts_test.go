@@ -0,0 +1,208 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/deadline"
+	"github.com/jeroenpf/coda-homework-assignment/internal/servicediscovery"
+)
+
+func TestUpstreamTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Received-Timeout", r.Header.Get(deadline.Header))
+
+		// Slow requests wait before sending the response headers, or until the load balancer gives up
+		if r.URL.Path == "/slow" {
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	cfg := DefaultTransportConfig()
+	cfg.MaxConnsPerHost = 1
+	transport, err := newUpstreamTransport(cfg, UpstreamTLSConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+
+	lb := NewLoadBalancer(servicediscovery.NewStaticServiceWatcher([]string{backend.URL}), "backend", transport)
+	if err := lb.StartServiceWatcher(); err != nil {
+		t.Fatalf("Failed to start service watcher: %v", err)
+	}
+
+	serveRoute := func(path string, rt *route) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if rt != nil {
+			req = req.WithContext(withRoute(req.Context(), rt))
+		}
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec
+	}
+	serve := func(path string) *httptest.ResponseRecorder {
+		return serveRoute(path, nil)
+	}
+
+	t.Run("Remaining time is propagated to the backend", func(t *testing.T) {
+		lb.timeouts = TimeoutConfig{Total: 2 * time.Second}
+
+		rec := serve("/")
+		received, err := strconv.Atoi(rec.Header().Get("X-Received-Timeout"))
+		if rec.Code != http.StatusOK || err != nil || received <= 1000 || received > 2000 {
+			t.Errorf("Unexpected response: %d with timeout %q", rec.Code, rec.Header().Get("X-Received-Timeout"))
+		}
+	})
+
+	t.Run("No header without a deadline", func(t *testing.T) {
+		lb.timeouts = TimeoutConfig{}
+
+		if rec := serve("/"); rec.Header().Get("X-Received-Timeout") != "" {
+			t.Errorf("Unexpected timeout header %q", rec.Header().Get("X-Received-Timeout"))
+		}
+	})
+
+	tests := []struct {
+		name          string
+		timeouts      TimeoutConfig
+		route         TimeoutConfig
+		path          string
+		expectedPhase string
+	}{
+		{
+			name:          "Total timeout",
+			timeouts:      TimeoutConfig{Total: 50 * time.Millisecond},
+			path:          "/slow",
+			expectedPhase: "total",
+		},
+		{
+			name:          "First byte timeout",
+			timeouts:      TimeoutConfig{FirstByte: 50 * time.Millisecond, Total: time.Second},
+			path:          "/slow",
+			expectedPhase: "first byte",
+		},
+		{
+			name:          "Route timeout overrides the default",
+			timeouts:      TimeoutConfig{Total: time.Second},
+			route:         TimeoutConfig{Total: 50 * time.Millisecond},
+			path:          "/slow",
+			expectedPhase: "total",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb.timeouts = tt.timeouts
+
+			start := time.Now()
+			rec := serveRoute(tt.path, &route{config: RouteConfig{Timeouts: tt.route}})
+
+			if rec.Code != http.StatusGatewayTimeout || !strings.Contains(rec.Body.String(), tt.expectedPhase+" timeout") {
+				t.Errorf("Unexpected response: %d %q", rec.Code, rec.Body.String())
+			}
+
+			if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+				t.Errorf("Request was not cut short: %s", elapsed)
+			}
+		})
+	}
+
+	t.Run("Connect timeout while waiting for a free connection", func(t *testing.T) {
+		lb.timeouts = TimeoutConfig{Connect: 50 * time.Millisecond}
+
+		// The only connection is busy with a slow request
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			serve("/slow")
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		rec := serve("/")
+		if rec.Code != http.StatusGatewayTimeout || !strings.Contains(rec.Body.String(), "connect timeout") {
+			t.Errorf("Unexpected response: %d %q", rec.Code, rec.Body.String())
+		}
+		<-done
+	})
+
+	t.Run("Backend timeouts override the route", func(t *testing.T) {
+		lb.timeouts = TimeoutConfig{Total: time.Second}
+
+		id := mustParseURL(t, backend.URL).Host
+		if _, err := lb.SetBackendTimeouts(id, TimeoutConfig{Total: 50 * time.Millisecond}); err != nil {
+			t.Fatalf("SetBackendTimeouts() error = %v", err)
+		}
+		defer lb.SetBackendTimeouts(id, TimeoutConfig{})
+
+		if rec := serve("/slow"); rec.Code != http.StatusGatewayTimeout {
+			t.Errorf("Expected a gateway timeout, got %d", rec.Code)
+		}
+
+		if _, err := lb.SetBackendTimeouts(id, TimeoutConfig{Total: -time.Second}); err == nil {
+			t.Error("Expected negative timeouts to be rejected")
+		}
+	})
+}
+
+func TestParseRouteTimeout(t *testing.T) {
+	route, err := ParseRouteTimeout("/reports:total=30s,first_byte=10s,connect=500ms")
+	if err != nil {
+		t.Fatalf("ParseRouteTimeout() error = %v", err)
+	}
+
+	expected := RouteTimeoutConfig{
+		PathPrefix: "/reports",
+		Timeouts:   TimeoutConfig{Connect: 500 * time.Millisecond, FirstByte: 10 * time.Second, Total: 30 * time.Second},
+	}
+	if route != expected {
+		t.Errorf("Unexpected route timeout %+v", route)
+	}
+
+	for _, invalid := range []string{"reports:total=1s", "/reports", "/reports:total=soon", "/reports:idle=1s", "/reports:total=-1s"} {
+		if _, err := ParseRouteTimeout(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestTimeoutRoutes(t *testing.T) {
+	config := DefaultConfig()
+	config.RouteTimeouts = []RouteTimeoutConfig{
+		{PathPrefix: "/api", Timeouts: TimeoutConfig{Total: time.Second}},
+		{PathPrefix: "/api/reports", Timeouts: TimeoutConfig{Total: time.Minute}},
+	}
+
+	pool := newTestPool(t, PoolConfig{Name: "backend", BackendUrls: []string{"http://127.0.0.1:1"}})
+	_, routes := config.routing()
+	router, err := NewRouter(routes, []*Pool{pool})
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	tests := map[string]time.Duration{
+		"/api":                time.Second,
+		"/api/users":          time.Second,
+		"/api/reports/weekly": time.Minute,
+		"/apix":               0,
+		"/":                   0,
+	}
+	for path, expected := range tests {
+		for _, rt := range router.routes {
+			if rt.matches(httptest.NewRequest(http.MethodGet, path, nil)) {
+				if rt.config.Timeouts.Total != expected {
+					t.Errorf("%s: expected a total timeout of %s, got %s from route %q", path, expected, rt.config.Timeouts.Total, rt.config.Name)
+				}
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type CertificateConfig struct {
+	CertFile string
+	KeyFile  string
+}
+
+type TLSConfig struct {
+	// Port is the port of the HTTPS listener, it is disabled when empty
+	Port string
+	// Certificates are selected by SNI, the first one is used when no other certificate matches
+	Certificates []CertificateConfig
+	// MinVersion is one of "1.0", "1.1", "1.2" or "1.3"
+	MinVersion string
+	// CipherSuites restricts the TLS 1.0-1.2 cipher suites by their IANA name, the Go defaults are used when empty
+	CipherSuites []string
+	// ReloadInterval is how often the certificate files are checked for changes
+	ReloadInterval time.Duration
+}
+
+func DefaultTLSConfig() TLSConfig {
+	return TLSConfig{
+		MinVersion:     "1.2",
+		ReloadInterval: 30 * time.Second,
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewServerTLSConfig creates the TLS configuration of the HTTPS listener, certificates are served from the store
+func NewServerTLSConfig(cfg TLSConfig, store *CertStore) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[cfg.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q", cfg.MinVersion)
+	}
+
+	cipherSuites, err := parseCipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		GetCertificate: store.GetCertificate,
+	}, nil
+}
+
+// parseCipherSuites maps cipher suite names to their IDs, insecure cipher suites are rejected
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// CertStore holds the certificates of the HTTPS listener and reloads them when their files change
+type CertStore struct {
+	files []CertificateConfig
+
+	mu        sync.RWMutex
+	fallback  *tls.Certificate
+	names     map[string]*tls.Certificate
+	wildcards map[string]*tls.Certificate
+	modTimes  map[string]time.Time
+}
+
+// NewCertStore loads the given certificates
+func NewCertStore(files []CertificateConfig) (*CertStore, error) {
+	if len(files) == 0 {
+		return nil, errors.New("at least one certificate is required")
+	}
+
+	store := &CertStore{files: files}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// GetCertificate selects the certificate for the server name of the client, it is used as tls.Config.GetCertificate
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.names[name]; ok {
+		return cert, nil
+	}
+
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := s.wildcards[parent]; ok {
+			return cert, nil
+		}
+	}
+
+	return s.fallback, nil
+}
+
+// Watch reloads the certificates whenever one of the files changes, until the context is cancelled
+func (s *CertStore) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+
+			// Keep serving the current certificates when the new ones are invalid, e.g. halfway through a renewal
+			if err := s.load(); err != nil {
+				slog.Error("failed to reload certificates", "error", err)
+				continue
+			}
+			slog.Info("reloaded certificates")
+		}
+	}
+}
+
+// changed reports whether any certificate file was modified since it was loaded
+func (s *CertStore) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for path, loaded := range s.modTimes {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(loaded) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// load reads all certificate files and indexes the certificates by the names they are valid for
+func (s *CertStore) load() error {
+	names := make(map[string]*tls.Certificate)
+	wildcards := make(map[string]*tls.Certificate)
+	modTimes := make(map[string]time.Time)
+	var fallback *tls.Certificate
+
+	for _, file := range s.files {
+		for _, path := range []string{file.CertFile, file.KeyFile} {
+			info, err := os.Stat(path)
+			if err != nil {
+				return fmt.Errorf("stat %s: %w", path, err)
+			}
+			modTimes[path] = info.ModTime()
+		}
+
+		cert, err := tls.LoadX509KeyPair(file.CertFile, file.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load certificate %s: %w", file.CertFile, err)
+		}
+
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("parse certificate %s: %w", file.CertFile, err)
+			}
+		}
+
+		if fallback == nil {
+			fallback = &cert
+		}
+
+		for _, name := range cert.Leaf.DNSNames {
+			name = strings.ToLower(name)
+			if parent, ok := strings.CutPrefix(name, "*."); ok {
+				wildcards[parent] = &cert
+				continue
+			}
+			names[name] = &cert
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallback = fallback
+	s.names = names
+	s.wildcards = wildcards
+	s.modTimes = modTimes
+
+	return nil
+}
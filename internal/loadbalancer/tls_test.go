@@ -0,0 +1,170 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/testca"
+)
+
+// issueCertificate writes a new certificate and key to dir and returns their config
+func issueCertificate(t *testing.T, ca *testca.CA, dir, name string, names ...string) CertificateConfig {
+	t.Helper()
+
+	certFile, keyFile := ca.IssueFiles(t, dir, name, names...)
+	return CertificateConfig{CertFile: certFile, KeyFile: keyFile}
+}
+
+func TestCertStore(t *testing.T) {
+	ca := testca.New(t)
+	dir := t.TempDir()
+
+	defaultCert := issueCertificate(t, ca, dir, "default", "default.example.com")
+	apiCert := issueCertificate(t, ca, dir, "api", "api.example.com")
+	wildcardCert := issueCertificate(t, ca, dir, "wildcard", "*.games.example.com")
+
+	store, err := NewCertStore([]CertificateConfig{defaultCert, apiCert, wildcardCert})
+	if err != nil {
+		t.Fatalf("Failed to create cert store: %v", err)
+	}
+
+	tests := []struct {
+		serverName string
+		expected   string
+	}{
+		{serverName: "api.example.com", expected: "api.example.com"},
+		{serverName: "API.example.com.", expected: "api.example.com"},
+		{serverName: "legends.games.example.com", expected: "*.games.example.com"},
+		{serverName: "deep.legends.games.example.com", expected: "default.example.com"},
+		{serverName: "", expected: "default.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run("SNI "+tt.serverName, func(t *testing.T) {
+			cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+			if err != nil {
+				t.Fatalf("GetCertificate() error = %v", err)
+			}
+
+			if cert.Leaf.DNSNames[0] != tt.expected {
+				t.Errorf("Selected certificate for %v, expected %s", cert.Leaf.DNSNames, tt.expected)
+			}
+		})
+	}
+
+	t.Run("Certificates are reloaded when the files change", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go store.Watch(ctx, 10*time.Millisecond)
+
+		renewed := issueCertificate(t, ca, dir, "api", "api.example.com", "renewed.example.com")
+
+		// Make sure the modification time differs on file systems with a coarse resolution
+		future := time.Now().Add(time.Minute)
+		for _, path := range []string{renewed.CertFile, renewed.KeyFile} {
+			if err := os.Chtimes(path, future, future); err != nil {
+				t.Fatalf("Failed to change modification time: %v", err)
+			}
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			cert, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "renewed.example.com"})
+			if cert.Leaf.DNSNames[0] == "api.example.com" {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		t.Error("Renewed certificate was not loaded")
+	})
+}
+
+func TestTLSListener(t *testing.T) {
+	ca := testca.New(t)
+	dir := t.TempDir()
+
+	store, err := NewCertStore([]CertificateConfig{issueCertificate(t, ca, dir, "lb", "lb.example.com")})
+	if err != nil {
+		t.Fatalf("Failed to create cert store: %v", err)
+	}
+
+	cfg := DefaultTLSConfig()
+	cfg.MinVersion = "1.3"
+	tlsConfig, err := NewServerTLSConfig(cfg, store)
+	if err != nil {
+		t.Fatalf("Failed to create TLS config: %v", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	url := "https://" + listener.Addr().String() + "/"
+
+	t.Run("Client with a supported version", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:    ca.Pool,
+			ServerName: "lb.example.com",
+		}}}
+
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent || resp.TLS.Version != tls.VersionTLS13 {
+			t.Errorf("Unexpected response: %d over TLS version %x", resp.StatusCode, resp.TLS.Version)
+		}
+	})
+
+	t.Run("Client below the minimum version is rejected", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:    ca.Pool,
+			ServerName: "lb.example.com",
+			MaxVersion: tls.VersionTLS12,
+		}}}
+
+		if _, err := client.Get(url); err == nil {
+			t.Error("Expected handshake to fail")
+		}
+	})
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	cfg := DefaultTLSConfig()
+	cfg.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+
+	tlsConfig, err := NewServerTLSConfig(cfg, &CertStore{})
+	if err != nil {
+		t.Fatalf("NewServerTLSConfig() error = %v", err)
+	}
+
+	if tlsConfig.MinVersion != tls.VersionTLS12 || len(tlsConfig.CipherSuites) != 1 ||
+		tlsConfig.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Unexpected TLS config: version %x, cipher suites %v", tlsConfig.MinVersion, tlsConfig.CipherSuites)
+	}
+
+	cfg.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+	if _, err := NewServerTLSConfig(cfg, &CertStore{}); err == nil {
+		t.Error("Expected insecure cipher suite to be rejected")
+	}
+
+	cfg = DefaultTLSConfig()
+	cfg.MinVersion = "2.0"
+	if _, err := NewServerTLSConfig(cfg, &CertStore{}); err == nil {
+		t.Error("Expected unknown TLS version to be rejected")
+	}
+}
@@ -0,0 +1,67 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/tracing/tracingtest"
+)
+
+func TestTracePropagation(t *testing.T) {
+	exporter := tracingtest.InstallInMemory("loadbalancer")
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentSpanID = "00f067aa0ba902b7"
+
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	lb := newTestLoadBalancer(t, backend.URL)
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+	req.Header.Set("tracestate", "vendor=value")
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code: %d", rec.Code)
+	}
+
+	upstream := <-received
+	if !strings.HasPrefix(upstream, "00-"+traceID+"-") {
+		t.Fatalf("Backend received traceparent %q, expected trace %s", upstream, traceID)
+	}
+
+	spans := exporter.GetSpans()
+	names := make(map[string]string, len(spans))
+	for _, span := range spans {
+		if span.SpanContext.TraceID().String() != traceID {
+			t.Errorf("Span %s has trace ID %s, expected %s", span.Name, span.SpanContext.TraceID(), traceID)
+		}
+		names[span.Name] = span.SpanContext.SpanID().String()
+	}
+
+	for _, name := range []string{"loadbalancer.request", "loadbalancer.select_backend", "loadbalancer.upstream"} {
+		if _, ok := names[name]; !ok {
+			t.Errorf("Expected span %s to be recorded, got %v", name, names)
+		}
+	}
+
+	// The backend must be a child of the upstream span
+	if upstreamSpan := names["loadbalancer.upstream"]; !strings.Contains(upstream, upstreamSpan) {
+		t.Errorf("Backend received traceparent %q, expected parent span %s", upstream, upstreamSpan)
+	}
+
+	for _, span := range spans {
+		if span.Name == "loadbalancer.request" && span.Parent.SpanID().String() != parentSpanID {
+			t.Errorf("Request span has parent %s, expected %s", span.Parent.SpanID(), parentSpanID)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Protocols spoken to the backends
+const (
+	// UpstreamAuto uses HTTP/2 when a TLS backend offers it and HTTP/1.1 otherwise
+	UpstreamAuto = "auto"
+	// UpstreamHTTP1 always uses HTTP/1.1
+	UpstreamHTTP1 = "http1"
+	// UpstreamH2C uses cleartext HTTP/2 with prior knowledge, the backends must support h2c
+	UpstreamH2C = "h2c"
+)
+
+// TransportConfig tunes the connections from the load balancer to the backends
+type TransportConfig struct {
+	// Protocol is one of UpstreamAuto, UpstreamHTTP1 or UpstreamH2C
+	Protocol            string
+	DialTimeout         time.Duration
+	KeepAlive           time.Duration
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout limits the time a backend may take to start its response, it is not supported with h2c
+	ResponseHeaderTimeout time.Duration
+	// IdleConnTimeout is how long an unused connection is kept open
+	IdleConnTimeout     time.Duration
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the number of connections to a single backend, 0 means no limit
+	MaxConnsPerHost int
+}
+
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		Protocol:              UpstreamAuto,
+		DialTimeout:           5 * time.Second,
+		KeepAlive:             30 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          512,
+		MaxIdleConnsPerHost:   64,
+	}
+}
+
+// ConnStats describes the connections of the shared transport to a single backend
+type ConnStats struct {
+	// OpenConns is the number of connections that are currently open, both idle and in use
+	OpenConns  int64  `json:"open_connections"`
+	Dials      uint64 `json:"dials"`
+	DialErrors uint64 `json:"dial_errors"`
+	// NewConns and ReusedConns count the requests that were sent over a new or an existing connection
+	NewConns    uint64 `json:"new_connections"`
+	ReusedConns uint64 `json:"reused_connections"`
+}
+
+// UpstreamTransport is the transport shared by all backends, it keeps track of the connections to every backend
+type UpstreamTransport struct {
+	http.RoundTripper
+	conns *connTracker
+}
+
+// CloseIdleConnections closes the connections that are not in use
+func (t *UpstreamTransport) CloseIdleConnections() {
+	if closer, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// newUpstreamTransport creates the transport used to proxy requests and run health checks against a pool
+func newUpstreamTransport(cfg TransportConfig, tlsCfg UpstreamTLSConfig) (*UpstreamTransport, error) {
+	var tlsConfig *tls.Config
+	if tlsCfg.Enabled() {
+		var err error
+		if tlsConfig, err = NewUpstreamTLSConfig(tlsCfg); err != nil {
+			return nil, err
+		}
+	}
+
+	conns := &connTracker{hosts: make(map[string]*connStats)}
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: cfg.KeepAlive}
+	dial := conns.dialContext(dialer.DialContext)
+
+	switch cfg.Protocol {
+	case UpstreamAuto, UpstreamHTTP1, "":
+		transport := &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dial,
+			ForceAttemptHTTP2:     true,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+			ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+			IdleConnTimeout:       cfg.IdleConnTimeout,
+			MaxIdleConns:          cfg.MaxIdleConns,
+			MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       cfg.MaxConnsPerHost,
+			ExpectContinueTimeout: time.Second,
+		}
+
+		if cfg.Protocol == UpstreamHTTP1 {
+			// A non-nil empty map disables the HTTP/2 upgrade during the TLS handshake
+			transport.ForceAttemptHTTP2 = false
+			transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		}
+
+		return &UpstreamTransport{RoundTripper: transport, conns: conns}, nil
+	case UpstreamH2C:
+		if tlsConfig != nil {
+			return nil, errors.New("h2c can not be combined with upstream tls")
+		}
+
+		transport := &http2.Transport{
+			AllowHTTP:       true,
+			IdleConnTimeout: cfg.IdleConnTimeout,
+			// h2c connections are plain TCP connections, the TLS config is never used
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		}
+
+		return &UpstreamTransport{RoundTripper: transport, conns: conns}, nil
+	default:
+		return nil, fmt.Errorf("unknown upstream protocol %q", cfg.Protocol)
+	}
+}
+
+// connTracker counts the connections of a transport per dialed address
+type connTracker struct {
+	mu    sync.Mutex
+	hosts map[string]*connStats
+}
+
+type connStats struct {
+	open       atomic.Int64
+	dials      atomic.Uint64
+	dialErrors atomic.Uint64
+}
+
+// host returns the statistics of the given address, they are created on first use
+func (t *connTracker) host(addr string) *connStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.hosts[addr]
+	if !ok {
+		stats = &connStats{}
+		t.hosts[addr] = stats
+	}
+	return stats
+}
+
+// dialContext wraps dial so that every connection is counted until it is closed
+func (t *connTracker) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		stats := t.host(addr)
+		stats.dials.Add(1)
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			stats.dialErrors.Add(1)
+			return nil, err
+		}
+
+		stats.open.Add(1)
+		return &trackedConn{Conn: conn, stats: stats}, nil
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	stats *connStats
+	once  sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.stats.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// dialAddr returns the address the transport dials for the URL, including the default port of the scheme
+func dialAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
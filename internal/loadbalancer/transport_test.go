@@ -0,0 +1,99 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/servicediscovery"
+)
+
+func TestUpstreamTransportConfig(t *testing.T) {
+	cfg := DefaultTransportConfig()
+	cfg.DialTimeout = time.Second
+	cfg.ResponseHeaderTimeout = 2 * time.Second
+	cfg.MaxIdleConnsPerHost = 16
+	cfg.MaxConnsPerHost = 32
+
+	upstream, err := newUpstreamTransport(cfg, UpstreamTLSConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+
+	transport := upstream.RoundTripper.(*http.Transport)
+	if transport.ResponseHeaderTimeout != 2*time.Second || transport.MaxIdleConnsPerHost != 16 ||
+		transport.MaxConnsPerHost != 32 || transport.IdleConnTimeout != cfg.IdleConnTimeout {
+		t.Errorf("Transport does not use the configured settings: %+v", transport)
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	// A closed server gives an address that refuses connections
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	transport, err := newUpstreamTransport(DefaultTransportConfig(), UpstreamTLSConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+
+	lb := NewLoadBalancer(servicediscovery.NewStaticServiceWatcher([]string{backend.URL, down.URL}), "backend", transport)
+	if err := lb.StartServiceWatcher(); err != nil {
+		t.Fatalf("Failed to start service watcher: %v", err)
+	}
+
+	// Send three requests to every backend, connections to the working backend are reused
+	for range 6 {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	statuses := make(map[string]BackendStatus)
+	for _, status := range lb.BackendStatuses() {
+		statuses[status.Addr] = status
+	}
+
+	expected := ConnStats{OpenConns: 1, Dials: 1, NewConns: 1, ReusedConns: 2}
+	if conns := statuses[backend.URL].Connections; conns != expected {
+		t.Errorf("Unexpected connection stats of the working backend: got %+v want %+v", conns, expected)
+	}
+
+	expected = ConnStats{Dials: 3, DialErrors: 3}
+	if conns := statuses[down.URL].Connections; conns != expected {
+		t.Errorf("Unexpected connection stats of the unreachable backend: got %+v want %+v", conns, expected)
+	}
+
+	transport.CloseIdleConnections()
+	for _, status := range lb.BackendStatuses() {
+		if status.Connections.OpenConns != 0 {
+			t.Errorf("Backend %s has %d open connections after closing idle connections", status.ID, status.Connections.OpenConns)
+		}
+	}
+}
+
+func TestDialAddr(t *testing.T) {
+	tests := map[string]string{
+		"http://backend:8081":  "backend:8081",
+		"http://backend":       "backend:80",
+		"https://backend":      "backend:443",
+		"https://[::1]":        "[::1]:443",
+		"http://10.0.0.1:8443": "10.0.0.1:8443",
+	}
+
+	for raw, expected := range tests {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", raw, err)
+		}
+
+		if addr := dialAddr(u); addr != expected {
+			t.Errorf("dialAddr(%s) = %s, want %s", raw, addr, expected)
+		}
+	}
+}
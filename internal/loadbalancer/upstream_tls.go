@@ -0,0 +1,87 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// UpstreamTLSConfig configures the TLS connections from the load balancer to backends. The flags apply to every pool,
+// a pool with a config of its own uses that instead.
+type UpstreamTLSConfig struct {
+	// CAFile is a PEM bundle used to verify backend certificates instead of the system roots
+	CAFile string `json:"ca_file,omitempty"`
+	// CertFile and KeyFile hold the client certificate presented to backends that require mutual TLS
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// ServerName overrides the name used for SNI and certificate verification, e.g. when backends are addressed by IP
+	ServerName string `json:"server_name,omitempty"`
+	// PinnedKeys are base64 encoded SHA-256 hashes of the subject public key info of accepted certificates. When set,
+	// the chain presented by a backend must contain at least one of them.
+	PinnedKeys []string `json:"pinned_keys,omitempty"`
+}
+
+// Enabled reports whether any upstream TLS setting was configured
+func (c UpstreamTLSConfig) Enabled() bool {
+	return c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" || c.ServerName != "" || len(c.PinnedKeys) > 0
+}
+
+// NewUpstreamTLSConfig creates the client TLS configuration used to connect to backends
+func NewUpstreamTLSConfig(cfg UpstreamTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: cfg.ServerName,
+	}
+
+	if cfg.CAFile != "" {
+		bundle, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca bundle: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("a client certificate needs both a certificate and a key file")
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(cfg.PinnedKeys) > 0 {
+		pins := make(map[string]bool, len(cfg.PinnedKeys))
+		for _, pin := range cfg.PinnedKeys {
+			pins[pin] = true
+		}
+		tlsConfig.VerifyConnection = verifyPinnedKeys(pins)
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyPinnedKeys runs after the regular certificate verification and additionally requires a pinned key
+func verifyPinnedKeys(pins map[string]bool) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		for _, cert := range state.PeerCertificates {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+				return nil
+			}
+		}
+
+		return errors.New("backend certificate does not match any pinned key")
+	}
+}
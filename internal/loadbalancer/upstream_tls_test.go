@@ -0,0 +1,209 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jeroenpf/coda-homework-assignment/internal/servicediscovery"
+	"github.com/jeroenpf/coda-homework-assignment/internal/testca"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	ca := testca.New(t)
+	dir := t.TempDir()
+
+	// The backend is only valid for backend.internal and requires a client certificate signed by the CA
+	serverCertPEM, serverKeyPEM := ca.Issue(t, "backend.internal")
+	serverCert, err := tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+	if err != nil {
+		t.Fatalf("Failed to load server certificate: %v", err)
+	}
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Client-Cert", r.TLS.PeerCertificates[0].Subject.CommonName)
+		w.WriteHeader(http.StatusOK)
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    ca.Pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	caFile := ca.WriteFile(t, dir)
+	certFile, keyFile := ca.IssueFiles(t, dir, "client", "loadbalancer")
+
+	block, _ := pem.Decode(serverCertPEM)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Failed to parse server certificate: %v", err)
+	}
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+
+	mutualTLS := UpstreamTLSConfig{
+		CAFile:     caFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "backend.internal",
+	}
+
+	tests := []struct {
+		name           string
+		config         func() UpstreamTLSConfig
+		expectedStatus int
+	}{
+		{
+			name:           "Mutual TLS with SNI override",
+			config:         func() UpstreamTLSConfig { return mutualTLS },
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Missing client certificate",
+			config: func() UpstreamTLSConfig {
+				cfg := mutualTLS
+				cfg.CertFile, cfg.KeyFile = "", ""
+				return cfg
+			},
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name: "Unknown CA",
+			config: func() UpstreamTLSConfig {
+				cfg := mutualTLS
+				cfg.CAFile = ""
+				return cfg
+			},
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name: "Server name mismatch",
+			config: func() UpstreamTLSConfig {
+				cfg := mutualTLS
+				cfg.ServerName = "other.internal"
+				return cfg
+			},
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name: "Matching pinned key",
+			config: func() UpstreamTLSConfig {
+				cfg := mutualTLS
+				cfg.PinnedKeys = []string{"bm90IHRoZSBrZXk=", pin}
+				return cfg
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Pinned key mismatch",
+			config: func() UpstreamTLSConfig {
+				cfg := mutualTLS
+				cfg.PinnedKeys = []string{"bm90IHRoZSBrZXk="}
+				return cfg
+			},
+			expectedStatus: http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, err := newUpstreamTransport(DefaultTransportConfig(), tt.config())
+			if err != nil {
+				t.Fatalf("Failed to create transport: %v", err)
+			}
+
+			lb := NewLoadBalancer(servicediscovery.NewStaticServiceWatcher([]string{backend.URL}), "backend", transport)
+			if err := lb.StartServiceWatcher(); err != nil {
+				t.Fatalf("Failed to start service watcher: %v", err)
+			}
+
+			rec := httptest.NewRecorder()
+			lb.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("Unexpected status code: got %d want %d", rec.Code, tt.expectedStatus)
+			}
+
+			if rec.Code == http.StatusOK && rec.Header().Get("X-Client-Cert") != "loadbalancer" {
+				t.Errorf("Backend did not see the client certificate: %q", rec.Header().Get("X-Client-Cert"))
+			}
+		})
+	}
+}
+
+func TestPoolUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	// Every backend has its own CA and only accepts client certificates signed by it
+	newBackend := func(name string) (*httptest.Server, UpstreamTLSConfig) {
+		ca := testca.New(t)
+		certPEM, keyPEM := ca.Issue(t, name+".internal")
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf("Failed to load server certificate: %v", err)
+		}
+
+		backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Client-Cert", r.TLS.PeerCertificates[0].Subject.CommonName)
+		}))
+		backend.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: ca.Pool, ClientAuth: tls.RequireAndVerifyClientCert}
+		backend.StartTLS()
+		t.Cleanup(backend.Close)
+
+		caDir := filepath.Join(dir, name)
+		if err := os.Mkdir(caDir, 0o700); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		certFile, keyFile := ca.IssueFiles(t, caDir, "client", "lb-"+name)
+		return backend, UpstreamTLSConfig{CAFile: ca.WriteFile(t, caDir), CertFile: certFile, KeyFile: keyFile, ServerName: name + ".internal"}
+	}
+	scores, scoresTLS := newBackend("scores")
+	players, playersTLS := newBackend("players")
+
+	// The flags configure the scores backend, the players pool brings its own CA and client certificate
+	config := DefaultConfig()
+	config.AdminAddr = ""
+	config.AccessLog.Enabled = false
+	config.UpstreamTLS = scoresTLS
+	config.Pools = []PoolConfig{
+		{Name: "scores", BackendUrls: []string{scores.URL}},
+		{Name: "players", BackendUrls: []string{players.URL}, UpstreamTLS: &playersTLS},
+	}
+	config.Routes = []RouteConfig{
+		{Name: "players", PathPrefix: "/players", Pool: "players"},
+		{Name: "scores", Pool: "scores"},
+	}
+
+	srv, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	for _, pool := range srv.router.Pools() {
+		if err := pool.lb.StartServiceWatcher(); err != nil {
+			t.Fatalf("Failed to discover backends: %v", err)
+		}
+	}
+
+	for path, client := range map[string]string{"/scores": "lb-scores", "/players": "lb-players"} {
+		rr := httptest.NewRecorder()
+		srv.srv.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusOK || rr.Header().Get("X-Client-Cert") != client {
+			t.Errorf("Expected %s to reach its backend as %s, got %d %q", path, client, rr.Code, rr.Header().Get("X-Client-Cert"))
+		}
+	}
+
+	// A key without a certificate is a mistake, not a request for plain TLS
+	config.Pools[1].UpstreamTLS = &UpstreamTLSConfig{KeyFile: playersTLS.KeyFile}
+	if _, err := NewServer(config); err == nil {
+		t.Error("Expected a key file without a certificate to be rejected")
+	}
+}
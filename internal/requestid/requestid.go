@@ -0,0 +1,93 @@
+package requestid
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// Header carries the ID that correlates a request across hops
+const Header = "X-Request-ID"
+
+const maxLength = 128
+
+type contextKey struct{}
+
+// New generates a new request ID
+func New() string {
+	return uuid.NewString()
+}
+
+// WithContext returns a copy of ctx that carries the request ID
+func WithContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID of the context, or an empty string when there is none
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Middleware makes sure every request has an ID. When trustIncoming is set a valid ID sent by the client is reused,
+// otherwise a new one is generated. The ID is stored in the request context, set on the request headers so it is
+// forwarded upstream, and returned to the client.
+func Middleware(trustIncoming bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !trustIncoming || !valid(id) {
+			id = New()
+		}
+
+		r = r.Clone(WithContext(r.Context(), id))
+		r.Header.Set(Header, id)
+		w.Header().Set(Header, id)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// valid only accepts IDs that are safe to write to logs and headers
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// logHandler adds the request ID of the context to every record
+type logHandler struct {
+	slog.Handler
+}
+
+// NewLogHandler wraps a slog handler so that records logged with a request context include its request ID
+func NewLogHandler(handler slog.Handler) slog.Handler {
+	return logHandler{Handler: handler}
+}
+
+func (h logHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := FromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return logHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h logHandler) WithGroup(name string) slog.Handler {
+	return logHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,77 @@
+package requestid
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		incoming      string
+		trustIncoming bool
+		expectReused  bool
+	}{
+		{
+			name:          "Generates an ID when missing",
+			trustIncoming: true,
+		},
+		{
+			name:          "Reuses a trusted incoming ID",
+			incoming:      "client-id-1",
+			trustIncoming: true,
+			expectReused:  true,
+		},
+		{
+			name:     "Replaces an untrusted incoming ID",
+			incoming: "client-id-1",
+		},
+		{
+			name:          "Replaces an invalid incoming ID",
+			incoming:      "bad id\nwith newline",
+			trustIncoming: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fromContext, forwarded string
+			handler := Middleware(tt.trustIncoming, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fromContext = FromContext(r.Context())
+				forwarded = r.Header.Get(Header)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set(Header, tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			returned := rec.Header().Get(Header)
+			if returned == "" || returned != fromContext || returned != forwarded {
+				t.Fatalf("ID mismatch: returned %q, context %q, forwarded %q", returned, fromContext, forwarded)
+			}
+
+			if reused := returned == tt.incoming; reused != tt.expectReused {
+				t.Errorf("Expected reuse of incoming ID to be %v, got ID %q", tt.expectReused, returned)
+			}
+		})
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewLogHandler(slog.NewTextHandler(&buf, nil))).With("component", "test")
+
+	logger.InfoContext(WithContext(context.Background(), "abc-123"), "handled")
+
+	if !strings.Contains(buf.String(), "component=test") || !strings.Contains(buf.String(), "request_id=abc-123") {
+		t.Errorf("Expected request ID in log line, got %q", buf.String())
+	}
+}
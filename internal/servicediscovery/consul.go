@@ -65,8 +65,15 @@ func (w *ConsulServiceWatcher) watch(serviceName string, handler func([]string))
 			var urls []string
 			for _, service := range services {
 				addr := strings.Replace(service.Service.Address, "host.docker.internal", "localhost", 1)
-				slog.Info("found service", "addr", addr, "port", service.Service.Port)
-				urls = append(urls, fmt.Sprintf("http://%s:%d", addr, service.Service.Port))
+
+				// Services announce whether they serve HTTPS through their metadata
+				scheme := service.Service.Meta["scheme"]
+				if scheme == "" {
+					scheme = "http"
+				}
+
+				slog.Info("found service", "addr", addr, "port", service.Service.Port, "scheme", scheme)
+				urls = append(urls, fmt.Sprintf("%s://%s:%d", scheme, addr, service.Service.Port))
 			}
 			handler(urls)
 		}
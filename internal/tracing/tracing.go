@@ -0,0 +1,122 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Supported span exporters
+const (
+	ExporterNone = "none"
+	ExporterOTLP = "otlp"
+)
+
+type Config struct {
+	ServiceName string
+	// Exporter is either ExporterNone or ExporterOTLP
+	Exporter string
+	// Endpoint is the host:port of the OTLP/HTTP collector
+	Endpoint string
+	Insecure bool
+	// SampleRatio is the fraction of new traces that are sampled, traces started upstream follow the parent decision
+	SampleRatio float64
+}
+
+func DefaultConfig(serviceName string) Config {
+	return Config{
+		ServiceName: serviceName,
+		Exporter:    ExporterNone,
+		Endpoint:    "localhost:4318",
+		Insecure:    true,
+		SampleRatio: 1,
+	}
+}
+
+// NewExporter creates the span exporter selected in the config
+func NewExporter(ctx context.Context, cfg Config) (sdktrace.SpanExporter, error) {
+	switch cfg.Exporter {
+	case ExporterNone, "":
+		return nil, nil
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+}
+
+// NewProvider creates a tracer provider that sends spans to the given exporter. A nil exporter results in a provider
+// that still propagates trace context but does not record anything.
+func NewProvider(cfg Config, exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	}
+
+	if exporter != nil {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	return sdktrace.NewTracerProvider(opts...)
+}
+
+// Setup installs a global tracer provider and the W3C trace context propagator. The returned function flushes and
+// stops the provider.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	exporter, err := NewExporter(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("create trace exporter: %w", err)
+	}
+
+	provider := NewProvider(cfg, exporter)
+	Install(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Install makes the provider and the W3C propagator the global defaults
+func Install(provider trace.TracerProvider) {
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+}
+
+// Extract returns a context that continues the trace found in the headers of the request
+func Extract(r *http.Request) context.Context {
+	return otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+// Inject writes the trace context of ctx into the headers of the request
+func Inject(ctx context.Context, r *http.Request) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
+}
+
+// Tracer returns a named tracer from the global provider. Callers look it up on every use instead of keeping it, so
+// that replacing the global provider, as tests do, takes effect.
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer(name)
+}
+
+// RequestAttributes returns the common span attributes of an incoming request
+func RequestAttributes(r *http.Request) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.HTTPRequestMethodKey.String(r.Method),
+		semconv.URLPath(r.URL.Path),
+		semconv.ServerAddress(r.Host),
+	}
+}
@@ -0,0 +1,22 @@
+// Package tracingtest records the spans of tests in memory
+package tracingtest
+
+import (
+	"github.com/jeroenpf/coda-homework-assignment/internal/tracing"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// InstallInMemory installs a provider that synchronously records finished spans in memory
+func InstallInMemory(serviceName string) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+
+	tracing.Install(sdktrace.NewTracerProvider(
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+		sdktrace.WithSyncer(exporter),
+	))
+
+	return exporter
+}